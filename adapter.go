@@ -2,10 +2,14 @@ package discovery
 
 import (
 	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 
 	"github.com/overmindtech/sdp-go"
 	"github.com/overmindtech/sdpcache"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/proto"
 )
 
 // Adapter is capable of finding information about items
@@ -53,6 +57,15 @@ type CachingAdapter interface {
 	Cache() *sdpcache.Cache
 }
 
+// CacheProvider Is an adapter of items that supports caching using any
+// `Cache` implementation, such as `DiskCache`. The engine purges the cache
+// while running and clears it when stopped. This takes precedence over
+// `CachingAdapter`
+type CacheProvider interface {
+	Adapter
+	Cache() Cache
+}
+
 // SearchableAdapter Is an adapter of items that supports searching
 type SearchableAdapter interface {
 	Adapter
@@ -72,12 +85,107 @@ type HiddenAdapter interface {
 	Hidden() bool
 }
 
+// HealthCheckableAdapter adapters that define a `HealthCheck()` method are
+// able to report whether they are currently able to serve queries, for example
+// whether their credentials are still valid. This is used when determining
+// whether the engine is ready
+type HealthCheckableAdapter interface {
+	Adapter
+	HealthCheck(ctx context.Context) error
+}
+
+// DynamicScopesAdapter adapters whose scopes change at runtime, for example
+// when a new account or namespace is discovered, can notify the engine by
+// sending on the channel returned by `ScopesChanged()`. The engine will then
+// re-check for overlapping scopes and send a heartbeat so that the new scopes
+// are advertised straight away. `Scopes()` is called for every query, so it
+// must always return the current scopes and be safe to call concurrently
+type DynamicScopesAdapter interface {
+	Adapter
+
+	// ScopesChanged Returns a channel that receives a value whenever the
+	// result of `Scopes()` changes. This should return the same channel every
+	// time it is called. Sends should not block, so either use a buffered
+	// channel or skip sending if a notification is already pending
+	ScopesChanged() <-chan struct{}
+}
+
+// GlobScopesAdapter adapters that define a `GlobScopes()` method returning
+// true have their scopes treated as glob patterns, rather than requiring
+// queries to match them exactly. The syntax is that of `path.Match()`: `*`
+// matches any sequence of characters other than `/`, `?` matches any single
+// character other than `/`, and `[...]` matches a character class. For
+// example the scope `123456789012.*` would match queries for any region in
+// that AWS account.
+//
+// Patterns can't be expanded, so when a query has a wildcard scope the
+// adapter is queried with the wildcard scope as-is, in the same way as an
+// adapter with the scope "*"
+type GlobScopesAdapter interface {
+	Adapter
+	GlobScopes() bool
+}
+
+// WeightedAdapter adapters that define a `Weight()` method are able to express
+// how much their results should be trusted relative to other adapters of the
+// same type. If multiple adapters return an item with the same
+// GloballyUniqueName for a single query, only the item from the adapter with
+// the highest weight will be returned. Adapters that don't implement this
+// interface have a weight of zero
+type WeightedAdapter interface {
+	Adapter
+	Weight() int
+}
+
+// RateLimitedAdapter adapters that define these methods will have their
+// queries throttled by the engine, independently of `MaxParallelExecutions`.
+// Queries wait for the adapter's concurrency limit before taking a slot in the
+// shared execution pool, which stops a single slow or rate limited API from
+// consuming every execution slot. Every call to the adapter, including
+// retries, waits for the rate limit
+type RateLimitedAdapter interface {
+	Adapter
+
+	// MaxConcurrency The maximum number of queries that will be executed
+	// against this adapter in parallel. Zero means unlimited
+	MaxConcurrency() int
+
+	// RateLimit The rate at which queries can be executed against this
+	// adapter, and the maximum burst size. A limit of `rate.Inf` means
+	// unlimited
+	RateLimit() (rate.Limit, int)
+}
+
+// adapterWeight Returns the weight of an adapter, or zero if it doesn't
+// implement `WeightedAdapter`
+func adapterWeight(adapter Adapter) int {
+	if w, ok := adapter.(WeightedAdapter); ok {
+		return w.Weight()
+	}
+
+	return 0
+}
+
+// ErrStreamClosed is returned when sending to a QueryResultStream that has
+// been closed
+var ErrStreamClosed = errors.New("query result stream is closed")
+
+// ErrStreamLimitReached is returned when sending an item to a
+// QueryResultStream that has already reached its item or byte limit
+var ErrStreamLimitReached = errors.New("query result stream limit reached")
+
 // QueryResultStream is a stream of items and errors that are returned from a
 // query. Adapters should send items to the stream as soon as they are
 // discovered using the `SendItem` method and should send any errors that occur
 // using the `SendError` method. These errors will be considered non-fatal. If
 // the process encounters a fatal error it should return an error to the caller
-// rather then sending one on the stream
+// rather then sending one on the stream.
+//
+// `SendItem` and `SendError` silently drop results once the stream has been
+// closed, the query's context has been cancelled, or for items, the stream's
+// limits have been reached. Adapters that want to stop discovering items when
+// this happens should use `TrySendItem` and `TrySendError`, which return an
+// error instead, or check `LimitReached()`
 type QueryResultStream struct {
 	items       chan *sdp.Item
 	errs        chan error
@@ -86,6 +194,64 @@ type QueryResultStream struct {
 	open        bool
 	wg          sync.WaitGroup
 	mutex       sync.RWMutex
+
+	// Closed when `Close()` is called so that blocked senders can give up
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	ctx        context.Context
+	bufferSize int
+
+	// Limits on the number of items and total size of items that can be
+	// sent, zero means unlimited
+	itemLimit int
+	byteLimit int
+
+	// The number and total size of the items that have been accepted, which
+	// are checked and updated together under `limitMutex`
+	numItems   int64
+	numBytes   int64
+	limitMutex sync.Mutex
+
+	// Set once an item has been rejected because of the limits
+	truncated atomic.Bool
+}
+
+// QueryResultStreamOption configures a QueryResultStream
+type QueryResultStreamOption func(*QueryResultStream)
+
+// WithStreamContext Sets the context of the query that the stream is for.
+// Once this is cancelled, sending to the stream will return the context's
+// error rather than blocking
+func WithStreamContext(ctx context.Context) QueryResultStreamOption {
+	return func(qrs *QueryResultStream) {
+		qrs.ctx = ctx
+	}
+}
+
+// WithStreamBufferSize Sets how many items and errors can be buffered before
+// sending blocks. Defaults to zero
+func WithStreamBufferSize(size int) QueryResultStreamOption {
+	return func(qrs *QueryResultStream) {
+		qrs.bufferSize = size
+	}
+}
+
+// WithStreamItemLimit Sets the maximum number of items that can be sent to
+// the stream. Zero means unlimited
+func WithStreamItemLimit(limit int) QueryResultStreamOption {
+	return func(qrs *QueryResultStream) {
+		qrs.itemLimit = limit
+	}
+}
+
+// WithStreamByteLimit Sets the maximum total size in bytes of the items that
+// can be sent to the stream. The item that crosses the limit is still sent.
+// Zero means unlimited
+func WithStreamByteLimit(limit int) QueryResultStreamOption {
+	return func(qrs *QueryResultStream) {
+		qrs.byteLimit = limit
+	}
 }
 
 // ItemHandler is a function that can be used to handle items as they are
@@ -97,15 +263,22 @@ type ItemHandler func(item *sdp.Item)
 type ErrHandler func(err error)
 
 // NewQueryResultStream creates a new QueryResultStream
-func NewQueryResultStream(itemHandler ItemHandler, errHandler ErrHandler) *QueryResultStream {
+func NewQueryResultStream(itemHandler ItemHandler, errHandler ErrHandler, opts ...QueryResultStreamOption) *QueryResultStream {
 	stream := &QueryResultStream{
-		items:       make(chan *sdp.Item),
-		errs:        make(chan error),
 		itemHandler: itemHandler,
 		errHandler:  errHandler,
 		open:        true,
+		closing:     make(chan struct{}),
+		ctx:         context.Background(),
+	}
+
+	for _, opt := range opts {
+		opt(stream)
 	}
 
+	stream.items = make(chan *sdp.Item, stream.bufferSize)
+	stream.errs = make(chan error, stream.bufferSize)
+
 	stream.wg.Add(2)
 	go stream.processItems()
 	go stream.processErrors()
@@ -113,29 +286,141 @@ func NewQueryResultStream(itemHandler ItemHandler, errHandler ErrHandler) *Query
 	return stream
 }
 
-// SendItem sends an item to the stream
+// SendItem sends an item to the stream. The item is dropped if the stream is
+// closed, its limits have been reached, or the query has been cancelled. Use
+// `TrySendItem` to find out whether the item was sent
 func (qrs *QueryResultStream) SendItem(item *sdp.Item) {
+	_ = qrs.TrySendItem(item)
+}
+
+// SendError sends an error to the stream. The error is dropped if the stream
+// is closed or the query has been cancelled. Use `TrySendError` to find out
+// whether the error was sent
+func (qrs *QueryResultStream) SendError(err error) {
+	_ = qrs.TrySendError(err)
+}
+
+// TrySendItem sends an item to the stream. Returns `ErrStreamClosed` if the
+// stream is closed, `ErrStreamLimitReached` if the stream's limits have been
+// reached, or the context's error if the query has been cancelled
+func (qrs *QueryResultStream) TrySendItem(item *sdp.Item) error {
 	qrs.mutex.RLock()
 	defer qrs.mutex.RUnlock()
-	if qrs.open {
-		qrs.items <- item
+
+	if !qrs.open {
+		return ErrStreamClosed
 	}
+
+	if item != nil && !qrs.accept(item) {
+		qrs.truncated.Store(true)
+		return ErrStreamLimitReached
+	}
+
+	return send(qrs, qrs.items, item)
 }
 
-// SendError sends an error to the stream
-func (qrs *QueryResultStream) SendError(err error) {
+// TrySendError sends an error to the stream. Returns `ErrStreamClosed` if the
+// stream is closed, or the context's error if the query has been cancelled
+func (qrs *QueryResultStream) TrySendError(err error) error {
 	qrs.mutex.RLock()
 	defer qrs.mutex.RUnlock()
-	if qrs.open {
-		qrs.errs <- err
+
+	if !qrs.open {
+		return ErrStreamClosed
+	}
+
+	return send(qrs, qrs.errs, err)
+}
+
+// accept Counts an item towards the stream's limits, returning false without
+// counting it if the limits have already been reached
+func (qrs *QueryResultStream) accept(item *sdp.Item) bool {
+	if qrs.itemLimit <= 0 && qrs.byteLimit <= 0 {
+		return true
+	}
+
+	qrs.limitMutex.Lock()
+	defer qrs.limitMutex.Unlock()
+
+	if qrs.limitReached() {
+		return false
+	}
+
+	qrs.numItems++
+	if qrs.byteLimit > 0 {
+		qrs.numBytes += int64(proto.Size(item))
+	}
+
+	return true
+}
+
+// send Sends a value to one of the stream's channels, giving up if the
+// stream is closed or the context is cancelled while waiting. The read lock
+// must be held by the caller
+func send[T any](qrs *QueryResultStream, ch chan<- T, value T) error {
+	// Prefer sending if there is room so that results aren't dropped just
+	// because the stream is closing at the same time
+	select {
+	case ch <- value:
+		return nil
+	default:
+	}
+
+	select {
+	case ch <- value:
+		return nil
+	case <-qrs.ctx.Done():
+		return qrs.ctx.Err()
+	case <-qrs.closing:
+		return ErrStreamClosed
+	}
+}
+
+// LimitReached Returns whether the stream has reached its item or byte limit,
+// meaning that any more items will be rejected. Adapters can use this to stop
+// discovering items early. This doesn't mean that any items were rejected, see
+// `Truncated()`
+func (qrs *QueryResultStream) LimitReached() bool {
+	qrs.limitMutex.Lock()
+	defer qrs.limitMutex.Unlock()
+
+	return qrs.limitReached()
+}
+
+// limitReached Returns whether the limits have been reached. `limitMutex`
+// must be held by the caller
+func (qrs *QueryResultStream) limitReached() bool {
+	if qrs.itemLimit > 0 && qrs.numItems >= int64(qrs.itemLimit) {
+		return true
+	}
+
+	if qrs.byteLimit > 0 && qrs.numBytes >= int64(qrs.byteLimit) {
+		return true
 	}
+
+	return false
+}
+
+// Truncated Returns whether any items were rejected because the stream's
+// limits had been reached
+func (qrs *QueryResultStream) Truncated() bool {
+	return qrs.truncated.Load()
 }
 
 // Close closes the stream and waits for all handlers to finish. This should be
 // called by the caller, and not by adapters themselves
 func (qrs *QueryResultStream) Close() {
+	// Release any senders that are blocked so that they give up the read
+	// lock
+	qrs.closeOnce.Do(func() {
+		close(qrs.closing)
+	})
+
 	qrs.mutex.Lock()
 	defer qrs.mutex.Unlock()
+	if !qrs.open {
+		return
+	}
 	qrs.open = false
 	close(qrs.items)
 	close(qrs.errs)
@@ -779,3 +779,146 @@ func TestNewQueryResultStream(t *testing.T) {
 		t.Errorf("Expected stream to be closed last. Results: %v", order)
 	}
 }
+
+func TestQueryResultStreamClosed(t *testing.T) {
+	stream := NewQueryResultStream(func(item *sdp.Item) {}, func(err error) {})
+	stream.Close()
+
+	if err := stream.TrySendItem(&sdp.Item{}); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("expected ErrStreamClosed, got %v", err)
+	}
+
+	if err := stream.TrySendError(errors.New("test")); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("expected ErrStreamClosed, got %v", err)
+	}
+
+	// Closing twice should be safe
+	stream.Close()
+}
+
+func TestQueryResultStreamCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// A handler that never finishes, like a caller that has stopped reading
+	block := make(chan struct{})
+	defer close(block)
+
+	stream := NewQueryResultStream(
+		func(item *sdp.Item) { <-block },
+		func(err error) {},
+		WithStreamContext(ctx),
+	)
+
+	// The first item is taken by the handler, the second can't be sent
+	if err := stream.TrySendItem(&sdp.Item{}); err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error)
+	go func() {
+		result <- stream.TrySendItem(&sdp.Item{})
+	}()
+
+	cancel()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected TrySendItem to return once the context was cancelled")
+	}
+}
+
+func TestQueryResultStreamBuffer(t *testing.T) {
+	block := make(chan struct{})
+
+	stream := NewQueryResultStream(
+		func(item *sdp.Item) { <-block },
+		func(err error) {},
+		WithStreamBufferSize(5),
+	)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// One is taken by the handler, the rest are buffered
+		for range 6 {
+			if err := stream.TrySendItem(&sdp.Item{}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected items to be buffered without blocking")
+	}
+
+	close(block)
+	stream.Close()
+}
+
+func TestQueryResultStreamLimits(t *testing.T) {
+	t.Run("items", func(t *testing.T) {
+		var handled int
+		stream := NewQueryResultStream(
+			func(item *sdp.Item) { handled++ },
+			func(err error) {},
+			WithStreamItemLimit(2),
+		)
+
+		for i := range 2 {
+			if err := stream.TrySendItem(&sdp.Item{}); err != nil {
+				t.Errorf("expected item %v to be sent, got %v", i, err)
+			}
+		}
+
+		if !stream.LimitReached() {
+			t.Error("expected limit to be reached")
+		}
+		if stream.Truncated() {
+			t.Error("expected the stream not to be truncated when no items were rejected")
+		}
+
+		if err := stream.TrySendItem(&sdp.Item{}); !errors.Is(err, ErrStreamLimitReached) {
+			t.Errorf("expected ErrStreamLimitReached, got %v", err)
+		}
+
+		if !stream.Truncated() {
+			t.Error("expected the stream to be truncated")
+		}
+
+		stream.Close()
+
+		if handled != 2 {
+			t.Errorf("expected 2 items to be handled, got %v", handled)
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		item := &sdp.Item{
+			Type:            "person",
+			UniqueAttribute: "name",
+			Scope:           "test",
+		}
+
+		stream := NewQueryResultStream(
+			func(item *sdp.Item) {},
+			func(err error) {},
+			WithStreamByteLimit(1),
+		)
+		defer stream.Close()
+
+		if err := stream.TrySendItem(item); err != nil {
+			t.Errorf("expected the item that crosses the limit to be sent, got %v", err)
+		}
+
+		if err := stream.TrySendItem(item); !errors.Is(err, ErrStreamLimitReached) {
+			t.Errorf("expected ErrStreamLimitReached, got %v", err)
+		}
+	})
+}
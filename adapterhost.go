@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
@@ -51,6 +51,65 @@ func (sh *AdapterHost) AddAdapters(adapters ...Adapter) error {
 	return nil
 }
 
+// RemoveAdapters Removes adapters, matching them by name. Returns the adapters
+// that were removed
+func (sh *AdapterHost) RemoveAdapters(adapters ...Adapter) []Adapter {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	names := make(map[string]bool, len(adapters))
+	for _, adapter := range adapters {
+		names[adapter.Name()] = true
+	}
+
+	removed := make([]Adapter, 0)
+	remaining := make([]Adapter, 0, len(sh.adapters))
+
+	for _, adapter := range sh.adapters {
+		if names[adapter.Name()] {
+			removed = append(removed, adapter)
+		} else {
+			remaining = append(remaining, adapter)
+		}
+	}
+
+	sh.adapters = remaining
+
+	return removed
+}
+
+// ScopeConflicts Returns an error describing every pair of adapters with the
+// same type whose scopes overlap, or nil if there are none. This is checked
+// when adapters are added, but adapters that implement `DynamicScopesAdapter`
+// can change their scopes afterwards
+func (sh *AdapterHost) ScopeConflicts() error {
+	adaptersByType := make(map[string][]Adapter)
+	for _, adapter := range sh.Adapters() {
+		adaptersByType[adapter.Type()] = append(adaptersByType[adapter.Type()], adapter)
+	}
+
+	types := make([]string, 0, len(adaptersByType))
+	for typ := range adaptersByType {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	var errs []error
+	for _, typ := range types {
+		adapters := adaptersByType[typ]
+
+		for i := range adapters {
+			for j := i + 1; j < len(adapters); j++ {
+				if scopesOverlap(adapters[i].Scopes(), adapters[j].Scopes()) {
+					errs = append(errs, fmt.Errorf("adapters %v and %v with type %v have overlapping scopes", adapters[i].Name(), adapters[j].Name(), typ))
+				}
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
 // scopesOverlap checks if there is any overlap between two slices of scopes
 func scopesOverlap(scopes1, scopes2 []string) bool {
 	scopeSet := make(map[string]struct{}, len(scopes1))
@@ -99,6 +158,20 @@ func (sh *AdapterHost) VisibleAdapters() []Adapter {
 	return result
 }
 
+// hasAdapterNamed Returns whether there is an adapter with the given name
+func (sh *AdapterHost) hasAdapterNamed(name string) bool {
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+
+	for _, adapter := range sh.adapters {
+		if adapter.Name() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
 // AdapterByType Returns the adapters for a given type
 func (sh *AdapterHost) AdaptersByType(typ string) []Adapter {
 	sh.mutex.RLock()
@@ -126,9 +199,21 @@ func (sh *AdapterHost) AdaptersByType(typ string) []Adapter {
 // unable to list them. In this case there will still be some queries with
 // wildcard scopes as they can't be expanded
 //
+// Specific scopes must match the adapter's scopes exactly, unless the adapter
+// implements `GlobScopesAdapter`, in which case they are matched as patterns
+//
 // This functions returns a map of queries with the adapters that they should be
 // run against
 func (sh *AdapterHost) ExpandQuery(q *sdp.Query) map[*sdp.Query]Adapter {
+	expandedQueries, _ := sh.expandQuery(q)
+
+	return expandedQueries
+}
+
+// expandQuery Expands a query as described in `ExpandQuery()`, also returning
+// the decision that was made for each adapter scope that was considered so
+// that routing can be debugged
+func (sh *AdapterHost) expandQuery(q *sdp.Query) (map[*sdp.Query]Adapter, []expansionDecision) {
 	var checkAdapters []Adapter
 
 	if IsWildcard(q.GetType()) {
@@ -141,39 +226,28 @@ func (sh *AdapterHost) ExpandQuery(q *sdp.Query) map[*sdp.Query]Adapter {
 	}
 
 	expandedQueries := make(map[*sdp.Query]Adapter)
+	decisions := make([]expansionDecision, 0)
 
 	for _, adapter := range checkAdapters {
-		// is the adapter is hidden
-		isHidden := false
-		if hs, ok := adapter.(HiddenAdapter); ok {
-			isHidden = hs.Hidden()
-		}
-
 		for _, adapterScope := range adapter.Scopes() {
-			// Create a new query if:
-			//
-			// * The adapter supports all scopes, or
-			// * The query scope is a wildcard (and the adapter is not hidden), or
-			// * The query scope substring matches adapter scope
-			if IsWildcard(adapterScope) || (IsWildcard(q.GetScope()) && !isHidden) || strings.Contains(adapterScope, q.GetScope()) {
-				dest := sdp.Query{}
-				q.Copy(&dest)
-
-				dest.Type = adapter.Type()
-
-				// Choose the more specific scope
-				if IsWildcard(adapterScope) {
-					dest.Scope = q.GetScope()
-				} else {
-					dest.Scope = adapterScope
-				}
+			decision := matchScope(adapter, adapterScope, q.GetScope())
+			decisions = append(decisions, decision)
 
-				expandedQueries[&dest] = adapter
+			if !decision.Matched {
+				continue
 			}
+
+			dest := sdp.Query{}
+			q.Copy(&dest)
+
+			dest.Type = adapter.Type()
+			dest.Scope = decision.Scope
+
+			expandedQueries[&dest] = adapter
 		}
 	}
 
-	return expandedQueries
+	return expandedQueries, decisions
 }
 
 // ClearAllAdapters Removes all adapters from the engine
@@ -183,28 +257,31 @@ func (sh *AdapterHost) ClearAllAdapters() {
 	sh.mutex.Unlock()
 }
 
-// StartPurger Starts the purger for all caching adapters
+// StartPurger Starts the purger for all caching adapters. The engine starts
+// purgers for its adapters itself, so this is only needed when an
+// `AdapterHost` is used without an engine
 func (sh *AdapterHost) StartPurger(ctx context.Context) {
 	for _, s := range sh.Adapters() {
-		if c, ok := s.(CachingAdapter); ok {
-			cache := c.Cache()
-			if cache != nil {
-				err := cache.StartPurger(ctx)
-				if err != nil {
-					sentry.CaptureException(fmt.Errorf("failed to start purger for adapter %s: %w", s.Name(), err))
-				}
-			}
+		if cache := adapterCache(s); cache != nil {
+			startPurger(ctx, s, cache)
 		}
 	}
 }
 
+// startPurger Starts the purger for an adapter's cache, reporting an error if
+// it can't be started
+func startPurger(ctx context.Context, adapter Adapter, cache Cache) {
+	err := cache.StartPurger(ctx)
+	if err != nil {
+		sentry.CaptureException(fmt.Errorf("failed to start purger for adapter %s: %w", adapter.Name(), err))
+	}
+}
+
+// Purge Purges expired results from the caches of all caching adapters
 func (sh *AdapterHost) Purge() {
 	for _, s := range sh.Adapters() {
-		if c, ok := s.(CachingAdapter); ok {
-			cache := c.Cache()
-			if cache != nil {
-				cache.Purge(time.Now())
-			}
+		if cache := adapterCache(s); cache != nil {
+			cache.Purge(time.Now())
 		}
 	}
 }
@@ -212,11 +289,18 @@ func (sh *AdapterHost) Purge() {
 // ClearCaches Clears caches for all caching adapters
 func (sh *AdapterHost) ClearCaches() {
 	for _, s := range sh.Adapters() {
-		if c, ok := s.(CachingAdapter); ok {
-			cache := c.Cache()
-			if cache != nil {
-				cache.Clear()
-			}
+		if cache := adapterCache(s); cache != nil {
+			cache.Clear()
+		}
+	}
+}
+
+// clearTransientCaches Clears the caches of all caching adapters except those
+// that implement `PersistentCache`
+func (sh *AdapterHost) clearTransientCaches() {
+	for _, s := range sh.Adapters() {
+		if cache := adapterCache(s); cache != nil && !isPersistentCache(cache) {
+			cache.Clear()
 		}
 	}
 }
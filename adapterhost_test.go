@@ -141,7 +141,7 @@ func TestAdapterHostExpandQuery(t *testing.T) {
 		}
 	})
 
-	t.Run("substring match", func(t *testing.T) {
+	t.Run("substring doesn't match", func(t *testing.T) {
 		req := sdp.Query{
 			Type:  sdp.WILDCARD,
 			Scope: "multi",
@@ -149,8 +149,8 @@ func TestAdapterHostExpandQuery(t *testing.T) {
 
 		m := sh.ExpandQuery(&req)
 
-		if len(m) != 2 {
-			t.Fatalf("Expected 2 queries, got %v", len(m))
+		if len(m) != 0 {
+			t.Fatalf("Expected 0 queries, got %v", len(m))
 		}
 	})
 
@@ -187,3 +187,32 @@ func TestAdapterHostAddAdapters(t *testing.T) {
 		t.Fatalf("Expected 1 adapters, got %v", x)
 	}
 }
+
+func TestAdapterHostRemoveAdapters(t *testing.T) {
+	sh := NewAdapterHost()
+
+	first := TestAdapter{ReturnName: "first", ReturnType: "first"}
+	second := TestAdapter{ReturnName: "second", ReturnType: "second"}
+
+	err := sh.AddAdapters(&first, &second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed := sh.RemoveAdapters(&first, &TestAdapter{ReturnName: "nonexistent"})
+
+	if len(removed) != 1 || removed[0].Name() != first.Name() {
+		t.Errorf("expected only %v to be removed, got %v", first.Name(), removed)
+	}
+
+	adapters := sh.Adapters()
+	if len(adapters) != 1 || adapters[0].Name() != second.Name() {
+		t.Errorf("expected only %v to remain, got %v", second.Name(), adapters)
+	}
+
+	// The removed adapter can be added again
+	err = sh.AddAdapters(&first)
+	if err != nil {
+		t.Error(err)
+	}
+}
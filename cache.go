@@ -0,0 +1,407 @@
+package discovery
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	"github.com/overmindtech/sdpcache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxPurgeWait is the longest that the purgers of `DiskCache` and
+// `MemoryCache` wait between purges, so that results stored after a purge are
+// purged promptly even if they expire before the next scheduled purge
+const maxPurgeWait = time.Minute
+
+// Cache is the interface that adapter caches must implement so that the
+// engine can manage their lifecycle, purging expired results while running
+// and clearing them when stopped. `*sdpcache.Cache` is the default in-memory
+// implementation, and `DiskCache` stores results on disk so that they survive
+// restarts and can be shared between processes
+type Cache interface {
+	// Lookup Returns whether the cache has a result for the given query. If it
+	// does the cached items or error are returned. The cache key is always
+	// returned so that results can be stored using it
+	Lookup(ctx context.Context, srcName string, method sdp.QueryMethod, scope string, typ string, query string, ignoreCache bool) (bool, sdpcache.CacheKey, []*sdp.Item, *sdp.QueryError)
+
+	// StoreItem Stores an item for the given duration. The item must be fully
+	// populated for indexing to work correctly
+	StoreItem(item *sdp.Item, duration time.Duration, ck sdpcache.CacheKey)
+
+	// StoreError Stores an error for the given duration
+	StoreError(err error, duration time.Duration, ck sdpcache.CacheKey)
+
+	// Delete Deletes everything that matches the given cache key
+	Delete(ck sdpcache.CacheKey)
+
+	// Purge Deletes everything that expired before the given time
+	Purge(before time.Time) sdpcache.PurgeStats
+
+	// StartPurger Starts purging expired results in the background until the
+	// context is cancelled. Returns an error if the purger is already running
+	StartPurger(ctx context.Context) error
+
+	// Clear Deletes everything
+	Clear()
+}
+
+var _ Cache = (*sdpcache.Cache)(nil)
+
+// adapterCache Returns the cache of an adapter, or nil if it doesn't have one
+func adapterCache(adapter Adapter) Cache {
+	var cache Cache
+
+	switch c := adapter.(type) {
+	case CacheProvider:
+		cache = c.Cache()
+	case CachingAdapter:
+		// Converting a nil `*sdpcache.Cache` would give a non-nil interface,
+		// so it has to be checked first
+		if sc := c.Cache(); sc != nil {
+			cache = sc
+		}
+	}
+
+	// Avoid returning a nil pointer wrapped in a non-nil interface
+	if cache == nil {
+		return nil
+	}
+	if v := reflect.ValueOf(cache); v.Kind() == reflect.Pointer && v.IsNil() {
+		return nil
+	}
+
+	return cache
+}
+
+// PersistentCache is a `Cache` whose results are meant to outlive the engine,
+// such as `DiskCache`. The engine doesn't clear these when it is stopped or an
+// adapter is removed, since that would throw away the results that they exist
+// to keep, and they may be shared with other adapters or processes.
+// `Engine.ClearCache()` still clears them
+type PersistentCache interface {
+	Cache
+
+	// Persistent Returns whether results should be kept when the engine is
+	// stopped
+	Persistent() bool
+}
+
+// isPersistentCache Returns whether a cache should be kept when the engine is
+// stopped or its adapter is removed
+func isPersistentCache(cache Cache) bool {
+	persistent, ok := cache.(PersistentCache)
+
+	return ok && persistent.Persistent()
+}
+
+// SnapshotCache is a `Cache` whose contents can be saved and restored. When
+// `EngineConfig.CacheSnapshotPath` is set, the caches of adapters that
+// implement this are saved to a file when the engine is stopped and restored
+// when it is started, so that restarts don't begin with an empty cache
+type SnapshotCache interface {
+	Cache
+
+	// Snapshot Returns all of the unexpired entries in the cache
+	Snapshot() []CacheEntry
+
+	// Restore Adds entries to the cache, keeping their original expiry.
+	// Entries that have already expired are ignored. Restored entries are
+	// merged with the existing contents of the cache rather than replacing
+	// them
+	Restore(entries []CacheEntry)
+}
+
+// StaleCache is a `Cache` that can return results for a while after they
+// expire. When `EngineConfig.StaleWhileRevalidate` is set, the engine serves
+// recently expired results from these caches immediately and refreshes them in
+// the background, rather than waiting for the adapter
+type StaleCache interface {
+	Cache
+
+	// LookupStale Works in the same way as `Lookup()` but also returns results
+	// that expired less than `maxStale` ago
+	LookupStale(ctx context.Context, srcName string, method sdp.QueryMethod, scope string, typ string, query string, maxStale time.Duration) StaleLookup
+}
+
+// StaleLookup is the result of `StaleCache.LookupStale()`
+type StaleLookup struct {
+	// Whether the cache had a result
+	Hit bool
+
+	// Whether any of the results have expired
+	Stale bool
+
+	// When the oldest of the results was stored, or zero if this isn't known
+	Stored time.Time
+
+	// The cached items, or error
+	Items []*sdp.Item
+	Error *sdp.QueryError
+}
+
+// staleLookup Converts the entries that match a cache key, including those
+// that have expired, into the results of `StaleCache.LookupStale()`
+func staleLookup(ctx context.Context, ck sdpcache.CacheKey, method sdp.QueryMethod, entries []CacheEntry, del func(sdpcache.CacheKey)) StaleLookup {
+	var lookup StaleLookup
+
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.Expiry.Before(now) {
+			lookup.Stale = true
+		}
+
+		if !entry.Stored.IsZero() && (lookup.Stored.IsZero() || entry.Stored.Before(lookup.Stored)) {
+			lookup.Stored = entry.Stored
+		}
+	}
+
+	lookup.Hit, _, lookup.Items, lookup.Error = cacheLookup(ctx, ck, method, entries, del)
+
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("ovm.cache.stale", lookup.Hit && lookup.Stale))
+
+	return lookup
+}
+
+// CacheEntry is a single item or error stored in a cache, along with the
+// values that it is indexed by
+type CacheEntry struct {
+	SST                  sdpcache.SST
+	UniqueAttributeValue string
+	Method               sdp.QueryMethod
+	Query                string
+
+	// Exactly one of these is set
+	Item  *sdp.Item
+	Error *sdp.QueryError
+
+	// When the entry was stored, which is zero for entries saved by older
+	// versions
+	Stored time.Time
+	Expiry time.Time
+}
+
+// newItemCacheEntry Creates the entry for storing an item, indexed in the same
+// way as `sdpcache.Cache.StoreItem()`
+func newItemCacheEntry(item *sdp.Item, duration time.Duration, ck sdpcache.CacheKey) CacheEntry {
+	now := time.Now()
+	entry := CacheEntry{
+		SST:                  ck.SST,
+		UniqueAttributeValue: item.UniqueAttributeValue(),
+		Item:                 proto.Clone(item).(*sdp.Item),
+		Stored:               now,
+		Expiry:               now.Add(duration),
+	}
+
+	if ck.Method != nil {
+		entry.Method = *ck.Method
+	}
+	if ck.Query != nil {
+		entry.Query = *ck.Query
+	}
+
+	return entry
+}
+
+// newErrorCacheEntry Creates the entry for storing an error. Errors that
+// aren't a `*sdp.QueryError` are stored as an `OTHER` error
+func newErrorCacheEntry(err error, duration time.Duration, ck sdpcache.CacheKey) CacheEntry {
+	var qErr *sdp.QueryError
+	if errors.As(err, &qErr) {
+		qErr = proto.Clone(qErr).(*sdp.QueryError)
+	} else {
+		qErr = &sdp.QueryError{
+			ErrorType:   sdp.QueryError_OTHER,
+			ErrorString: err.Error(),
+			Scope:       ck.SST.Scope,
+			SourceName:  ck.SST.SourceName,
+			ItemType:    ck.SST.Type,
+		}
+	}
+
+	iv := ck.ToIndexValues()
+	now := time.Now()
+
+	return CacheEntry{
+		SST:                  ck.SST,
+		UniqueAttributeValue: iv.UniqueAttributeValue,
+		Method:               iv.Method,
+		Query:                iv.Query,
+		Error:                qErr,
+		Stored:               now,
+		Expiry:               now.Add(duration),
+	}
+}
+
+// indexValues Returns the values that the entry is indexed by, for use with
+// `sdpcache.CacheKey.Matches()`
+func (c CacheEntry) indexValues() sdpcache.IndexValues {
+	return sdpcache.IndexValues{
+		SSTHash:              c.SST.Hash(),
+		UniqueAttributeValue: c.UniqueAttributeValue,
+		Method:               c.Method,
+		Query:                c.Query,
+	}
+}
+
+// id Returns an identifier for the entry that is unique within its SST.
+// Storing an entry with the same ID replaces the existing one
+func (c CacheEntry) id() string {
+	var name string
+	if c.Item != nil {
+		name = c.Item.GloballyUniqueName()
+	}
+
+	return fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%v\x00%v\x00%v\x00%v", c.Method, c.Query, c.UniqueAttributeValue, name))))
+}
+
+// encodedCacheEntry is the format that entries are saved to disk in. Items and
+// errors are encoded as protobuf
+type encodedCacheEntry struct {
+	SourceName           string          `json:"sourceName"`
+	Scope                string          `json:"scope"`
+	Type                 string          `json:"type"`
+	UniqueAttributeValue string          `json:"uniqueAttributeValue,omitempty"`
+	Method               sdp.QueryMethod `json:"method"`
+	Query                string          `json:"query,omitempty"`
+	Item                 []byte          `json:"item,omitempty"`
+	Error                []byte          `json:"error,omitempty"`
+	Stored               time.Time       `json:"stored"`
+	Expiry               time.Time       `json:"expiry"`
+}
+
+// encodeCacheEntry Converts an entry to the format that it is saved in
+func encodeCacheEntry(entry CacheEntry) (encodedCacheEntry, error) {
+	encoded := encodedCacheEntry{
+		SourceName:           entry.SST.SourceName,
+		Scope:                entry.SST.Scope,
+		Type:                 entry.SST.Type,
+		UniqueAttributeValue: entry.UniqueAttributeValue,
+		Method:               entry.Method,
+		Query:                entry.Query,
+		Stored:               entry.Stored,
+		Expiry:               entry.Expiry,
+	}
+
+	var err error
+	if entry.Item != nil {
+		encoded.Item, err = proto.Marshal(entry.Item)
+	} else {
+		encoded.Error, err = proto.Marshal(entry.Error)
+	}
+
+	return encoded, err
+}
+
+// decode Converts a saved entry back to a `CacheEntry`
+func (e encodedCacheEntry) decode() (CacheEntry, error) {
+	entry := CacheEntry{
+		SST: sdpcache.SST{
+			SourceName: e.SourceName,
+			Scope:      e.Scope,
+			Type:       e.Type,
+		},
+		UniqueAttributeValue: e.UniqueAttributeValue,
+		Method:               e.Method,
+		Query:                e.Query,
+		Stored:               e.Stored,
+		Expiry:               e.Expiry,
+	}
+
+	if e.Error != nil {
+		entry.Error = &sdp.QueryError{}
+		return entry, proto.Unmarshal(e.Error, entry.Error)
+	}
+
+	entry.Item = &sdp.Item{}
+	return entry, proto.Unmarshal(e.Item, entry.Item)
+}
+
+// cacheLookup Converts the unexpired entries that match a cache key into the
+// results of `Cache.Lookup()`, with the same semantics as
+// `sdpcache.Cache.Lookup()`. A cached error is returned in place of any items,
+// and if a GET finds more than one item they are deleted using `del` and
+// treated as a miss
+func cacheLookup(ctx context.Context, ck sdpcache.CacheKey, method sdp.QueryMethod, entries []CacheEntry, del func(sdpcache.CacheKey)) (bool, sdpcache.CacheKey, []*sdp.Item, *sdp.QueryError) {
+	span := trace.SpanFromContext(ctx)
+
+	if len(entries) == 0 {
+		span.SetAttributes(
+			attribute.String("ovm.cache.result", "cache miss"),
+			attribute.Bool("ovm.cache.hit", false),
+		)
+		return false, ck, nil, nil
+	}
+
+	items := make([]*sdp.Item, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Error != nil {
+			span.SetAttributes(
+				attribute.String("ovm.cache.result", "cache hit: QueryError"),
+				attribute.Bool("ovm.cache.hit", true),
+			)
+			return true, ck, nil, proto.Clone(entry.Error).(*sdp.QueryError)
+		}
+
+		items = append(items, proto.Clone(entry.Item).(*sdp.Item))
+	}
+
+	if method == sdp.QueryMethod_GET && len(items) > 1 {
+		span.SetAttributes(
+			attribute.String("ovm.cache.result", "cache returned >1 value, purging and continuing"),
+			attribute.Int("ovm.cache.numItems", len(items)),
+			attribute.Bool("ovm.cache.hit", false),
+		)
+		del(ck)
+		return false, ck, nil, nil
+	}
+
+	span.SetAttributes(
+		attribute.String("ovm.cache.result", "cache hit"),
+		attribute.Int("ovm.cache.numItems", len(items)),
+		attribute.Bool("ovm.cache.hit", true),
+	)
+
+	return true, ck, items, nil
+}
+
+// ignoredCacheLookup Returns the results of `Cache.Lookup()` when the cache
+// is being ignored
+func ignoredCacheLookup(ctx context.Context, ck sdpcache.CacheKey) (bool, sdpcache.CacheKey, []*sdp.Item, *sdp.QueryError) {
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("ovm.cache.result", "ignore cache"),
+		attribute.Bool("ovm.cache.hit", false),
+	)
+
+	return false, ck, nil, nil
+}
+
+// runPurger Calls `purge` until the context is cancelled, waiting until the
+// next entry expires between purges, but at least `minWait` and at most
+// `maxPurgeWait`
+func runPurger(ctx context.Context, purge func(before time.Time) sdpcache.PurgeStats, minWait time.Duration) {
+	if minWait == 0 {
+		minWait = sdpcache.MinWaitDefault
+	}
+
+	for {
+		stats := purge(time.Now())
+
+		wait := maxPurgeWait
+		if stats.NextExpiry != nil {
+			wait = min(max(time.Until(*stats.NextExpiry), minWait), maxPurgeWait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
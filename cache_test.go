@@ -0,0 +1,128 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	"github.com/overmindtech/sdpcache"
+)
+
+// nilCacheTestAdapter is a TestAdapter whose `Cache()` returns a nil pointer
+// of a concrete type
+type nilCacheTestAdapter struct {
+	TestAdapter
+}
+
+func (n *nilCacheTestAdapter) Cache() Cache {
+	var cache *MemoryCache
+	return cache
+}
+
+// diskCacheTestAdapter is a TestAdapter that uses a `DiskCache`
+type diskCacheTestAdapter struct {
+	TestAdapter
+
+	diskCache *DiskCache
+}
+
+func (d *diskCacheTestAdapter) Cache() Cache {
+	return d.diskCache
+}
+
+// sdpcacheTestAdapter is a TestAdapter that implements `CachingAdapter` by
+// returning the concrete sdpcache type
+type sdpcacheTestAdapter struct {
+	TestAdapter
+
+	sdpCache *sdpcache.Cache
+}
+
+func (l *sdpcacheTestAdapter) Cache() *sdpcache.Cache {
+	return l.sdpCache
+}
+
+func TestAdapterCache(t *testing.T) {
+	t.Run("cache provider", func(t *testing.T) {
+		adapter := &TestAdapter{}
+
+		if adapterCache(adapter) == nil {
+			t.Error("expected a cache")
+		}
+	})
+
+	t.Run("sdpcache caching adapter", func(t *testing.T) {
+		adapter := &sdpcacheTestAdapter{sdpCache: sdpcache.NewCache()}
+
+		if adapterCache(adapter) == nil {
+			t.Error("expected a cache")
+		}
+	})
+
+	t.Run("sdpcache caching adapter without a cache", func(t *testing.T) {
+		adapter := &sdpcacheTestAdapter{}
+
+		if cache := adapterCache(adapter); cache != nil {
+			t.Errorf("expected no cache, got %v", cache)
+		}
+	})
+
+	t.Run("cache provider with a nil cache", func(t *testing.T) {
+		adapter := &nilCacheTestAdapter{}
+
+		if cache := adapterCache(adapter); cache != nil {
+			t.Errorf("expected no cache, got %v", cache)
+		}
+	})
+
+	t.Run("adapter without a cache", func(t *testing.T) {
+		adapter := &SlowAdapter{}
+
+		if cache := adapterCache(adapter); cache != nil {
+			t.Errorf("expected no cache, got %v", cache)
+		}
+	})
+}
+
+func TestPersistentCachesAreKept(t *testing.T) {
+	ctx := context.Background()
+	ck := sdpcache.CacheKeyFromParts("disk", sdp.QueryMethod_GET, "test", "person", "one")
+
+	diskCache, err := NewDiskCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskCache.StoreItem((&TestAdapter{}).NewTestItem("test", "one"), time.Minute, ck)
+
+	adapter := &diskCacheTestAdapter{
+		TestAdapter: TestAdapter{ReturnName: "disk", ReturnScopes: []string{"test"}},
+		diskCache:   diskCache,
+	}
+
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.AddAdapters(adapter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.RemoveAdapters(adapter)
+
+	if hit, _, _, _ := diskCache.Lookup(ctx, "disk", sdp.QueryMethod_GET, "test", "person", "one", false); !hit {
+		t.Error("expected the disk cache to be kept when the adapter is removed")
+	}
+
+	err = e.AddAdapters(adapter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.ClearCache()
+
+	if hit, _, _, _ := diskCache.Lookup(ctx, "disk", sdp.QueryMethod_GET, "test", "person", "one", false); hit {
+		t.Error("expected ClearCache to clear the disk cache")
+	}
+}
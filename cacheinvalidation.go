@@ -0,0 +1,182 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/overmindtech/sdp-go"
+	"github.com/overmindtech/sdpcache"
+	log "github.com/sirupsen/logrus"
+)
+
+// invalidationSubjectPrefix is the prefix of the subjects that cache
+// invalidations for a specific scope are sent on
+const invalidationSubjectPrefix = "invalidate.scope."
+
+// CacheInvalidation Describes the cached results that should be evicted from
+// the caches of adapters. Invalidations are sent as JSON on
+// `invalidate.scope.<scope>` and are received by every replica of a source,
+// regardless of `EngineConfig.NATSQueueName`
+type CacheInvalidation struct {
+	// The scope to evict results for. This must be a specific scope that can
+	// be used in a NATS subject
+	Scope string `json:"scope"`
+
+	// The type to evict results for. If this is blank, results of all types
+	// in the scope are evicted
+	Type string `json:"type,omitempty"`
+
+	// The unique attribute value of the item to evict. If this is blank, all
+	// results for the type and scope are evicted. Since LIST and SEARCH
+	// results could include the item, these are evicted for the type and
+	// scope too
+	UniqueAttributeValue string `json:"uniqueAttributeValue,omitempty"`
+}
+
+// Subject Returns the NATS subject that the invalidation is sent on
+func (i CacheInvalidation) Subject() string {
+	return invalidationSubjectPrefix + i.Scope
+}
+
+// Validate Returns an error if the invalidation can't be sent or applied
+func (i CacheInvalidation) Validate() error {
+	if i.Scope == "" {
+		return errors.New("cache invalidation must have a scope")
+	}
+
+	if !validSubjectScope(i.Scope) || isGlobPattern(i.Scope) {
+		return fmt.Errorf("cache invalidation scope %q must be a specific scope that can be used in a NATS subject", i.Scope)
+	}
+
+	if i.UniqueAttributeValue != "" && i.Type == "" {
+		return errors.New("cache invalidation with a unique attribute value must have a type")
+	}
+
+	return nil
+}
+
+// cacheKeys Returns the keys that should be deleted from the cache of an
+// adapter, given the name and type of the adapter and the scope that its
+// results are cached under
+func (i CacheInvalidation) cacheKeys(sourceName string, typ string, scope string) []sdpcache.CacheKey {
+	sst := sdpcache.SST{
+		SourceName: sourceName,
+		Scope:      scope,
+		Type:       typ,
+	}
+
+	if i.UniqueAttributeValue == "" {
+		return []sdpcache.CacheKey{{SST: sst}}
+	}
+
+	uav := i.UniqueAttributeValue
+	list := sdp.QueryMethod_LIST
+	search := sdp.QueryMethod_SEARCH
+
+	return []sdpcache.CacheKey{
+		{SST: sst, UniqueAttributeValue: &uav},
+		{SST: sst, Method: &list},
+		{SST: sst, Method: &search},
+	}
+}
+
+// InvalidateCache Evicts the results described by the invalidation from the
+// caches of this engine's adapters. Results are assumed to be cached under the
+// adapter's name, as is the convention for adapters using `sdpcache`. Returns
+// the number of adapter caches that were affected. Use
+// `PublishCacheInvalidation()` to evict results from every replica of a
+// source
+func (e *Engine) InvalidateCache(invalidation CacheInvalidation) (int, error) {
+	if err := invalidation.Validate(); err != nil {
+		return 0, err
+	}
+
+	var numCaches int
+
+	for _, adapter := range e.sh.Adapters() {
+		if invalidation.Type != "" && adapter.Type() != invalidation.Type {
+			continue
+		}
+
+		cache := adapterCache(adapter)
+		if cache == nil {
+			continue
+		}
+
+		for _, adapterScope := range adapter.Scopes() {
+			decision := matchScope(adapter, adapterScope, invalidation.Scope)
+			if !decision.Matched {
+				continue
+			}
+
+			for _, ck := range invalidation.cacheKeys(adapter.Name(), adapter.Type(), decision.Scope) {
+				cache.Delete(ck)
+			}
+
+			numCaches++
+
+			// An adapter caches results for a scope under one key, so
+			// there is no need to check its other scopes
+			break
+		}
+	}
+
+	return numCaches, nil
+}
+
+// handleCacheInvalidation Handles an invalidation received over NATS
+func (e *Engine) handleCacheInvalidation(msg *nats.Msg) {
+	var invalidation CacheInvalidation
+
+	err := json.Unmarshal(msg.Data, &invalidation)
+	if err != nil {
+		log.WithError(err).WithField("subject", msg.Subject).Error("Failed to parse cache invalidation")
+		return
+	}
+
+	numCaches, err := e.InvalidateCache(invalidation)
+	if err != nil {
+		log.WithError(err).WithField("subject", msg.Subject).Error("Failed to invalidate cache")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"ovm.sdp.scope":                invalidation.Scope,
+		"ovm.sdp.type":                 invalidation.Type,
+		"ovm.sdp.uniqueAttributeValue": invalidation.UniqueAttributeValue,
+		"ovm.cache.numCaches":          numCaches,
+	}).Info("Invalidated cache")
+}
+
+// PublishCacheInvalidation Sends an invalidation over NATS so that every
+// source serving the scope, including all replicas, evicts the described
+// results from its caches. This can be used after a known infrastructure
+// change to force fresh data to be discovered without redeploying
+func PublishCacheInvalidation(ctx context.Context, conn sdp.EncodedConnection, invalidation CacheInvalidation) error {
+	if err := invalidation.Validate(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(invalidation)
+	if err != nil {
+		return fmt.Errorf("error encoding cache invalidation: %w", err)
+	}
+
+	return conn.PublishMsg(ctx, &nats.Msg{
+		Subject: invalidation.Subject(),
+		Data:    data,
+	})
+}
+
+// PublishCacheInvalidation Sends an invalidation over the engine's NATS
+// connection. See `PublishCacheInvalidation()`
+func (e *Engine) PublishCacheInvalidation(ctx context.Context, invalidation CacheInvalidation) error {
+	if !e.IsNATSConnected() {
+		return errors.New("cannot publish cache invalidation, NATS is not connected")
+	}
+
+	return PublishCacheInvalidation(ctx, e.natsConnection, invalidation)
+}
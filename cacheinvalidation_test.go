@@ -0,0 +1,226 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCacheInvalidationValidate(t *testing.T) {
+	tests := map[string]struct {
+		Invalidation CacheInvalidation
+		Valid        bool
+	}{
+		"scope":                           {CacheInvalidation{Scope: "test"}, true},
+		"type and unique attribute value": {CacheInvalidation{Scope: "test", Type: "person", UniqueAttributeValue: "Dylan"}, true},
+		"no scope":                        {CacheInvalidation{Type: "person"}, false},
+		"wildcard scope":                  {CacheInvalidation{Scope: "*"}, false},
+		"glob scope":                      {CacheInvalidation{Scope: "test-?"}, false},
+		"unique attribute value, no type": {CacheInvalidation{Scope: "test", UniqueAttributeValue: "Dylan"}, false},
+		"scope with subject wildcard":     {CacheInvalidation{Scope: "foo.>"}, false},
+		"scope containing whitespace":     {CacheInvalidation{Scope: "has space"}, false},
+		"type":                            {CacheInvalidation{Scope: "test", Type: "person"}, true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.Invalidation.Validate()
+			if test.Valid && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+			if !test.Valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestInvalidateCache(t *testing.T) {
+	ctx := context.Background()
+
+	newEngine := func(t *testing.T, adapters ...Adapter) *Engine {
+		t.Helper()
+
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = e.AddAdapters(adapters...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return e
+	}
+
+	// populate Caches a GET for each query and a LIST in the scope
+	populate := func(t *testing.T, adapter *TestAdapter, scope string, queries ...string) {
+		t.Helper()
+
+		for _, query := range queries {
+			if _, err := adapter.Get(ctx, scope, query, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := adapter.List(ctx, scope, false); err != nil {
+			t.Fatal(err)
+		}
+		adapter.resetCalls()
+	}
+
+	t.Run("by unique attribute value", func(t *testing.T) {
+		adapter := &TestAdapter{ReturnName: "uav", ReturnScopes: []string{"test"}, CacheDuration: time.Minute}
+		e := newEngine(t, adapter)
+		populate(t, adapter, "test", "one", "two")
+
+		numCaches, err := e.InvalidateCache(CacheInvalidation{Scope: "test", Type: "person", UniqueAttributeValue: "one"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numCaches != 1 {
+			t.Errorf("expected 1 cache to be affected, got %v", numCaches)
+		}
+
+		for _, query := range []string{"one", "two"} {
+			if _, err := adapter.Get(ctx, "test", query, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := adapter.List(ctx, "test", false); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(adapter.GetCalls) != 1 || adapter.GetCalls[0][1] != "one" {
+			t.Errorf("expected only the invalidated item to be fetched again, got %v", adapter.GetCalls)
+		}
+		if len(adapter.ListCalls) != 1 {
+			t.Errorf("expected the LIST to be evicted, got %v LIST calls", len(adapter.ListCalls))
+		}
+	})
+
+	t.Run("by type", func(t *testing.T) {
+		person := &TestAdapter{ReturnName: "person", ReturnType: "person", ReturnScopes: []string{"test"}, CacheDuration: time.Minute}
+		dog := &TestAdapter{ReturnName: "dog", ReturnType: "dog", ReturnScopes: []string{"test"}, CacheDuration: time.Minute}
+		e := newEngine(t, person, dog)
+		populate(t, person, "test", "one")
+		populate(t, dog, "test", "one")
+
+		_, err := e.InvalidateCache(CacheInvalidation{Scope: "test", Type: "person"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := person.Get(ctx, "test", "one", false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dog.Get(ctx, "test", "one", false); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(person.GetCalls) != 1 {
+			t.Errorf("expected the person to be fetched again, got %v GET calls", len(person.GetCalls))
+		}
+		if len(dog.GetCalls) != 0 {
+			t.Errorf("expected the dog to be served from the cache, got %v GET calls", len(dog.GetCalls))
+		}
+	})
+
+	t.Run("other scopes are kept", func(t *testing.T) {
+		adapter := &TestAdapter{ReturnName: "scopes", ReturnScopes: []string{"a", "b"}, CacheDuration: time.Minute}
+		e := newEngine(t, adapter)
+		populate(t, adapter, "a", "one")
+		populate(t, adapter, "b", "one")
+
+		_, err := e.InvalidateCache(CacheInvalidation{Scope: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, scope := range []string{"a", "b"} {
+			if _, err := adapter.Get(ctx, scope, "one", false); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if len(adapter.GetCalls) != 1 || adapter.GetCalls[0][0] != "a" {
+			t.Errorf("expected only scope a to be fetched again, got %v", adapter.GetCalls)
+		}
+	})
+
+	t.Run("wildcard adapters", func(t *testing.T) {
+		adapter := &TestAdapter{ReturnName: "wildcard", ReturnScopes: []string{"*"}, CacheDuration: time.Minute}
+		e := newEngine(t, adapter)
+		populate(t, adapter, "test", "one")
+
+		numCaches, err := e.InvalidateCache(CacheInvalidation{Scope: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numCaches != 1 {
+			t.Errorf("expected 1 cache to be affected, got %v", numCaches)
+		}
+
+		if _, err := adapter.Get(ctx, "test", "one", false); err != nil {
+			t.Fatal(err)
+		}
+		if len(adapter.GetCalls) != 1 {
+			t.Errorf("expected the item to be fetched again, got %v GET calls", len(adapter.GetCalls))
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		e := newEngine(t)
+
+		_, err := e.InvalidateCache(CacheInvalidation{Scope: "*"})
+		if err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestCacheInvalidationOverNATS(t *testing.T) {
+	SkipWithoutNats(t)
+
+	// Both engines share a queue group, like replicas of a source
+	first := &TestAdapter{ReturnName: "replica", ReturnScopes: []string{"test"}, CacheDuration: time.Minute}
+	second := &TestAdapter{ReturnName: "replica", ReturnScopes: []string{"test"}, CacheDuration: time.Minute}
+	e1 := newStartedEngine(t, "TestCacheInvalidationOverNATS", nil, first)
+	e2 := newStartedEngine(t, "TestCacheInvalidationOverNATS", nil, second)
+
+	ctx := context.Background()
+	for _, adapter := range []*TestAdapter{first, second} {
+		if _, err := adapter.Get(ctx, "test", "one", false); err != nil {
+			t.Fatal(err)
+		}
+		adapter.resetCalls()
+	}
+
+	err := e1.PublishCacheInvalidation(ctx, CacheInvalidation{Scope: "test", Type: "person", UniqueAttributeValue: "one"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []*Engine{e1, e2} {
+		err = e.natsConnection.Underlying().Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, adapter := range []*TestAdapter{first, second} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := adapter.Get(ctx, "test", "one", false); err != nil {
+				t.Fatal(err)
+			}
+			if len(adapter.GetCalls) > 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected replica %v to evict the item", i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
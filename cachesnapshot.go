@@ -0,0 +1,149 @@
+package discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheSnapshotVersion is the version of the snapshot file format. Snapshots
+// with a different version are ignored
+const cacheSnapshotVersion = 1
+
+// cacheSnapshot is the format of the file that caches are saved to
+type cacheSnapshot struct {
+	Version   int                 `json:"version"`
+	CreatedAt time.Time           `json:"createdAt"`
+	Entries   []encodedCacheEntry `json:"entries"`
+}
+
+// snapshotAdapterCache Returns the cache of an adapter if it can be
+// snapshotted
+func snapshotAdapterCache(adapter Adapter) (SnapshotCache, bool) {
+	cache, ok := adapterCache(adapter).(SnapshotCache)
+	return cache, ok
+}
+
+// saveCacheSnapshot Saves the unexpired contents of all adapter caches that
+// implement `SnapshotCache` to a file. Each adapter saves only the entries
+// stored under its own name, so caches that are shared between adapters are
+// only saved once. The file is replaced atomically so that a failed save
+// doesn't corrupt an existing snapshot
+func (e *Engine) saveCacheSnapshot(path string) error {
+	snapshot := cacheSnapshot{
+		Version:   cacheSnapshotVersion,
+		CreatedAt: time.Now(),
+		Entries:   make([]encodedCacheEntry, 0),
+	}
+
+	for _, adapter := range e.sh.Adapters() {
+		cache, ok := snapshotAdapterCache(adapter)
+		if !ok {
+			continue
+		}
+
+		for _, entry := range cache.Snapshot() {
+			if entry.SST.SourceName != adapter.Name() {
+				continue
+			}
+
+			encoded, err := encodeCacheEntry(entry)
+			if err != nil {
+				log.WithError(err).WithField("ovm.adapter.name", adapter.Name()).Warn("Error encoding cache entry for snapshot")
+				continue
+			}
+
+			snapshot.Entries = append(snapshot.Entries, encoded)
+		}
+	}
+
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("error encoding cache snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("error creating cache snapshot: %w", err)
+	}
+
+	_, err = tmp.Write(b)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("error writing cache snapshot: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"path":    path,
+		"entries": len(snapshot.Entries),
+	}).Info("Saved cache snapshot")
+
+	return nil
+}
+
+// restoreCacheSnapshot Restores a snapshot saved by `saveCacheSnapshot()`
+// into the caches of the current adapters. Entries are matched to adapters by
+// name, and entries for adapters that no longer exist or that have since
+// expired are ignored. A missing snapshot is not an error
+func (e *Engine) restoreCacheSnapshot(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading cache snapshot: %w", err)
+	}
+
+	var snapshot cacheSnapshot
+	err = json.Unmarshal(b, &snapshot)
+	if err != nil {
+		return fmt.Errorf("error decoding cache snapshot: %w", err)
+	}
+
+	if snapshot.Version != cacheSnapshotVersion {
+		return fmt.Errorf("cache snapshot has version %v, expected %v", snapshot.Version, cacheSnapshotVersion)
+	}
+
+	entriesByAdapter := make(map[string][]CacheEntry)
+	for _, encoded := range snapshot.Entries {
+		entry, err := encoded.decode()
+		if err != nil {
+			log.WithError(err).Warn("Error decoding cache snapshot entry")
+			continue
+		}
+
+		entriesByAdapter[entry.SST.SourceName] = append(entriesByAdapter[entry.SST.SourceName], entry)
+	}
+
+	restored := 0
+	for _, adapter := range e.sh.Adapters() {
+		cache, ok := snapshotAdapterCache(adapter)
+		if !ok {
+			continue
+		}
+
+		entries := entriesByAdapter[adapter.Name()]
+		cache.Restore(entries)
+		restored += len(entries)
+	}
+
+	log.WithFields(log.Fields{
+		"path":      path,
+		"entries":   restored,
+		"createdAt": snapshot.CreatedAt,
+	}).Info("Restored cache snapshot")
+
+	return nil
+}
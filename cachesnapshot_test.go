@@ -0,0 +1,103 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	"github.com/overmindtech/sdpcache"
+)
+
+// snapshotTestAdapter is a TestAdapter that uses a `MemoryCache`
+type snapshotTestAdapter struct {
+	TestAdapter
+
+	memoryCache *MemoryCache
+}
+
+func (s *snapshotTestAdapter) Cache() Cache {
+	return s.memoryCache
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	newEngine := func(t *testing.T, adapters ...Adapter) *Engine {
+		t.Helper()
+
+		e, err := NewEngine(&EngineConfig{CacheSnapshotPath: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = e.AddAdapters(adapters...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return e
+	}
+
+	t.Run("missing snapshot", func(t *testing.T) {
+		e := newEngine(t)
+
+		err := e.restoreCacheSnapshot(path)
+		if err != nil {
+			t.Errorf("expected no error for a missing snapshot, got %v", err)
+		}
+	})
+
+	t.Run("save and restore", func(t *testing.T) {
+		before := &snapshotTestAdapter{
+			TestAdapter: TestAdapter{ReturnName: "snapshot"},
+			memoryCache: NewMemoryCache(),
+		}
+
+		ck := sdpcache.CacheKeyFromParts("snapshot", sdp.QueryMethod_GET, "test", "person", "one")
+		before.memoryCache.StoreItem(before.NewTestItem("test", "one"), time.Minute, ck)
+
+		// Entries stored under another name belong to a different adapter
+		other := sdpcache.CacheKeyFromParts("other", sdp.QueryMethod_GET, "test", "person", "two")
+		before.memoryCache.StoreItem(before.NewTestItem("test", "two"), time.Minute, other)
+
+		err := newEngine(t, before).saveCacheSnapshot(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		after := &snapshotTestAdapter{
+			TestAdapter: TestAdapter{ReturnName: "snapshot"},
+			memoryCache: NewMemoryCache(),
+		}
+
+		err = newEngine(t, after).restoreCacheSnapshot(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hit, _, items, _ := after.memoryCache.Lookup(ctx, "snapshot", sdp.QueryMethod_GET, "test", "person", "one", false)
+		if !hit || len(items) != 1 {
+			t.Errorf("expected the restored item to be a cache hit, got hit=%v items=%v", hit, items)
+		}
+
+		if entries := after.memoryCache.Snapshot(); len(entries) != 1 {
+			t.Errorf("expected only the adapter's own entries to be restored, got %v", len(entries))
+		}
+	})
+
+	t.Run("unsupported version", func(t *testing.T) {
+		err := os.WriteFile(path, []byte(`{"version": 0}`), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = newEngine(t).restoreCacheSnapshot(path)
+		if err == nil {
+			t.Error("expected an error for an unsupported version")
+		}
+	})
+}
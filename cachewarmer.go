@@ -0,0 +1,162 @@
+package discovery
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/overmindtech/sdp-go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// cacheWarmerIdleCheckInterval is how often the cache warmer checks whether
+// the execution pools are quiet enough for it to run a query
+const cacheWarmerIdleCheckInterval = time.Second
+
+// CacheWarmingTarget is a type and scope that the cache warmer runs LIST
+// queries for
+type CacheWarmingTarget struct {
+	Type string
+
+	// The scope to LIST. This can be the wildcard in order to LIST every scope
+	// of the type
+	Scope string
+}
+
+// CacheWarmingOptions configures a cache warmer that periodically runs LIST
+// queries in the background so that the caches of the matching adapters are
+// already populated when GET queries arrive
+type CacheWarmingOptions struct {
+	// The types and scopes to LIST
+	Targets []CacheWarmingTarget
+
+	// How often to run the LIST queries. This should be shorter than the cache
+	// duration of the adapters so that their caches don't expire between runs
+	Interval time.Duration
+}
+
+// runCacheWarmer Warms the caches straight away and then every
+// `CacheWarmingOptions.Interval` until the context is cancelled
+func (e *Engine) runCacheWarmer(ctx context.Context, opts CacheWarmingOptions) {
+	defer LogRecoverToReturn(ctx, "runCacheWarmer")
+
+	if len(opts.Targets) == 0 || opts.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		e.warmCaches(ctx, opts.Targets)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// warmCaches Runs a LIST query for each target, one at a time. Before each
+// query the warmer waits for the execution pools to be less than half full,
+// so that warming only uses capacity that queries from users don't need
+func (e *Engine) warmCaches(ctx context.Context, targets []CacheWarmingTarget) {
+	for _, target := range targets {
+		if !e.waitForIdlePools(ctx) {
+			return
+		}
+
+		e.warmCache(ctx, target)
+	}
+}
+
+// waitForIdlePools Waits until fewer than half of the executions allowed in
+// each of this engine's pools are running. Returns false if the context is
+// cancelled or the engine starts draining first
+func (e *Engine) waitForIdlePools(ctx context.Context) bool {
+	threshold := max(e.maxParallelExecutions()/2, 1)
+
+	for {
+		if e.IsDraining() {
+			return false
+		}
+
+		if int(e.listExecutionsInUse.Load()) < threshold && int(e.getExecutionsInUse.Load()) < threshold {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(cacheWarmerIdleCheckInterval):
+		}
+	}
+}
+
+// warmCache Runs a LIST query for a single target, ignoring the cache so that
+// the adapters refresh it with their results. The query is counted as
+// in-flight and tracked so that draining waits for it, and cancels it once the
+// drain timeout is reached
+func (e *Engine) warmCache(ctx context.Context, target CacheWarmingTarget) {
+	// Count the query before checking whether we are draining so that a drain
+	// can't start without seeing it
+	e.inFlightQueries.Add(1)
+	defer e.inFlightQueries.Add(-1)
+
+	if e.IsDraining() {
+		return
+	}
+
+	u := uuid.New()
+	query := &sdp.Query{
+		UUID:        u[:],
+		Type:        target.Type,
+		Method:      sdp.QueryMethod_LIST,
+		Scope:       target.Scope,
+		IgnoreCache: true,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.maxRequestTimeout())
+	defer cancel()
+
+	e.TrackQuery(u, &QueryTracker{
+		Query:   query,
+		Context: ctx,
+		Cancel:  cancel,
+		Engine:  e,
+	})
+	defer e.DeleteTrackedQuery(u)
+
+	ctx, span := tracer.Start(ctx, "WarmCache", trace.WithAttributes(
+		attribute.String("ovm.sdp.type", target.Type),
+		attribute.String("ovm.sdp.scope", target.Scope),
+	))
+	defer span.End()
+
+	start := time.Now()
+
+	var numItems, numErrs int
+	for _, err := range e.Query(ctx, query) {
+		if err != nil {
+			numErrs++
+		} else {
+			numItems++
+		}
+	}
+
+	span.SetAttributes(
+		attribute.Int("ovm.adapter.numItems", numItems),
+		attribute.Int("ovm.adapter.numErrors", numErrs),
+	)
+
+	log.WithContext(ctx).WithFields(log.Fields{
+		"ovm.sdp.type":       target.Type,
+		"ovm.sdp.scope":      target.Scope,
+		"ovm.adapter.items":  numItems,
+		"ovm.adapter.errors": numErrs,
+		"duration":           time.Since(start).String(),
+	}).Debug("Warmed cache")
+}
@@ -0,0 +1,167 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+)
+
+func TestCacheWarmer(t *testing.T) {
+	t.Run("warmed items are served from the cache", func(t *testing.T) {
+		adapter := TestAdapter{ReturnType: "person", ReturnScopes: []string{"test"}}
+
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = e.AddAdapters(&adapter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.warmCaches(context.Background(), []CacheWarmingTarget{{Type: "person", Scope: "test"}})
+
+		if len(adapter.ListCalls) != 1 {
+			t.Fatalf("expected 1 LIST call, got %v", len(adapter.ListCalls))
+		}
+
+		for _, qErr := range e.Query(context.Background(), &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "test",
+		}) {
+			if qErr != nil {
+				t.Error(qErr)
+			}
+		}
+
+		if len(adapter.GetCalls) != 0 {
+			t.Errorf("expected the GET to be served from the cache, got %v GET calls", len(adapter.GetCalls))
+		}
+	})
+
+	t.Run("warming runs on an interval until cancelled", func(t *testing.T) {
+		adapter := TestAdapter{ReturnType: "person", ReturnScopes: []string{"test"}}
+
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = e.AddAdapters(&adapter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+			e.runCacheWarmer(ctx, CacheWarmingOptions{
+				Targets:  []CacheWarmingTarget{{Type: "person", Scope: "test"}},
+				Interval: 50 * time.Millisecond,
+			})
+		}()
+
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("expected the warmer to stop when cancelled")
+		}
+
+		adapter.mutex.Lock()
+		defer adapter.mutex.Unlock()
+
+		if len(adapter.ListCalls) < 2 {
+			t.Errorf("expected at least 2 LIST calls, got %v", len(adapter.ListCalls))
+		}
+	})
+	t.Run("draining waits for warming and cancels it after the timeout", func(t *testing.T) {
+		e := newDrainTestEngine(t, time.Minute)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			e.warmCache(context.Background(), CacheWarmingTarget{Type: "person", Scope: "test"})
+		}()
+
+		for e.inFlightQueries.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		start := time.Now()
+
+		err := e.drain(100 * time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-done:
+		default:
+			t.Fatal("expected warming to have finished once drained")
+		}
+
+		if time.Since(start) > drainCancelTimeout {
+			t.Errorf("expected warming to be cancelled at the drain timeout, took %v", time.Since(start))
+		}
+	})
+
+	t.Run("warming is skipped while draining", func(t *testing.T) {
+		adapter := TestAdapter{ReturnType: "person", ReturnScopes: []string{"test"}}
+
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = e.AddAdapters(&adapter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.draining.Store(true)
+		e.warmCache(context.Background(), CacheWarmingTarget{Type: "person", Scope: "test"})
+
+		if len(adapter.ListCalls) != 0 {
+			t.Errorf("expected no LIST calls, got %v", len(adapter.ListCalls))
+		}
+	})
+
+	t.Run("idle check only counts this engine's executions", func(t *testing.T) {
+		e, err := NewEngine(&EngineConfig{MaxParallelExecutions: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Executions queued by other engines in the process don't hold up
+		// warming
+		listExecutionPoolCount.Add(10)
+		defer listExecutionPoolCount.Add(-10)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		if !e.waitForIdlePools(ctx) {
+			t.Error("expected the pools to be idle")
+		}
+
+		e.listExecutionsInUse.Add(1)
+		defer e.listExecutionsInUse.Add(-1)
+
+		ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		if e.waitForIdlePools(ctx) {
+			t.Error("expected the pools not to be idle")
+		}
+	})
+}
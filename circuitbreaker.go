@@ -0,0 +1,254 @@
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+)
+
+// DefaultBreakerThreshold is a suggested number of consecutive failures after
+// which to open the circuit breaker for an adapter and scope. It isn't the
+// default: `Engine.BreakerThreshold` is zero unless set, which disables
+// circuit breakers
+const DefaultBreakerThreshold = 5
+
+// DefaultBreakerCooldown is how long a circuit breaker stays open before a
+// single trial query is allowed through
+const DefaultBreakerCooldown = 30 * time.Second
+
+// breakerState is the state of a single circuit breaker
+type breakerState int
+
+const (
+	// Queries are executed as normal
+	breakerClosed breakerState = iota
+	// Queries are short-circuited without calling the adapter
+	breakerOpen
+	// A single trial query is allowed through to see if the adapter has
+	// recovered
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breakerOutcome is the result of a query, as far as the breaker is concerned
+type breakerOutcome int
+
+const (
+	// The adapter responded successfully
+	breakerSuccess breakerOutcome = iota
+	// The adapter failed, or didn't respond in time
+	breakerFailure
+	// The query was cancelled by the caller, so tells us nothing about the
+	// health of the adapter
+	breakerIgnored
+)
+
+// breakerKey identifies a circuit breaker. For adapters that serve all scopes
+// or scopes matching a pattern, the scope is the adapter's scope rather than
+// the scope of the query, so that the number of breakers is bounded by the
+// adapters' scopes
+type breakerKey struct {
+	adapter string
+	scope   string
+}
+
+// circuitBreaker tracks consecutive failures for a single adapter and scope
+type circuitBreaker struct {
+	state               breakerState
+	consecutiveFailures int
+	openedAt            time.Time
+	trialInFlight       bool
+	mutex               sync.Mutex
+}
+
+// Allow Returns whether a query should be executed. When open, this returns
+// false until the cooldown has passed, after which a single trial query is
+// allowed
+func (b *circuitBreaker) Allow(cooldown time.Duration) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < cooldown {
+			return false
+		}
+
+		b.state = breakerHalfOpen
+		b.trialInFlight = true
+
+		return true
+	case breakerHalfOpen:
+		if b.trialInFlight {
+			return false
+		}
+
+		b.trialInFlight = true
+
+		return true
+	default:
+		return true
+	}
+}
+
+// Record Records the outcome of a query that was allowed by `Allow()`
+func (b *circuitBreaker) Record(outcome breakerOutcome, threshold int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.trialInFlight = false
+	}
+
+	switch outcome {
+	case breakerSuccess:
+		b.state = breakerClosed
+		b.consecutiveFailures = 0
+	case breakerFailure:
+		b.consecutiveFailures++
+
+		if b.state == breakerHalfOpen || b.consecutiveFailures >= threshold {
+			b.state = breakerOpen
+			b.openedAt = time.Now()
+		}
+	case breakerIgnored:
+	}
+}
+
+// State Returns the current state and number of consecutive failures
+func (b *circuitBreaker) State() (breakerState, int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state, b.consecutiveFailures
+}
+
+// adapterBreakers Stores the circuit breaker for each adapter and scope
+type adapterBreakers struct {
+	breakers map[breakerKey]*circuitBreaker
+	mutex    sync.Mutex
+}
+
+// Get Returns the circuit breaker for an adapter and the scope of a query,
+// creating it if required
+func (a *adapterBreakers) Get(adapter Adapter, scope string) *circuitBreaker {
+	key := breakerKey{
+		adapter: adapter.Name(),
+		scope:   breakerScope(adapter, scope),
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.breakers == nil {
+		a.breakers = make(map[breakerKey]*circuitBreaker)
+	}
+
+	b, ok := a.breakers[key]
+	if !ok {
+		b = &circuitBreaker{}
+		a.breakers[key] = b
+	}
+
+	return b
+}
+
+// Remove Deletes the circuit breakers for an adapter in all scopes
+func (a *adapterBreakers) Remove(name string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for key := range a.breakers {
+		if key.adapter == name {
+			delete(a.breakers, key)
+		}
+	}
+}
+
+// Open Returns the keys of all breakers that are not closed, sorted by
+// adapter and scope
+func (a *adapterBreakers) Open() []breakerKey {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	open := make([]breakerKey, 0)
+	for key, b := range a.breakers {
+		if state, _ := b.State(); state != breakerClosed {
+			open = append(open, key)
+		}
+	}
+
+	sort.Slice(open, func(i, j int) bool {
+		if open[i].adapter != open[j].adapter {
+			return open[i].adapter < open[j].adapter
+		}
+		return open[i].scope < open[j].scope
+	})
+
+	return open
+}
+
+// Err Returns an error describing all breakers that are not closed, or nil if
+// all adapters are healthy
+func (a *adapterBreakers) Err() error {
+	var errs []error
+
+	for _, key := range a.Open() {
+		errs = append(errs, fmt.Errorf("circuit breaker open for adapter %v in scope %v", key.adapter, key.scope))
+	}
+
+	return errors.Join(errs...)
+}
+
+// breakerScope Returns the scope that the breaker for a query is keyed by.
+// This is the query's scope if the adapter lists it explicitly, otherwise the
+// wildcard or pattern that matched it
+func breakerScope(adapter Adapter, scope string) string {
+	var matched string
+
+	for _, adapterScope := range adapter.Scopes() {
+		if adapterScope == scope {
+			return scope
+		}
+
+		if matched == "" && (IsWildcard(adapterScope) || isGlobPattern(adapterScope)) && matchScope(adapter, adapterScope, scope).Matched {
+			matched = adapterScope
+		}
+	}
+
+	if matched != "" {
+		return matched
+	}
+
+	return scope
+}
+
+// isBreakerFailure Returns whether an error returned by an adapter indicates
+// that the adapter itself is failing, rather than that the query couldn't be
+// answered. Only timeouts and transient errors as defined by
+// `IsTransientError()`, such as throttling and 5xx responses, count. Other
+// errors, such as NOTFOUND or permissions errors for a single resource, don't
+func isBreakerFailure(err error) bool {
+	var sdpErr *sdp.QueryError
+	if errors.As(err, &sdpErr) && sdpErr.GetErrorType() == sdp.QueryError_TIMEOUT {
+		return true
+	}
+
+	return IsTransientError(err)
+}
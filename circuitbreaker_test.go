@@ -0,0 +1,264 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+)
+
+// failingTestAdapter fails all queries while `Fail` is set and counts how many
+// times it has been called. Failures are transient unless `FailErr` is set
+type failingTestAdapter struct {
+	SpeedTestAdapter
+
+	Fail    atomic.Bool
+	FailErr error
+	Calls   atomic.Int32
+}
+
+func (f *failingTestAdapter) Get(ctx context.Context, scope string, query string, ignoreCache bool) (*sdp.Item, error) {
+	f.Calls.Add(1)
+
+	if f.Fail.Load() {
+		if f.FailErr != nil {
+			return nil, f.FailErr
+		}
+		return nil, errors.New("service unavailable")
+	}
+
+	return f.SpeedTestAdapter.Get(ctx, scope, query, ignoreCache)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := circuitBreaker{}
+
+	for range 2 {
+		if !b.Allow(time.Minute) {
+			t.Fatal("expected closed breaker to allow queries")
+		}
+		b.Record(breakerFailure, 3)
+	}
+
+	if state, failures := b.State(); state != breakerClosed || failures != 2 {
+		t.Errorf("expected closed with 2 failures, got %v with %v", state, failures)
+	}
+
+	b.Record(breakerIgnored, 3)
+	b.Record(breakerFailure, 3)
+
+	if state, _ := b.State(); state != breakerOpen {
+		t.Fatalf("expected breaker to be open, got %v", state)
+	}
+
+	if b.Allow(time.Minute) {
+		t.Error("expected open breaker not to allow queries during the cooldown")
+	}
+
+	// With no cooldown the next query is a trial, and only one is allowed
+	if !b.Allow(0) {
+		t.Fatal("expected a trial query to be allowed")
+	}
+
+	if b.Allow(0) {
+		t.Error("expected only one trial query to be allowed")
+	}
+
+	t.Run("failed trial", func(t *testing.T) {
+		b.Record(breakerFailure, 3)
+
+		if state, _ := b.State(); state != breakerOpen {
+			t.Errorf("expected breaker to re-open, got %v", state)
+		}
+	})
+
+	t.Run("ignored trial", func(t *testing.T) {
+		if !b.Allow(0) {
+			t.Fatal("expected a trial query to be allowed")
+		}
+
+		b.Record(breakerIgnored, 3)
+
+		if !b.Allow(0) {
+			t.Error("expected another trial query to be allowed after an ignored one")
+		}
+	})
+
+	t.Run("successful trial", func(t *testing.T) {
+		b.Record(breakerSuccess, 3)
+
+		if state, failures := b.State(); state != breakerClosed || failures != 0 {
+			t.Errorf("expected closed with no failures, got %v with %v", state, failures)
+		}
+	})
+}
+
+func TestExecuteCircuitBreaker(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.BreakerThreshold = 3
+	e.BreakerCooldown = 100 * time.Millisecond
+
+	adapter := failingTestAdapter{}
+	adapter.Fail.Store(true)
+
+	execute := func() []*sdp.QueryError {
+		items := make(chan *sdp.Item, 10)
+		errs := make(chan *sdp.QueryError, 10)
+
+		e.Execute(context.Background(), &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "test",
+		}, &adapter, items, errs)
+
+		close(errs)
+
+		queryErrs := make([]*sdp.QueryError, 0)
+		for err := range errs {
+			queryErrs = append(queryErrs, err)
+		}
+
+		return queryErrs
+	}
+
+	for range 3 {
+		execute()
+	}
+
+	if e.breakers.Err() == nil {
+		t.Error("expected an open circuit breaker to be reported")
+	}
+
+	queryErrs := execute()
+	if len(queryErrs) != 1 || !strings.Contains(queryErrs[0].GetErrorString(), "circuit breaker open") {
+		t.Errorf("expected a circuit breaker error, got %v", queryErrs)
+	}
+
+	if calls := adapter.Calls.Load(); calls != 3 {
+		t.Errorf("expected adapter to be called 3 times, got %v", calls)
+	}
+
+	// Once the cooldown has passed, a successful trial closes the breaker
+	adapter.Fail.Store(false)
+	time.Sleep(e.BreakerCooldown)
+
+	queryErrs = execute()
+	if len(queryErrs) != 0 {
+		t.Errorf("expected no errors, got %v", queryErrs)
+	}
+
+	if err := e.breakers.Err(); err != nil {
+		t.Errorf("expected no open circuit breakers, got %v", err)
+	}
+}
+
+func TestExecuteCircuitBreakerIgnoresPermanentErrors(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.BreakerThreshold = 1
+
+	adapter := failingTestAdapter{FailErr: errors.New("access denied")}
+	adapter.Fail.Store(true)
+
+	for range 3 {
+		errs := make(chan *sdp.QueryError, 10)
+
+		e.Execute(context.Background(), &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "test",
+		}, &adapter, make(chan *sdp.Item, 10), errs)
+	}
+
+	if calls := adapter.Calls.Load(); calls != 3 {
+		t.Errorf("expected the adapter to be called every time, got %v calls", calls)
+	}
+
+	if err := e.breakers.Err(); err != nil {
+		t.Errorf("expected no open circuit breakers, got %v", err)
+	}
+}
+
+func TestCircuitBreakersAreOptIn(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.BreakerThreshold != 0 {
+		t.Errorf("expected circuit breakers to be disabled by default, got a threshold of %v", e.BreakerThreshold)
+	}
+}
+
+func TestBreakerScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		scopes   []string
+		scope    string
+		expected string
+	}{
+		{"explicit scope", []string{"a", "b"}, "b", "b"},
+		{"wildcard adapter", []string{"*"}, "any-scope", "*"},
+		{"explicit scope preferred over wildcard", []string{"*", "a"}, "a", "a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			adapter := &TestAdapter{ReturnScopes: test.scopes}
+
+			if scope := breakerScope(adapter, test.scope); scope != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, scope)
+			}
+		})
+	}
+
+	t.Run("wildcard adapters share a breaker", func(t *testing.T) {
+		var breakers adapterBreakers
+		adapter := &TestAdapter{ReturnScopes: []string{"*"}}
+
+		if breakers.Get(adapter, "one") != breakers.Get(adapter, "two") {
+			t.Error("expected queries in different scopes to use the same breaker")
+		}
+	})
+}
+
+func TestExecutionOutcome(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		numItems    int32
+		numFailures int32
+		expected    breakerOutcome
+	}{
+		{"success", context.Background(), 1, 0, breakerSuccess},
+		{"partial failure", context.Background(), 1, 1, breakerSuccess},
+		{"failure", context.Background(), 0, 1, breakerFailure},
+		{"cancelled", cancelled, 0, 1, breakerIgnored},
+		{"timed out", expired, 0, 0, breakerFailure},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if outcome := executionOutcome(test.ctx, test.numItems, test.numFailures); outcome != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, outcome)
+			}
+		})
+	}
+}
@@ -59,6 +59,17 @@ func AddEngineFlags(command *cobra.Command) {
 
 	command.PersistentFlags().Int("max-parallel", 0, "The maximum number of parallel executions")
 	cobra.CheckErr(viper.BindEnv("max-parallel", "MAX_PARALLEL"))
+
+	command.PersistentFlags().String("query-server-address", "", "The address for the HTTP query server to listen on e.g. 'localhost:8089'. This allows queries to be sent to the source directly without NATS. There is no authentication, so only loopback addresses are allowed. Disabled if blank")
+	cobra.CheckErr(viper.BindEnv("query-server-address", "QUERY_SERVER_ADDRESS"))
+	command.PersistentFlags().String("metrics-server-address", "", "The address to serve Prometheus metrics on e.g. ':9090'. Metrics are served at /metrics. Disabled if blank")
+	cobra.CheckErr(viper.BindEnv("metrics-server-address", "METRICS_SERVER_ADDRESS"))
+	command.PersistentFlags().String("health-server-address", "", "The address to serve health checks on e.g. ':8080'. Liveness is served at /healthz and readiness at /readyz. Disabled if blank")
+	cobra.CheckErr(viper.BindEnv("health-server-address", "HEALTH_SERVER_ADDRESS"))
+	command.PersistentFlags().Duration("drain-timeout", 0, "How long to wait for in-flight queries to finish when shutting down before cancelling them")
+	cobra.CheckErr(viper.BindEnv("drain-timeout", "DRAIN_TIMEOUT"))
+	command.PersistentFlags().String("cache-snapshot-path", "", "The file to save adapter caches to when shutting down and restore them from when starting, so that restarts don't begin with empty caches. Disabled if blank")
+	cobra.CheckErr(viper.BindEnv("cache-snapshot-path", "CACHE_SNAPSHOT_PATH"))
 }
 
 func EngineConfigFromViper(engineType, version string) (*EngineConfig, error) {
@@ -186,9 +197,87 @@ func EngineConfigFromViper(engineType, version string) (*EngineConfig, error) {
 		NATSOptions:           &natsOptions,
 		Unauthenticated:       allowUnauthenticated,
 		MaxParallelExecutions: maxParallelExecutions,
+		QueryServerAddress:    viper.GetString("query-server-address"),
+		MetricsServerAddress:  viper.GetString("metrics-server-address"),
+		HealthServerAddress:   viper.GetString("health-server-address"),
+		DrainTimeout:          viper.GetDuration("drain-timeout"),
+		CacheSnapshotPath:     viper.GetString("cache-snapshot-path"),
 	}, nil
 }
 
+// NewInvalidateCacheCommand Returns a command that sends a cache invalidation
+// over NATS, evicting cached results from every replica of every source that
+// serves the scope. It connects using the same configuration as the engine, so
+// `AddEngineFlags()` must have been called on a parent command. Sources can add
+// this to their root command to force fresh data to be discovered after a
+// known infrastructure change
+func NewInvalidateCacheCommand(engineType string) *cobra.Command {
+	command := &cobra.Command{
+		Use:   "invalidate-cache",
+		Short: "Evicts cached results from every replica of the source",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var invalidation CacheInvalidation
+			var err error
+
+			invalidation.Scope, err = cmd.Flags().GetString("scope")
+			if err != nil {
+				return err
+			}
+			invalidation.Type, err = cmd.Flags().GetString("type")
+			if err != nil {
+				return err
+			}
+			invalidation.UniqueAttributeValue, err = cmd.Flags().GetString("unique-attribute-value")
+			if err != nil {
+				return err
+			}
+
+			err = invalidation.Validate()
+			if err != nil {
+				return err
+			}
+
+			ec, err := EngineConfigFromViper(engineType, "")
+			if err != nil {
+				return fmt.Errorf("error getting engine config: %w", err)
+			}
+
+			err = ec.CreateClients()
+			if err != nil {
+				return fmt.Errorf("error creating clients: %w", err)
+			}
+
+			conn, err := ec.NATSOptions.Connect()
+			if err != nil {
+				return fmt.Errorf("error connecting to NATS: %w", err)
+			}
+			defer conn.Close()
+
+			err = PublishCacheInvalidation(cmd.Context(), conn, invalidation)
+			if err != nil {
+				return fmt.Errorf("error publishing cache invalidation: %w", err)
+			}
+
+			err = conn.Underlying().Flush()
+			if err != nil {
+				return fmt.Errorf("error flushing NATS connection: %w", err)
+			}
+
+			log.WithField("subject", invalidation.Subject()).Info("Cache invalidation sent")
+
+			return nil
+		},
+	}
+
+	command.Flags().String("scope", "", "The scope to evict cached results for")
+	command.Flags().String("type", "", "The type to evict cached results for. All types are evicted if blank")
+	command.Flags().String("unique-attribute-value", "", "The unique attribute value of the item to evict. All results for the type are evicted if blank")
+	cobra.CheckErr(command.MarkFlagRequired("scope"))
+
+	return command
+}
+
 // MapFromEngineConfig Returns the config as a map
 func MapFromEngineConfig(ec *EngineConfig) map[string]any {
 	var apiKeyClientSecret string
@@ -217,6 +306,11 @@ func MapFromEngineConfig(ec *EngineConfig) map[string]any {
 		"nats-connection-timeout":  ec.NATSConnectionTimeout,
 		"nats-queue-name":          ec.NATSQueueName,
 		"unauthenticated":          ec.Unauthenticated,
+		"query-server-address":     ec.QueryServerAddress,
+		"metrics-server-address":   ec.MetricsServerAddress,
+		"health-server-address":    ec.HealthServerAddress,
+		"drain-timeout":            ec.DrainTimeout,
+		"cache-snapshot-path":      ec.CacheSnapshotPath,
 	}
 }
 
@@ -0,0 +1,285 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/overmindtech/sdp-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+)
+
+// coalesceKey identifies executions that would return identical results
+type coalesceKey struct {
+	adapter     string
+	typ         string
+	scope       string
+	method      sdp.QueryMethod
+	query       string
+	ignoreCache bool
+}
+
+func newCoalesceKey(q *sdp.Query, adapter Adapter) coalesceKey {
+	return coalesceKey{
+		adapter:     adapter.Name(),
+		typ:         q.GetType(),
+		scope:       q.GetScope(),
+		method:      q.GetMethod(),
+		query:       q.GetQuery(),
+		ignoreCache: q.GetIgnoreCache(),
+	}
+}
+
+// coalescedExecution is a single call to an adapter whose results are shared
+// by every identical execution that started before it returned any results
+type coalescedExecution struct {
+	// Closed once the call is complete, after which no more results will be
+	// sent to followers
+	done chan struct{}
+
+	// Whether the call was cut short because the context of the execution
+	// that made it was cancelled. In this case the results are incomplete
+	aborted bool
+
+	// Whether the adapter has returned any results. Since results aren't
+	// recorded, executions can only join before this
+	started bool
+
+	followers []*coalesceFollower
+	mutex     sync.Mutex
+}
+
+// sharedResult is a single item or error sent to a follower
+type sharedResult struct {
+	item *sdp.Item
+	err  error
+}
+
+// coalesceFollower is an execution that is waiting for the results of another
+// execution's adapter call. Results are queued by the leader and sent to the
+// follower's handlers by its own goroutine, so that a slow follower doesn't
+// hold up the leader
+type coalesceFollower struct {
+	// Receives a value whenever results are queued
+	notify chan struct{}
+
+	queue []sharedResult
+	mutex sync.Mutex
+}
+
+// push Queues a result for the follower
+func (f *coalesceFollower) push(result sharedResult) {
+	f.mutex.Lock()
+	f.queue = append(f.queue, result)
+	f.mutex.Unlock()
+
+	select {
+	case f.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take Returns and removes the queued results
+func (f *coalesceFollower) take() []sharedResult {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	queue := f.queue
+	f.queue = nil
+
+	return queue
+}
+
+// follow Adds a follower to the execution. Returns false if the adapter has
+// already returned results, since the follower would miss them
+func (c *coalescedExecution) follow() (*coalesceFollower, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.started {
+		return nil, false
+	}
+
+	follower := &coalesceFollower{
+		notify: make(chan struct{}, 1),
+	}
+	c.followers = append(c.followers, follower)
+
+	return follower, true
+}
+
+// unfollow Removes a follower that is no longer interested in the results
+func (c *coalescedExecution) unfollow(follower *coalesceFollower) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.followers = slices.DeleteFunc(c.followers, func(f *coalesceFollower) bool {
+		return f == follower
+	})
+}
+
+// broadcast Sends a copy of a result to each follower. Copies are needed
+// since the original is modified and sent to the execution that made the
+// call. Nothing is copied if there are no followers
+func (c *coalescedExecution) broadcast(result sharedResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.started = true
+
+	for _, follower := range c.followers {
+		if result.item != nil {
+			follower.push(sharedResult{item: proto.Clone(result.item).(*sdp.Item)})
+		} else {
+			follower.push(sharedResult{err: cloneError(result.err)})
+		}
+	}
+}
+
+// cloneError Returns a copy of an error if it is an `sdp.QueryError`, since
+// these are modified before being sent. Other errors are returned as-is
+func cloneError(err error) error {
+	var sdpErr *sdp.QueryError
+	if errors.As(err, &sdpErr) {
+		return proto.Clone(sdpErr).(*sdp.QueryError)
+	}
+
+	return err
+}
+
+// executionCoalescer Tracks the executions that are currently calling adapters
+type executionCoalescer struct {
+	executions map[coalesceKey]*coalescedExecution
+	mutex      sync.Mutex
+}
+
+// join Returns the running execution for a key, or creates one. Returns true
+// if the caller created the execution and is responsible for calling the
+// adapter and calling `finish()`
+func (c *executionCoalescer) join(key coalesceKey) (*coalescedExecution, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.executions == nil {
+		c.executions = make(map[coalesceKey]*coalescedExecution)
+	}
+
+	if execution, ok := c.executions[key]; ok {
+		return execution, false
+	}
+
+	execution := &coalescedExecution{
+		done: make(chan struct{}),
+	}
+	c.executions[key] = execution
+
+	return execution, true
+}
+
+// finish Marks an execution as complete and releases anyone waiting for it.
+// Executions that start after this will call the adapter again
+func (c *executionCoalescer) finish(key coalesceKey, execution *coalescedExecution, aborted bool) {
+	c.mutex.Lock()
+	delete(c.executions, key)
+	c.mutex.Unlock()
+
+	execution.mutex.Lock()
+	execution.aborted = aborted
+	execution.mutex.Unlock()
+
+	close(execution.done)
+}
+
+// executeCoalesced Runs a query against an adapter, sharing a single adapter
+// call between all identical executions that are running at the same time.
+// The first execution calls the adapter and streams its results as normal.
+// Identical executions that start before the adapter has returned any results
+// follow it, and are sent copies of its results as they arrive. Results
+// aren't recorded, so executions that start later call the adapter
+// themselves. If the first execution is cancelled, its followers call the
+// adapter themselves, skipping any items that they were already sent.
+// Callers must already hold the adapter's concurrency slot, if it has one, so
+// that a follower is never holding a slot that its leader is waiting for
+func (e *Engine) executeCoalesced(ctx context.Context, q *sdp.Query, adapter Adapter, itemHandler ItemHandler, errHandler ErrHandler) {
+	key := newCoalesceKey(q, adapter)
+	execution, leader := e.coalescer.join(key)
+
+	if leader {
+		defer func() {
+			e.coalescer.finish(key, execution, ctx.Err() != nil)
+		}()
+
+		e.runAdapter(ctx, q, adapter,
+			func(item *sdp.Item) {
+				if item != nil {
+					execution.broadcast(sharedResult{item: item})
+				}
+				itemHandler(item)
+			},
+			func(err error) {
+				if err != nil {
+					execution.broadcast(sharedResult{err: err})
+				}
+				errHandler(err)
+			},
+		)
+
+		return
+	}
+
+	follower, ok := execution.follow()
+	if !ok {
+		e.runAdapter(ctx, q, adapter, itemHandler, errHandler)
+		return
+	}
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Bool("ovm.adapter.coalesced", true))
+
+	// The names of the items that have been sent, in case the leader is
+	// cancelled and the adapter has to be called again
+	sent := make(map[string]bool)
+	send := func() {
+		for _, result := range follower.take() {
+			if result.item != nil {
+				sent[result.item.GloballyUniqueName()] = true
+				itemHandler(result.item)
+			} else {
+				errHandler(result.err)
+			}
+		}
+	}
+
+	for finished := false; !finished; {
+		select {
+		case <-follower.notify:
+			send()
+		case <-execution.done:
+			send()
+			finished = true
+		case <-ctx.Done():
+			execution.unfollow(follower)
+			errHandler(&sdp.QueryError{
+				ErrorType:   sdp.QueryError_OTHER,
+				ErrorString: ctx.Err().Error(),
+			})
+			return
+		}
+	}
+
+	if execution.aborted {
+		span.SetAttributes(attribute.Bool("ovm.adapter.coalescedAborted", true))
+		e.runAdapter(ctx, q, adapter,
+			func(item *sdp.Item) {
+				if item != nil && sent[item.GloballyUniqueName()] {
+					return
+				}
+				itemHandler(item)
+			},
+			errHandler,
+		)
+	}
+}
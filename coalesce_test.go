@@ -0,0 +1,232 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/overmindtech/sdp-go"
+)
+
+func TestExecuteCoalesced(t *testing.T) {
+	// coalescedResult is what a single execution received
+	type coalescedResult struct {
+		uuid  uuid.UUID
+		items []*sdp.Item
+		errs  []*sdp.QueryError
+	}
+
+	execute := func(ctx context.Context, e *Engine, adapter Adapter, query string) coalescedResult {
+		u := uuid.New()
+		items := make(chan *sdp.Item, 10)
+		errs := make(chan *sdp.QueryError, 10)
+
+		e.Execute(ctx, &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  query,
+			Scope:  "test",
+			UUID:   u[:],
+		}, adapter, items, errs)
+
+		close(items)
+		close(errs)
+
+		result := coalescedResult{uuid: u}
+		for item := range items {
+			result.items = append(result.items, item)
+		}
+		for err := range errs {
+			result.errs = append(result.errs, err)
+		}
+
+		return result
+	}
+
+	t.Run("identical queries share a call", func(t *testing.T) {
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		adapter := failingTestAdapter{
+			SpeedTestAdapter: SpeedTestAdapter{QueryDelay: 100 * time.Millisecond},
+		}
+
+		results := make([]coalescedResult, 5)
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i] = execute(context.Background(), e, &adapter, "Dylan")
+			}()
+		}
+		wg.Wait()
+
+		if calls := adapter.Calls.Load(); calls != 1 {
+			t.Errorf("expected 1 adapter call, got %v", calls)
+		}
+
+		seen := make(map[*sdp.Item]bool)
+		for _, result := range results {
+			if len(result.items) != 1 || len(result.errs) != 0 {
+				t.Fatalf("expected 1 item and no errors, got %v items and errors %v", len(result.items), result.errs)
+			}
+
+			item := result.items[0]
+			if seen[item] {
+				t.Error("expected every execution to receive its own copy of the item")
+			}
+			seen[item] = true
+
+			if !bytes.Equal(item.GetMetadata().GetSourceQuery().GetUUID(), result.uuid[:]) {
+				t.Error("expected item metadata to reference the execution's own query")
+			}
+		}
+	})
+
+	t.Run("different queries do not share a call", func(t *testing.T) {
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		adapter := failingTestAdapter{
+			SpeedTestAdapter: SpeedTestAdapter{QueryDelay: 50 * time.Millisecond},
+		}
+
+		var wg sync.WaitGroup
+		for _, query := range []string{"Dylan", "Katie"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				execute(context.Background(), e, &adapter, query)
+			}()
+		}
+		wg.Wait()
+
+		if calls := adapter.Calls.Load(); calls != 2 {
+			t.Errorf("expected 2 adapter calls, got %v", calls)
+		}
+	})
+
+	t.Run("errors are shared", func(t *testing.T) {
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		adapter := failingTestAdapter{
+			SpeedTestAdapter: SpeedTestAdapter{QueryDelay: 50 * time.Millisecond},
+		}
+		adapter.Fail.Store(true)
+
+		results := make([]coalescedResult, 3)
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i] = execute(context.Background(), e, &adapter, "Dylan")
+			}()
+		}
+		wg.Wait()
+
+		for _, result := range results {
+			if len(result.errs) != 1 {
+				t.Fatalf("expected 1 error, got %v", result.errs)
+			}
+
+			if !bytes.Equal(result.errs[0].GetUUID(), result.uuid[:]) {
+				t.Error("expected error to reference the execution's own query")
+			}
+		}
+	})
+
+	t.Run("cancelled leader", func(t *testing.T) {
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		adapter := failingTestAdapter{
+			SpeedTestAdapter: SpeedTestAdapter{QueryDelay: 100 * time.Millisecond},
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			execute(ctx, e, &adapter, "Dylan")
+		}()
+
+		// Wait for the leader to call the adapter before joining
+		for adapter.Calls.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		var follower coalescedResult
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			follower = execute(context.Background(), e, &adapter, "Dylan")
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		wg.Wait()
+
+		if len(follower.items) != 1 {
+			t.Errorf("expected the follower to get an item, got %v items and errors %v", len(follower.items), follower.errs)
+		}
+
+		if calls := adapter.Calls.Load(); calls != 2 {
+			t.Errorf("expected the follower to call the adapter itself, got %v calls", calls)
+		}
+	})
+}
+
+func TestCoalescedExecutionFollow(t *testing.T) {
+	execution := &coalescedExecution{done: make(chan struct{})}
+
+	// Nothing is copied while there are no followers
+	execution.broadcast(sharedResult{item: (&TestAdapter{}).NewTestItem("test", "one")})
+
+	if _, ok := execution.follow(); ok {
+		t.Error("expected executions to be unable to follow once results have been returned")
+	}
+
+	execution = &coalescedExecution{done: make(chan struct{})}
+
+	follower, ok := execution.follow()
+	if !ok {
+		t.Fatal("expected to be able to follow before results are returned")
+	}
+
+	item := (&TestAdapter{}).NewTestItem("test", "one")
+	execution.broadcast(sharedResult{item: item})
+
+	select {
+	case <-follower.notify:
+	default:
+		t.Error("expected the follower to be notified")
+	}
+
+	results := follower.take()
+	if len(results) != 1 || results[0].item == item {
+		t.Errorf("expected the follower to be sent a copy of the item, got %v", results)
+	}
+
+	execution.unfollow(follower)
+	execution.broadcast(sharedResult{item: item})
+
+	if results := follower.take(); len(results) != 0 {
+		t.Errorf("expected nothing to be sent after unfollowing, got %v", results)
+	}
+}
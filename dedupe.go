@@ -0,0 +1,74 @@
+package discovery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultDuplicateQueryWindow is how long the UUID of a finished query is
+// remembered for, so that late duplicates are still suppressed
+const DefaultDuplicateQueryWindow = time.Minute
+
+// seenQueries Tracks the UUIDs of queries that are being handled, or have been
+// handled recently
+type seenQueries struct {
+	// The time each query finished, or the zero time if it is still running
+	finished  map[uuid.UUID]time.Time
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+// Claim Marks a query as being handled. Returns false if the query is already
+// being handled, or finished less than `window` ago
+func (s *seenQueries) Claim(u uuid.UUID, window time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.finished == nil {
+		s.finished = make(map[uuid.UUID]time.Time)
+	}
+
+	s.prune(window)
+
+	if finished, seen := s.finished[u]; seen {
+		if finished.IsZero() || time.Since(finished) < window {
+			return false
+		}
+	}
+
+	s.finished[u] = time.Time{}
+
+	return true
+}
+
+// Release Marks a query as finished. It will continue to be treated as a
+// duplicate until the window has passed
+func (s *seenQueries) Release(u uuid.UUID) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.finished == nil {
+		return
+	}
+
+	s.finished[u] = time.Now()
+}
+
+// prune Removes queries that finished more than `window` ago. To avoid
+// scanning the map for every query this runs at most once per window. The
+// mutex must be held by the caller
+func (s *seenQueries) prune(window time.Duration) {
+	if time.Since(s.lastPrune) < window {
+		return
+	}
+
+	for u, finished := range s.finished {
+		if !finished.IsZero() && time.Since(finished) >= window {
+			delete(s.finished, u)
+		}
+	}
+
+	s.lastPrune = time.Now()
+}
@@ -0,0 +1,106 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/overmindtech/sdp-go"
+	"github.com/sourcegraph/conc/pool"
+)
+
+func TestSeenQueries(t *testing.T) {
+	s := seenQueries{}
+	u := uuid.New()
+	window := 50 * time.Millisecond
+
+	if !s.Claim(u, window) {
+		t.Fatal("expected first claim to succeed")
+	}
+
+	if s.Claim(u, window) {
+		t.Error("expected claim of a running query to fail")
+	}
+
+	s.Release(u)
+
+	if s.Claim(u, window) {
+		t.Error("expected claim within the window to fail")
+	}
+
+	if !s.Claim(uuid.New(), window) {
+		t.Error("expected claim of a different query to succeed")
+	}
+
+	time.Sleep(window)
+
+	if !s.Claim(u, window) {
+		t.Error("expected claim after the window to succeed")
+	}
+
+	t.Run("pruning", func(t *testing.T) {
+		s := seenQueries{}
+
+		for range 10 {
+			u := uuid.New()
+			s.Claim(u, window)
+			s.Release(u)
+		}
+
+		time.Sleep(window)
+
+		// This triggers a prune of everything that has expired
+		s.Claim(uuid.New(), window)
+
+		if len(s.finished) != 1 {
+			t.Errorf("expected expired queries to be pruned, %v remaining", len(s.finished))
+		}
+	})
+}
+
+func TestHandleQueryDuplicates(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.listExecutionPool = pool.New().WithMaxGoroutines(10)
+	e.getExecutionPool = pool.New().WithMaxGoroutines(10)
+
+	adapter := failingTestAdapter{
+		SpeedTestAdapter: SpeedTestAdapter{QueryDelay: 50 * time.Millisecond},
+	}
+
+	err = e.AddAdapters(&adapter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newQuery := func(u uuid.UUID) *sdp.Query {
+		return &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "test",
+			UUID:   u[:],
+		}
+	}
+
+	u := uuid.New()
+
+	e.HandleQuery(context.Background(), newQuery(u))
+
+	// The same query arriving on the other subject should be ignored
+	e.HandleQuery(context.Background(), newQuery(u))
+
+	if calls := adapter.Calls.Load(); calls != 1 {
+		t.Errorf("expected duplicate to be ignored, got %v adapter calls", calls)
+	}
+
+	e.HandleQuery(context.Background(), newQuery(uuid.New()))
+
+	if calls := adapter.Calls.Load(); calls != 2 {
+		t.Errorf("expected a new query to be handled, got %v adapter calls", calls)
+	}
+}
@@ -0,0 +1,530 @@
+package discovery
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	"github.com/overmindtech/sdpcache"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DiskCache is a `Cache` that stores results as files in a directory, so that
+// they survive restarts and can be shared between processes with access to the
+// same directory. Each combination of source name, scope and type has its own
+// subdirectory, in which results are indexed by the queries that would return
+// them: items and GET errors by unique attribute value, and LIST and SEARCH
+// results by method and query. This means that a lookup only reads the files
+// for its own query. Expired results are never returned, even if they haven't
+// been purged yet. Since the results are meant to outlive the engine, the
+// engine doesn't clear them when it is stopped or an adapter is removed
+type DiskCache struct {
+	// Minimum amount of time to wait between purges. Defaults to
+	// `sdpcache.MinWaitDefault`
+	MinWaitTime time.Duration
+
+	dir string
+
+	// Held for writing while the whole cache is cleared, and for reading by
+	// everything else
+	mutex sync.RWMutex
+
+	// Locks for each source name, scope and type, so that queries for
+	// different types and scopes don't wait for each other
+	sstLocks sync.Map
+
+	purging atomic.Bool
+}
+
+var _ Cache = (*DiskCache)(nil)
+var _ PersistentCache = (*DiskCache)(nil)
+
+// NewDiskCache Creates a disk cache that stores results in `dir`, creating it
+// if required. Results that are already in the directory will be used
+func NewDiskCache(dir string) (*DiskCache, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cache directory: %w", err)
+	}
+
+	return &DiskCache{
+		dir: dir,
+	}, nil
+}
+
+// Persistent Returns true, since results are kept on disk
+func (d *DiskCache) Persistent() bool {
+	return true
+}
+
+// diskCacheFile is an entry along with the file it was read from
+type diskCacheFile struct {
+	path  string
+	entry CacheEntry
+}
+
+// Lookup Returns whether the cache has a result for the given query. This has
+// the same semantics as `sdpcache.Cache.Lookup()`
+func (d *DiskCache) Lookup(ctx context.Context, srcName string, method sdp.QueryMethod, scope string, typ string, query string, ignoreCache bool) (bool, sdpcache.CacheKey, []*sdp.Item, *sdp.QueryError) {
+	ck := sdpcache.CacheKeyFromParts(srcName, method, scope, typ, query)
+
+	if ignoreCache {
+		return ignoredCacheLookup(ctx, ck)
+	}
+
+	unlock := d.rLockSST(ck.SST)
+	files, err := d.search(ck, time.Now())
+	unlock()
+	if err != nil {
+		// A cache that can't be read is treated as empty so that the adapter
+		// is queried instead
+		span := trace.SpanFromContext(ctx)
+		span.RecordError(err)
+		span.SetAttributes(
+			attribute.String("ovm.cache.result", "cache read error"),
+			attribute.Bool("ovm.cache.hit", false),
+		)
+		return false, ck, nil, nil
+	}
+
+	entries := make([]CacheEntry, 0, len(files))
+	for _, file := range files {
+		entries = append(entries, file.entry)
+	}
+
+	return cacheLookup(ctx, ck, method, entries, d.Delete)
+}
+
+// StoreItem Stores an item for the given duration
+func (d *DiskCache) StoreItem(item *sdp.Item, duration time.Duration, ck sdpcache.CacheKey) {
+	if item == nil {
+		return
+	}
+
+	d.store(newItemCacheEntry(item, duration, ck))
+}
+
+// StoreError Stores an error for the given duration
+func (d *DiskCache) StoreError(err error, duration time.Duration, ck sdpcache.CacheKey) {
+	if err == nil {
+		return
+	}
+
+	d.store(newErrorCacheEntry(err, duration, ck))
+}
+
+// Delete Deletes everything that matches the given cache key
+func (d *DiskCache) Delete(ck sdpcache.CacheKey) {
+	unlock := d.lockSST(ck.SST)
+	defer unlock()
+
+	if ck.UniqueAttributeValue == nil && ck.Method == nil && ck.Query == nil {
+		err := os.RemoveAll(d.sstDir(ck.SST))
+		if err != nil {
+			log.WithError(err).Warn("Error deleting from disk cache")
+		}
+		return
+	}
+
+	// Include expired results so that they are deleted too
+	files, err := d.search(ck, time.Time{})
+	if err != nil {
+		log.WithError(err).Warn("Error reading disk cache")
+		return
+	}
+
+	for _, file := range files {
+		d.remove(file.entry)
+	}
+}
+
+// Purge Deletes all results that expired before the given time
+func (d *DiskCache) Purge(before time.Time) sdpcache.PurgeStats {
+	start := time.Now()
+	stats := sdpcache.PurgeStats{}
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	sstDirs, err := os.ReadDir(d.dir)
+	if err != nil {
+		log.WithError(err).Warn("Error purging disk cache")
+	}
+
+	for _, sstDir := range sstDirs {
+		if !sstDir.IsDir() {
+			continue
+		}
+
+		lock := d.sstLock(sdpcache.SSTHash(sstDir.Name()))
+		lock.Lock()
+
+		err = d.walkSST(filepath.Join(d.dir, sstDir.Name()), func(path string, entry CacheEntry) {
+			if entry.Expiry.Before(before) {
+				// Files written by older versions aren't indexed, so are
+				// removed directly
+				if filepath.Dir(path) == filepath.Join(d.dir, sstDir.Name()) {
+					if os.Remove(path) == nil {
+						stats.NumPurged++
+					}
+					return
+				}
+
+				// The other copies of the entry will fail to be read, so
+				// it is only counted once
+				if d.remove(entry) {
+					stats.NumPurged++
+				}
+				return
+			}
+
+			if stats.NextExpiry == nil || entry.Expiry.Before(*stats.NextExpiry) {
+				expiry := entry.Expiry
+				stats.NextExpiry = &expiry
+			}
+		})
+		if err != nil {
+			log.WithError(err).Warn("Error purging disk cache")
+		}
+
+		lock.Unlock()
+	}
+
+	stats.TimeTaken = time.Since(start)
+
+	return stats
+}
+
+// StartPurger Purges expired results in the background until the context is
+// cancelled
+func (d *DiskCache) StartPurger(ctx context.Context) error {
+	if !d.purging.CompareAndSwap(false, true) {
+		return errors.New("purger already running")
+	}
+
+	go func() {
+		defer d.purging.Store(false)
+
+		runPurger(ctx, d.Purge, d.MinWaitTime)
+	}()
+
+	return nil
+}
+
+// Clear Deletes everything in the cache
+func (d *DiskCache) Clear() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	dirs, err := os.ReadDir(d.dir)
+	if err != nil {
+		log.WithError(err).Warn("Error clearing disk cache")
+		return
+	}
+
+	for _, dir := range dirs {
+		err = os.RemoveAll(filepath.Join(d.dir, dir.Name()))
+		if err != nil {
+			log.WithError(err).Warn("Error clearing disk cache")
+		}
+	}
+}
+
+// sstLock Returns the lock for a source name, scope and type
+func (d *DiskCache) sstLock(hash sdpcache.SSTHash) *sync.RWMutex {
+	lock, _ := d.sstLocks.LoadOrStore(hash, &sync.RWMutex{})
+
+	return lock.(*sync.RWMutex)
+}
+
+// lockSST Locks a source name, scope and type for writing, returning a
+// function that unlocks it
+func (d *DiskCache) lockSST(sst sdpcache.SST) func() {
+	d.mutex.RLock()
+	lock := d.sstLock(sst.Hash())
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+		d.mutex.RUnlock()
+	}
+}
+
+// rLockSST Locks a source name, scope and type for reading, returning a
+// function that unlocks it
+func (d *DiskCache) rLockSST(sst sdpcache.SST) func() {
+	d.mutex.RLock()
+	lock := d.sstLock(sst.Hash())
+	lock.RLock()
+
+	return func() {
+		lock.RUnlock()
+		d.mutex.RUnlock()
+	}
+}
+
+// sstDir Returns the directory that results for a source name, scope and type
+// are stored in
+func (d *DiskCache) sstDir(sst sdpcache.SST) string {
+	return filepath.Join(d.dir, string(sst.Hash()))
+}
+
+// paths Returns the files that an entry is stored in, one for each query that
+// it can be found by
+func (d *DiskCache) paths(entry CacheEntry) []string {
+	dir := d.sstDir(entry.SST)
+	id := entry.id()
+
+	var paths []string
+
+	// Items can be found by a GET for their unique attribute value, no matter
+	// how they were found
+	if entry.Item != nil || entry.Method == sdp.QueryMethod_GET {
+		paths = append(paths, filepath.Join(dir, uavBucket(entry.UniqueAttributeValue), id))
+	}
+
+	switch entry.Method {
+	case sdp.QueryMethod_LIST:
+		paths = append(paths, filepath.Join(dir, listBucket, id))
+	case sdp.QueryMethod_SEARCH:
+		paths = append(paths, filepath.Join(dir, searchBucket(entry.Query), id))
+	}
+
+	return paths
+}
+
+// store Writes an entry to disk. Entries are written to a temporary file then
+// renamed so that other processes never read partially written files
+func (d *DiskCache) store(entry CacheEntry) {
+	encoded, err := encodeCacheEntry(entry)
+	if err != nil {
+		log.WithError(err).Warn("Error encoding disk cache entry")
+		return
+	}
+
+	b, err := json.Marshal(encoded)
+	if err != nil {
+		log.WithError(err).Warn("Error encoding disk cache entry")
+		return
+	}
+
+	unlock := d.lockSST(entry.SST)
+	defer unlock()
+
+	for _, path := range d.paths(entry) {
+		err = writeFileAtomic(path, b)
+		if err != nil {
+			log.WithError(err).Warn("Error writing to disk cache")
+			return
+		}
+	}
+}
+
+// remove Deletes every copy of an entry, returning whether any were deleted.
+// The SST must be locked by the caller
+func (d *DiskCache) remove(entry CacheEntry) bool {
+	var removed bool
+
+	for _, path := range d.paths(entry) {
+		err := os.Remove(path)
+		if err == nil {
+			removed = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.WithError(err).Warn("Error deleting from disk cache")
+		}
+	}
+
+	return removed
+}
+
+// search Returns the entries that match a cache key and expire after
+// `notExpiredAt`. Pass the zero time to include expired entries. Keys for a
+// single query only read the files for that query, other keys read every
+// result for the SST. The SST must be locked by the caller
+func (d *DiskCache) search(ck sdpcache.CacheKey, notExpiredAt time.Time) ([]diskCacheFile, error) {
+	files := make([]diskCacheFile, 0)
+
+	collect := func(path string, entry CacheEntry) {
+		if !notExpiredAt.IsZero() && !entry.Expiry.After(notExpiredAt) {
+			return
+		}
+
+		if !ck.Matches(entry.indexValues()) {
+			return
+		}
+
+		files = append(files, diskCacheFile{
+			path:  path,
+			entry: entry,
+		})
+	}
+
+	var err error
+	if bucket, ok := diskCacheBucket(ck); ok {
+		err = walkBucket(filepath.Join(d.sstDir(ck.SST), bucket), collect)
+	} else {
+		// Entries are stored in more than one bucket, so only keep one copy
+		seen := make(map[string]bool)
+		err = d.walkSST(d.sstDir(ck.SST), func(path string, entry CacheEntry) {
+			if seen[entry.id()] {
+				return
+			}
+			seen[entry.id()] = true
+
+			collect(path, entry)
+		})
+	}
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	return files, err
+}
+
+// walkSST Calls `fn` for every file in the directory of an SST, including
+// files written by older versions that aren't in a bucket
+func (d *DiskCache) walkSST(dir string, fn func(path string, entry CacheEntry)) error {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, dirEntry := range dirEntries {
+		if strings.HasPrefix(dirEntry.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, dirEntry.Name())
+
+		if dirEntry.IsDir() {
+			err = walkBucket(path, fn)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+
+		entry, err := readDiskCacheEntry(path)
+		if err != nil {
+			continue
+		}
+
+		fn(path, entry)
+	}
+
+	return nil
+}
+
+// listBucket is the bucket that LIST results are stored in
+const listBucket = "list"
+
+// uavBucket Returns the bucket that results for a unique attribute value are
+// stored in
+func uavBucket(uav string) string {
+	return fmt.Sprintf("uav-%x", sha1.Sum([]byte(uav)))
+}
+
+// searchBucket Returns the bucket that results of a SEARCH are stored in
+func searchBucket(query string) string {
+	return fmt.Sprintf("search-%x", sha1.Sum([]byte(query)))
+}
+
+// diskCacheBucket Returns the bucket that contains every result matching a
+// cache key, if there is one
+func diskCacheBucket(ck sdpcache.CacheKey) (string, bool) {
+	switch {
+	case ck.UniqueAttributeValue != nil:
+		return uavBucket(*ck.UniqueAttributeValue), true
+	case ck.Method != nil && *ck.Method == sdp.QueryMethod_LIST:
+		return listBucket, true
+	case ck.Method != nil && *ck.Method == sdp.QueryMethod_SEARCH && ck.Query != nil:
+		return searchBucket(*ck.Query), true
+	default:
+		return "", false
+	}
+}
+
+// walkBucket Calls `fn` for every entry in a bucket
+func walkBucket(dir string, fn func(path string, entry CacheEntry)) error {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || strings.HasPrefix(dirEntry.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, dirEntry.Name())
+
+		entry, err := readDiskCacheEntry(path)
+		if err != nil {
+			// The file may have been purged by another process
+			continue
+		}
+
+		fn(path, entry)
+	}
+
+	return nil
+}
+
+// writeFileAtomic Writes a file by writing to a temporary file in the same
+// directory then renaming it, so that other processes never read partially
+// written files
+func writeFileAtomic(path string, b []byte) error {
+	dir := filepath.Dir(path)
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(b)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// readDiskCacheEntry Reads and decodes a single entry
+func readDiskCacheEntry(path string) (CacheEntry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+
+	var encoded encodedCacheEntry
+	err = json.Unmarshal(b, &encoded)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+
+	return encoded.decode()
+}
@@ -0,0 +1,211 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	"github.com/overmindtech/sdpcache"
+)
+
+func newTestDiskCache(t *testing.T, dir string) *DiskCache {
+	t.Helper()
+
+	cache, err := NewDiskCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cache
+}
+
+func TestDiskCache(t *testing.T) {
+	ctx := context.Background()
+	adapter := TestAdapter{}
+
+	t.Run("store and lookup items", func(t *testing.T) {
+		cache := newTestDiskCache(t, t.TempDir())
+
+		ck := sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_LIST, "scope", "person", "")
+		cache.StoreItem(adapter.NewTestItem("scope", "one"), time.Minute, ck)
+		cache.StoreItem(adapter.NewTestItem("scope", "two"), time.Minute, ck)
+
+		hit, _, items, qErr := cache.Lookup(ctx, "test", sdp.QueryMethod_LIST, "scope", "person", "", false)
+		if !hit {
+			t.Fatal("expected a cache hit")
+		}
+		if qErr != nil {
+			t.Fatalf("expected no error, got %v", qErr)
+		}
+		if len(items) != 2 {
+			t.Errorf("expected 2 items, got %v", len(items))
+		}
+
+		// The LIST results should also satisfy a GET for one of the items
+		hit, _, items, _ = cache.Lookup(ctx, "test", sdp.QueryMethod_GET, "scope", "person", "one", false)
+		if !hit {
+			t.Fatal("expected a cache hit for GET")
+		}
+		if len(items) != 1 || items[0].UniqueAttributeValue() != "one" {
+			t.Errorf("expected item one, got %v", items)
+		}
+
+		hit, _, _, _ = cache.Lookup(ctx, "test", sdp.QueryMethod_LIST, "other", "person", "", false)
+		if hit {
+			t.Error("expected a cache miss for a different scope")
+		}
+
+		hit, _, _, _ = cache.Lookup(ctx, "test", sdp.QueryMethod_LIST, "scope", "person", "", true)
+		if hit {
+			t.Error("expected a cache miss when ignoring the cache")
+		}
+	})
+
+	t.Run("store and lookup errors", func(t *testing.T) {
+		cache := newTestDiskCache(t, t.TempDir())
+
+		ck := sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_GET, "scope", "person", "missing")
+		cache.StoreError(&sdp.QueryError{
+			ErrorType:   sdp.QueryError_NOTFOUND,
+			ErrorString: "not found",
+		}, time.Minute, ck)
+
+		hit, _, _, qErr := cache.Lookup(ctx, "test", sdp.QueryMethod_GET, "scope", "person", "missing", false)
+		if !hit {
+			t.Fatal("expected a cache hit")
+		}
+		if qErr == nil || qErr.GetErrorType() != sdp.QueryError_NOTFOUND {
+			t.Errorf("expected a NOTFOUND error, got %v", qErr)
+		}
+
+		ck = sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_GET, "scope", "person", "broken")
+		cache.StoreError(errors.New("broken"), time.Minute, ck)
+
+		_, _, _, qErr = cache.Lookup(ctx, "test", sdp.QueryMethod_GET, "scope", "person", "broken", false)
+		if qErr == nil || qErr.GetErrorType() != sdp.QueryError_OTHER {
+			t.Errorf("expected an OTHER error, got %v", qErr)
+		}
+	})
+
+	t.Run("results survive a new instance", func(t *testing.T) {
+		dir := t.TempDir()
+
+		ck := sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_GET, "scope", "person", "one")
+		newTestDiskCache(t, dir).StoreItem(adapter.NewTestItem("scope", "one"), time.Minute, ck)
+
+		hit, _, items, _ := newTestDiskCache(t, dir).Lookup(ctx, "test", sdp.QueryMethod_GET, "scope", "person", "one", false)
+		if !hit || len(items) != 1 {
+			t.Errorf("expected a cache hit with 1 item, got hit=%v items=%v", hit, items)
+		}
+	})
+
+	t.Run("expired results are not returned", func(t *testing.T) {
+		cache := newTestDiskCache(t, t.TempDir())
+
+		ck := sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_LIST, "scope", "person", "")
+		cache.StoreItem(adapter.NewTestItem("scope", "one"), -time.Second, ck)
+		cache.StoreItem(adapter.NewTestItem("scope", "two"), time.Minute, ck)
+
+		_, _, items, _ := cache.Lookup(ctx, "test", sdp.QueryMethod_LIST, "scope", "person", "", false)
+		if len(items) != 1 {
+			t.Errorf("expected 1 unexpired item, got %v", len(items))
+		}
+
+		stats := cache.Purge(time.Now())
+		if stats.NumPurged != 1 {
+			t.Errorf("expected 1 item to be purged, got %v", stats.NumPurged)
+		}
+		if stats.NextExpiry == nil {
+			t.Error("expected the next expiry to be set")
+		}
+	})
+
+	t.Run("purger", func(t *testing.T) {
+		cache := newTestDiskCache(t, t.TempDir())
+		cache.MinWaitTime = 10 * time.Millisecond
+
+		ck := sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_GET, "scope", "person", "one")
+		cache.StoreItem(adapter.NewTestItem("scope", "one"), 50*time.Millisecond, ck)
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		err := cache.StartPurger(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = cache.StartPurger(ctx); err == nil {
+			t.Error("expected an error when starting a second purger")
+		}
+
+		time.Sleep(200 * time.Millisecond)
+
+		if stats := cache.Purge(time.Now().Add(time.Hour)); stats.NumPurged != 0 {
+			t.Errorf("expected the purger to have already purged everything, %v remained", stats.NumPurged)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		cache := newTestDiskCache(t, t.TempDir())
+
+		ck := sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_LIST, "scope", "person", "")
+		cache.StoreItem(adapter.NewTestItem("scope", "one"), time.Minute, ck)
+		cache.StoreItem(adapter.NewTestItem("scope", "two"), time.Minute, ck)
+
+		cache.Delete(sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_GET, "scope", "person", "one"))
+
+		_, _, items, _ := cache.Lookup(ctx, "test", sdp.QueryMethod_LIST, "scope", "person", "", false)
+		if len(items) != 1 || items[0].UniqueAttributeValue() != "two" {
+			t.Errorf("expected only item two to remain, got %v", items)
+		}
+	})
+
+	t.Run("lookups only read the files for their query", func(t *testing.T) {
+		dir := t.TempDir()
+		cache := newTestDiskCache(t, dir)
+
+		ck := sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_LIST, "scope", "person", "")
+		cache.StoreItem(adapter.NewTestItem("scope", "one"), time.Minute, ck)
+		cache.StoreItem(adapter.NewTestItem("scope", "two"), time.Minute, ck)
+
+		// Corrupt the LIST results so that reading them would fail
+		sstDir := filepath.Join(dir, string(ck.SST.Hash()))
+		files, err := filepath.Glob(filepath.Join(sstDir, listBucket, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 {
+			t.Fatalf("expected 2 LIST files, got %v", len(files))
+		}
+		for _, file := range files {
+			err = os.WriteFile(file, []byte("corrupt"), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		hit, _, items, _ := cache.Lookup(ctx, "test", sdp.QueryMethod_GET, "scope", "person", "one", false)
+		if !hit || len(items) != 1 {
+			t.Errorf("expected a GET hit from its own files, got hit=%v items=%v", hit, items)
+		}
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		cache := newTestDiskCache(t, t.TempDir())
+
+		ck := sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_GET, "scope", "person", "one")
+		cache.StoreItem(adapter.NewTestItem("scope", "one"), time.Minute, ck)
+
+		cache.Clear()
+
+		hit, _, _, _ := cache.Lookup(ctx, "test", sdp.QueryMethod_GET, "scope", "person", "one", false)
+		if hit {
+			t.Error("expected a cache miss after clearing")
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package discovery
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often to check whether in-flight queries have finished while draining
+const drainPollInterval = 50 * time.Millisecond
+
+// How long to wait for cancelled queries to send their final responses once
+// the drain timeout has been reached
+const drainCancelTimeout = 5 * time.Second
+
+// IsDraining Returns whether the engine is currently draining, in which case
+// new queries will be rejected
+func (e *Engine) IsDraining() bool {
+	return e.draining.Load()
+}
+
+// drain Stops the engine accepting new queries and waits up to `timeout` for
+// in-flight queries to finish. This includes adapter executions that aren't
+// part of a handled query, such as those from `Query()`. Tracked queries that
+// are still running after this are cancelled, which causes them to send a
+// CANCELLED response. Subscriptions for
+// cancellations are kept so that queries can still be cancelled while the
+// engine is draining
+func (e *Engine) drain(timeout time.Duration) error {
+	e.draining.Store(true)
+
+	err := e.unsubscribeQueries()
+	if err != nil {
+		return err
+	}
+
+	if e.waitForInFlightQueries(timeout) {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"timeout":            timeout.String(),
+		"inFlightQueries":    e.inFlightQueries.Load(),
+		"inFlightExecutions": e.inFlightExecutions.Load(),
+	}).Warn("Drain timeout reached, cancelling in-flight queries")
+
+	e.cancelTrackedQueries()
+
+	if !e.waitForInFlightQueries(drainCancelTimeout) {
+		log.WithFields(log.Fields{
+			"inFlightQueries":    e.inFlightQueries.Load(),
+			"inFlightExecutions": e.inFlightExecutions.Load(),
+		}).Error("Queries did not finish after being cancelled")
+	}
+
+	return nil
+}
+
+// unsubscribeQueries Removes all subscriptions that would result in the engine
+// starting new queries, leaving the others in place
+func (e *Engine) unsubscribeQueries() error {
+	e.natsConnectionMutex.Lock()
+	defer e.natsConnectionMutex.Unlock()
+
+	if e.natsConnection == nil || e.natsConnection.Underlying() == nil || e.natsConnection.Status() != nats.CONNECTED {
+		return nil
+	}
+
+	remaining := make([]*nats.Subscription, 0, len(e.subscriptions))
+
+	for _, subscription := range e.subscriptions {
+		if !startsQueries(subscription.Subject) {
+			remaining = append(remaining, subscription)
+			continue
+		}
+
+		err := subscription.Unsubscribe()
+		if err != nil {
+			return fmt.Errorf("error unsubscribing from %v: %w", subscription.Subject, err)
+		}
+	}
+
+	e.subscriptions = remaining
+
+	return nil
+}
+
+// startsQueries Returns whether messages on a subject can cause the engine to
+// start a new query. This includes requests and items that could fire triggers
+func startsQueries(subject string) bool {
+	return strings.HasPrefix(subject, "request.") || subject == "query.>"
+}
+
+// waitForInFlightQueries Waits for all in-flight queries and adapter
+// executions to finish, returning false if they are still running after
+// `timeout`
+func (e *Engine) waitForInFlightQueries(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for e.inFlightQueries.Load() > 0 || e.inFlightExecutions.Load() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(drainPollInterval)
+	}
+
+	return true
+}
+
+// cancelTrackedQueries Cancels all queries that are currently being tracked,
+// including those started by triggers
+func (e *Engine) cancelTrackedQueries() {
+	e.trackedQueriesMutex.RLock()
+	defer e.trackedQueriesMutex.RUnlock()
+
+	for _, qt := range e.trackedQueries {
+		if qt.Cancel != nil {
+			qt.Cancel()
+		}
+	}
+
+	for _, triggered := range e.triggeredQueries {
+		for qt := range triggered {
+			if qt.Cancel != nil {
+				qt.Cancel()
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/overmindtech/sdp-go"
+	"github.com/sourcegraph/conc/pool"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// newDrainTestEngine Returns an engine that can execute queries without being
+// connected to NATS
+func newDrainTestEngine(t *testing.T, queryDelay time.Duration) *Engine {
+	t.Helper()
+
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.listExecutionPool = pool.New().WithMaxGoroutines(10)
+	e.getExecutionPool = pool.New().WithMaxGoroutines(10)
+
+	err = e.AddAdapters(&SpeedTestAdapter{QueryDelay: queryDelay})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+// startDrainTestQuery Starts a query in the background and waits for it to be
+// in-flight. The returned channel is closed once the query has finished
+func startDrainTestQuery(t *testing.T, e *Engine, recorder *httptest.ResponseRecorder) chan struct{} {
+	t.Helper()
+
+	u := uuid.New()
+	conn := newHTTPResponseConnection(recorder)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		e.handleQuery(context.Background(), &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "test",
+			UUID:   u[:],
+		}, conn, conn)
+	}()
+
+	for e.inFlightQueries.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	return done
+}
+
+// finalState Returns the state of the last response in the recorded output
+func finalState(t *testing.T, recorder *httptest.ResponseRecorder) sdp.ResponderState {
+	t.Helper()
+
+	var state sdp.ResponderState
+
+	scanner := bufio.NewScanner(bytes.NewReader(recorder.Body.Bytes()))
+	for scanner.Scan() {
+		var response sdp.QueryResponse
+		err := protojson.Unmarshal(scanner.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r := response.GetResponse(); r != nil {
+			state = r.GetState()
+		}
+	}
+
+	return state
+}
+
+func TestDrain(t *testing.T) {
+	t.Run("waits for in-flight queries", func(t *testing.T) {
+		e := newDrainTestEngine(t, 200*time.Millisecond)
+		recorder := httptest.NewRecorder()
+
+		done := startDrainTestQuery(t, e, recorder)
+
+		err := e.drain(10 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-done:
+		default:
+			t.Fatal("expected the query to have finished once drained")
+		}
+
+		if state := finalState(t, recorder); state != sdp.ResponderState_COMPLETE {
+			t.Errorf("expected final state COMPLETE, got %v", state)
+		}
+	})
+
+	t.Run("cancels queries after the timeout", func(t *testing.T) {
+		e := newDrainTestEngine(t, time.Minute)
+		recorder := httptest.NewRecorder()
+
+		done := startDrainTestQuery(t, e, recorder)
+
+		start := time.Now()
+
+		err := e.drain(100 * time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if time.Since(start) > drainCancelTimeout {
+			t.Errorf("expected drain to finish quickly once queries were cancelled, took %v", time.Since(start))
+		}
+
+		<-done
+
+		if state := finalState(t, recorder); state != sdp.ResponderState_CANCELLED {
+			t.Errorf("expected final state CANCELLED, got %v", state)
+		}
+	})
+
+	t.Run("rejects new queries", func(t *testing.T) {
+		e := newDrainTestEngine(t, time.Millisecond)
+		recorder := httptest.NewRecorder()
+
+		err := e.drain(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !e.IsDraining() {
+			t.Fatal("expected engine to be draining")
+		}
+
+		conn := newHTTPResponseConnection(recorder)
+		e.handleQuery(context.Background(), &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "test",
+		}, conn, conn)
+
+		if recorder.Body.Len() != 0 {
+			t.Errorf("expected no responses while draining, got %v", recorder.Body.String())
+		}
+	})
+
+	t.Run("waits for executions that aren't handled queries", func(t *testing.T) {
+		e := newDrainTestEngine(t, 200*time.Millisecond)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for _, err := range e.Query(context.Background(), &sdp.Query{
+				Type:   "person",
+				Method: sdp.QueryMethod_GET,
+				Query:  "Dylan",
+				Scope:  "test",
+			}) {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+
+		for e.inFlightExecutions.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		if n := e.inFlightQueries.Load(); n != 0 {
+			t.Errorf("expected no handled queries, got %v", n)
+		}
+
+		err := e.drain(10 * time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n := e.inFlightExecutions.Load(); n != 0 {
+			t.Errorf("expected executions to have finished once drained, got %v", n)
+		}
+
+		<-done
+	})
+}
+
+func TestStartsQueries(t *testing.T) {
+	tests := map[string]bool{
+		"request.all":     true,
+		"request.scope.>": true,
+		"query.>":         true,
+		"cancel.all":      false,
+		"cancel.scope.>":  false,
+	}
+
+	for subject, expected := range tests {
+		if actual := startsQueries(subject); actual != expected {
+			t.Errorf("expected startsQueries(%q) to be %v, got %v", subject, expected, actual)
+		}
+	}
+}
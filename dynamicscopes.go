@@ -0,0 +1,61 @@
+package discovery
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// watchScopes Handles scope change notifications from an adapter until the
+// context is cancelled or the channel is closed
+func (e *Engine) watchScopes(ctx context.Context, adapter DynamicScopesAdapter) {
+	defer LogRecoverToReturn(ctx, "watchScopes")
+
+	changed := adapter.ScopesChanged()
+	if changed == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-changed:
+			if !ok {
+				return
+			}
+
+			// Collapse a burst of notifications into a single update
+		drain:
+			for {
+				select {
+				case _, ok := <-changed:
+					if !ok {
+						break drain
+					}
+				default:
+					break drain
+				}
+			}
+
+			e.handleScopesChanged(adapter)
+		}
+	}
+}
+
+// handleScopesChanged Updates everything that depends on an adapter's scopes
+// after they have changed
+func (e *Engine) handleScopesChanged(adapter Adapter) {
+	log.WithFields(log.Fields{
+		"ovm.adapter.name":   adapter.Name(),
+		"ovm.adapter.scopes": adapter.Scopes(),
+	}).Info("Adapter scopes changed")
+
+	// Overlapping adapters can't be rejected once they have been added, but
+	// they are reported here and in the heartbeat
+	if err := e.sh.ScopeConflicts(); err != nil {
+		log.WithError(err).WithField("ovm.adapter.name", adapter.Name()).Error("Adapter scopes now overlap with another adapter")
+	}
+
+	e.adaptersChanged()
+}
@@ -0,0 +1,121 @@
+package discovery
+
+import (
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/overmindtech/sdp-go"
+)
+
+// dynamicScopesTestAdapter is a TestAdapter whose scopes can be changed
+type dynamicScopesTestAdapter struct {
+	TestAdapter
+
+	scopes      []string
+	scopesMutex sync.RWMutex
+	changed     chan struct{}
+}
+
+func newDynamicScopesTestAdapter(name string, scopes ...string) *dynamicScopesTestAdapter {
+	return &dynamicScopesTestAdapter{
+		TestAdapter: TestAdapter{ReturnName: name},
+		scopes:      scopes,
+		changed:     make(chan struct{}, 1),
+	}
+}
+
+func (d *dynamicScopesTestAdapter) Scopes() []string {
+	d.scopesMutex.RLock()
+	defer d.scopesMutex.RUnlock()
+
+	return d.scopes
+}
+
+func (d *dynamicScopesTestAdapter) ScopesChanged() <-chan struct{} {
+	return d.changed
+}
+
+func (d *dynamicScopesTestAdapter) SetScopes(scopes ...string) {
+	d.scopesMutex.Lock()
+	d.scopes = scopes
+	d.scopesMutex.Unlock()
+
+	select {
+	case d.changed <- struct{}{}:
+	default:
+	}
+}
+
+func TestDynamicScopes(t *testing.T) {
+	e, nextHeartbeat := newRunningTestEngine(t)
+
+	adapter := newDynamicScopesTestAdapter("dynamic", "first")
+
+	err := e.AddAdapters(adapter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextHeartbeat(t)
+
+	t.Run("new scopes are advertised", func(t *testing.T) {
+		adapter.SetScopes("first", "second")
+
+		heartbeat := nextHeartbeat(t)
+
+		if !slices.Contains(heartbeat.GetAvailableScopes(), "second") {
+			t.Errorf("expected heartbeat to include the new scope, got %v", heartbeat.GetAvailableScopes())
+		}
+
+		if heartbeat.GetError() != "" {
+			t.Errorf("expected no error, got %v", heartbeat.GetError())
+		}
+
+		expanded := e.sh.ExpandQuery(&sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "second",
+		})
+
+		if len(expanded) != 1 {
+			t.Errorf("expected query for the new scope to expand to 1 query, got %v", len(expanded))
+		}
+	})
+
+	t.Run("overlapping scopes are reported", func(t *testing.T) {
+		err := e.AddAdapters(&TestAdapter{
+			ReturnName:   "static",
+			ReturnScopes: []string{"third"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nextHeartbeat(t)
+
+		adapter.SetScopes("first", "third")
+
+		heartbeat := nextHeartbeat(t)
+
+		if heartbeat.GetError() == "" {
+			t.Error("expected heartbeat to report overlapping scopes")
+		}
+
+		if e.sh.ScopeConflicts() == nil {
+			t.Error("expected scope conflicts")
+		}
+	})
+
+	t.Run("removed adapters are not watched", func(t *testing.T) {
+		e.RemoveAdapters(adapter)
+		nextHeartbeat(t)
+
+		e.adapterJobsMutex.Lock()
+		_, watching := e.adapterJobCancels[adapter.Name()]
+		e.adapterJobsMutex.Unlock()
+
+		if watching {
+			t.Error("expected the scope watcher to be stopped")
+		}
+	})
+}
@@ -4,12 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"connectrpc.com/connect"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
+	"github.com/overmindtech/discovery/tracing"
 	"github.com/overmindtech/sdp-go"
 	"github.com/overmindtech/sdp-go/auth"
 	log "github.com/sirupsen/logrus"
@@ -72,6 +75,69 @@ type EngineConfig struct {
 	// ones you're running locally
 	OvermindManagedSource sdp.SourceManaged
 	MaxParallelExecutions int // 2_000, Max number of requests to run in parallel
+
+	// The address that the HTTP query server should listen on e.g.
+	// "localhost:8089". This allows queries to be sent to the engine directly
+	// without NATS. The server has no authentication and bypasses NATS auth,
+	// so `Start()` fails unless the host is "localhost" or a loopback IP. If
+	// this is blank the server won't be started
+	QueryServerAddress string
+
+	// The address that metrics should be served on for scraping by Prometheus
+	// e.g. ":9090". Metrics are served at `/metrics`. This requires
+	// `tracing.InitMeter()` to have been called with Prometheus enabled,
+	// otherwise `Start()` will fail. If this is blank the server won't be
+	// started
+	MetricsServerAddress string
+
+	// The address that the health server should listen on e.g. ":8080". This
+	// serves `/healthz` and `/readyz` endpoints for use as liveness and
+	// readiness probes. If this is blank the server won't be started
+	HealthServerAddress string
+
+	// How long `Stop()` waits for in-flight queries to finish once the engine
+	// has stopped accepting new ones. Queries that are still running after
+	// this are cancelled. If this is zero, in-flight queries are cancelled
+	// immediately
+	DrainTimeout time.Duration
+
+	// The policy used to retry queries that fail with transient errors. Adapters
+	// can override this by implementing `RetryingAdapter`. If this is nil
+	// queries are not retried
+	RetryPolicy *RetryPolicy
+
+	// The number of items and errors that adapters can send to their
+	// `QueryResultStream` before sending blocks. Defaults to zero
+	StreamBufferSize int
+
+	// The maximum number of items that a single adapter execution can return.
+	// Once reached, further items are rejected and the results are marked as
+	// truncated. Zero means unlimited
+	StreamItemLimit int
+
+	// The maximum total size in bytes of the items that a single adapter
+	// execution can return. Zero means unlimited
+	StreamByteLimit int
+
+	// The file that the caches of adapters that implement `SnapshotCache` are
+	// saved to when the engine is stopped, and restored from when it is
+	// started, so that restarts don't begin with empty caches. Results keep
+	// their original expiry. If this is blank caches are not saved
+	CacheSnapshotPath string
+
+	// Options for warming adapter caches by running LIST queries in the
+	// background while the engine is running. If this is nil caches are only
+	// populated by queries from users
+	CacheWarming *CacheWarmingOptions
+
+	// How long after expiring cached results can still be served. When this
+	// is set, queries that don't ignore the cache are answered immediately
+	// with results that expired less than this long ago, and the results are
+	// refreshed in the background. This only applies to adapters whose cache
+	// implements `StaleCache` and retains expired results, such as a
+	// `MemoryCache` with `StaleRetention` set. If this is zero expired results
+	// are never served
+	StaleWhileRevalidate time.Duration
 }
 
 // Engine is the main discovery engine. This is where all of the Adapters and
@@ -92,6 +158,28 @@ type Engine struct {
 	ConnectionWatchInterval time.Duration
 	connectionWatcher       NATSWatcher
 
+	// The number of consecutive failures of an adapter in a given scope after
+	// which queries are short-circuited rather than being sent to the
+	// adapter. Only timeouts and transient errors count as failures. Zero,
+	// the default, disables circuit breaking. `DefaultBreakerThreshold` is a
+	// suggested value
+	BreakerThreshold int
+
+	// How long to short-circuit queries for once a circuit breaker opens,
+	// before allowing a single trial query through. Defaults to
+	// `DefaultBreakerCooldown`
+	BreakerCooldown time.Duration
+
+	// How long to remember the UUIDs of finished queries for, so that
+	// duplicates which arrive late are still ignored. Defaults to
+	// `DefaultDuplicateQueryWindow`
+	DuplicateQueryWindow time.Duration
+
+	// How long the results of adapter health checks are reused for by
+	// `ReadinessCheck()`, so that probes don't call every adapter. Defaults
+	// to `DefaultAdapterHealthCheckInterval`
+	AdapterHealthCheckInterval time.Duration
+
 	// The configuration for the heartbeat for this engine. If this is nil the
 	// engine won't send heartbeats when started
 
@@ -108,6 +196,12 @@ type Engine struct {
 	// blocked by LIST requests, they need to be handled in a different pool to
 	// avoid deadlocking.
 	getExecutionPool *pool.Pool
+	poolsMutex       sync.Mutex
+
+	// The number of executions that are running in each pool, not including
+	// those that are queued waiting for a slot
+	listExecutionsInUse atomic.Int32
+	getExecutionsInUse  atomic.Int32
 
 	// The NATS connection
 	natsConnection      sdp.EncodedConnection
@@ -116,6 +210,9 @@ type Engine struct {
 	// List of all current subscriptions
 	subscriptions []*nats.Subscription
 
+	// Stops scope subscriptions being updated concurrently
+	scopeSubscriptionsMutex sync.Mutex
+
 	// All Adapters managed by this Engine
 	sh *AdapterHost
 
@@ -127,6 +224,18 @@ type Engine struct {
 	trackedQueries      map[uuid.UUID]*QueryTracker
 	trackedQueriesMutex sync.RWMutex
 
+	// Queries started by triggers, keyed by the UUID of the query that found
+	// the triggering item. These share that query's UUID so that results are
+	// sent to whoever started it, so are stored separately from
+	// `trackedQueries` and cancelled along with it. Protected by
+	// `trackedQueriesMutex`
+	triggeredQueries map[uuid.UUID]map[*QueryTracker]struct{}
+
+	// Triggers that should be checked against every item that is seen on the
+	// NATS network
+	triggers      []Trigger
+	triggersMutex sync.RWMutex
+
 	// Prevents the engine being restarted many times in parallel
 	restartMutex sync.Mutex
 
@@ -135,16 +244,87 @@ type Engine struct {
 	backgroundJobContext context.Context
 	backgroundJobCancel  context.CancelFunc
 	heartbeatCancel      context.CancelFunc
+
+	// Waits for the background jobs that write to adapter caches, such as
+	// cache warming, so that the caches aren't saved until they have stopped
+	cacheJobs sync.WaitGroup
+
+	// Cancels the background jobs of each adapter, such as cache purging,
+	// keyed by adapter name so that they can be stopped when adapters are
+	// removed. `adapterJobsContext` is set while the engine is running, and
+	// is what adapters added at runtime have their jobs started with
+	adapterJobCancels  map[string]context.CancelFunc
+	adapterJobsContext context.Context
+	adapterJobsMutex   sync.Mutex
+
+	// The number of executions using each adapter, so that the caches of
+	// removed adapters aren't cleared while queries are still using them
+	adapterUsage adapterUsage
+
+	// The HTTP query server, if enabled
+	queryServer *http.Server
+
+	// The Prometheus metrics server, if enabled
+	metricsServer *http.Server
+
+	// The health server, if enabled. This keeps running when the engine is
+	// stopped so that probes can report on restarts, and is stopped by
+	// `StopHealthServer()`
+	healthServer *http.Server
+
+	// The time that the engine finished starting, or the zero time if it
+	// isn't started, and the error from the last call to `Start()`
+	startedAt      time.Time
+	startErr       error
+	startedAtMutex sync.RWMutex
+
+	// The most recent results of the adapters' health checks
+	adapterHealth adapterHealth
+
+	// The time of the last successful heartbeat
+	lastHeartbeat      time.Time
+	lastHeartbeatMutex sync.Mutex
+
+	// Whether the engine is draining. While draining new queries are rejected
+	draining atomic.Bool
+
+	// The number of queries that are currently being handled, not including
+	// those that were ignored or had no adapters to run against
+	inFlightQueries atomic.Int64
+
+	// The number of adapter executions that are queued or running, from any
+	// source including `Query()` and cache warming
+	inFlightExecutions atomic.Int64
+
+	// Concurrency and rate limits for adapters that implement
+	// `RateLimitedAdapter`
+	throttles adapterThrottles
+
+	// Circuit breakers for each adapter and scope
+	breakers adapterBreakers
+
+	// Shares adapter calls between identical executions
+	coalescer executionCoalescer
+
+	// Stale results that are being refreshed in the background
+	revalidations revalidations
+
+	// The UUIDs of queries that have been handled recently, used to ignore
+	// duplicates
+	seenQueries seenQueries
 }
 
 func NewEngine(engineConfig *EngineConfig) (*Engine, error) {
 	sh := NewAdapterHost()
 	return &Engine{
-		EngineConfig:            engineConfig,
-		MaxRequestTimeout:       DefaultMaxRequestTimeout,
-		ConnectionWatchInterval: DefaultConnectionWatchInterval,
-		sh:                      sh,
-		trackedQueries:          make(map[uuid.UUID]*QueryTracker),
+		EngineConfig:               engineConfig,
+		MaxRequestTimeout:          DefaultMaxRequestTimeout,
+		ConnectionWatchInterval:    DefaultConnectionWatchInterval,
+		BreakerCooldown:            DefaultBreakerCooldown,
+		DuplicateQueryWindow:       DefaultDuplicateQueryWindow,
+		AdapterHealthCheckInterval: DefaultAdapterHealthCheckInterval,
+		sh:                         sh,
+		trackedQueries:             make(map[uuid.UUID]*QueryTracker),
 	}, nil
 }
 
@@ -157,6 +337,22 @@ func (e *Engine) TrackQuery(uuid uuid.UUID, qt *QueryTracker) {
 	e.trackedQueries[uuid] = qt
 }
 
+// trackNewQuery Tracks a query, unless one with the same UUID is already
+// being tracked. Returns whether the query was tracked. This stops queries
+// that share a UUID from replacing the original
+func (e *Engine) trackNewQuery(uuid uuid.UUID, qt *QueryTracker) bool {
+	e.trackedQueriesMutex.Lock()
+	defer e.trackedQueriesMutex.Unlock()
+
+	if _, exists := e.trackedQueries[uuid]; exists {
+		return false
+	}
+
+	e.trackedQueries[uuid] = qt
+
+	return true
+}
+
 // GetTrackedQuery Returns the QueryTracker object for a given UUID. This
 // tracker can then be used to cancel the query
 func (e *Engine) GetTrackedQuery(uuid uuid.UUID) (*QueryTracker, error) {
@@ -177,9 +373,214 @@ func (e *Engine) DeleteTrackedQuery(uuid [16]byte) {
 	delete(e.trackedQueries, uuid)
 }
 
-// AddAdapters Adds an adapter to this engine
+// AddAdapters Adds adapters to this engine. This can be called while the
+// engine is running, in which case background jobs such as cache purgers are
+// started for the new adapters and a heartbeat is sent so that the new scopes
+// and types are visible straight away
 func (e *Engine) AddAdapters(adapters ...Adapter) error {
-	return e.sh.AddAdapters(adapters...)
+	err := e.sh.AddAdapters(adapters...)
+	if err != nil {
+		return err
+	}
+
+	e.adapterJobsMutex.Lock()
+	if e.adapterJobsContext != nil {
+		e.startAdapterJobs(e.adapterJobsContext, adapters...)
+	}
+	e.adapterJobsMutex.Unlock()
+
+	if e.IsStarted() {
+		e.adaptersChanged()
+	}
+
+	return nil
+}
+
+// RemoveAdapters Removes adapters from this engine, matching them by name.
+// This can be called while the engine is running. Queries that have already
+// started against a removed adapter are allowed to finish, but new queries
+// won't be sent to it. The background jobs of removed adapters are stopped and
+// a heartbeat is sent so that the removed scopes and types are no longer
+// advertised. Their caches are cleared once the queries that were already
+// running against them have finished, unless they implement `PersistentCache`
+func (e *Engine) RemoveAdapters(adapters ...Adapter) {
+	removed := e.sh.RemoveAdapters(adapters...)
+
+	e.adapterJobsMutex.Lock()
+	e.stopAdapterJobs(removed...)
+	e.adapterJobsMutex.Unlock()
+
+	for _, adapter := range removed {
+		e.throttles.Remove(adapter.Name())
+		e.breakers.Remove(adapter.Name())
+
+		if cache := adapterCache(adapter); cache != nil && !isPersistentCache(cache) {
+			e.adapterUsage.whenIdle(adapter.Name(), cache.Clear)
+		}
+	}
+
+	if len(removed) > 0 && e.IsStarted() {
+		e.adaptersChanged()
+	}
+}
+
+// startAllAdapterJobs Starts the background jobs for all adapters and sets
+// `adapterJobsContext`, so that adapters added from now on have their jobs
+// started by `AddAdapters()`. Both happen under the same lock so that an
+// adapter added while this is running can't be missed
+func (e *Engine) startAllAdapterJobs(ctx context.Context) {
+	e.adapterJobsMutex.Lock()
+	defer e.adapterJobsMutex.Unlock()
+
+	e.adapterJobsContext = ctx
+	e.startAdapterJobs(ctx, e.sh.Adapters()...)
+}
+
+// stopAllAdapterJobs Stops the background jobs for all adapters and clears
+// `adapterJobsContext` so that no more are started
+func (e *Engine) stopAllAdapterJobs() {
+	e.adapterJobsMutex.Lock()
+	defer e.adapterJobsMutex.Unlock()
+
+	e.adapterJobsContext = nil
+
+	for name, cancel := range e.adapterJobCancels {
+		cancel()
+		delete(e.adapterJobCancels, name)
+	}
+}
+
+// startAdapterJobs Starts the background jobs for adapters: cache purgers for
+// caching adapters, and scope watchers for adapters with dynamic scopes. Each
+// adapter's jobs have their own context so that they can be stopped if the
+// adapter is removed. `adapterJobsMutex` must be held by the caller
+func (e *Engine) startAdapterJobs(ctx context.Context, adapters ...Adapter) {
+	if e.adapterJobCancels == nil {
+		e.adapterJobCancels = make(map[string]context.CancelFunc)
+	}
+
+	for _, adapter := range adapters {
+		cache := adapterCache(adapter)
+		dynamic, isDynamic := adapter.(DynamicScopesAdapter)
+
+		if cache == nil && !isDynamic {
+			continue
+		}
+
+		// Stop any jobs that are left over from a previous start
+		if cancel, ok := e.adapterJobCancels[adapter.Name()]; ok {
+			cancel()
+		}
+
+		jobContext, cancel := context.WithCancel(ctx)
+		e.adapterJobCancels[adapter.Name()] = cancel
+
+		if cache != nil {
+			startPurger(jobContext, adapter, cache)
+		}
+
+		if isDynamic {
+			go e.watchScopes(jobContext, dynamic)
+		}
+	}
+}
+
+// stopAdapterJobs Stops the background jobs for the given adapters.
+// `adapterJobsMutex` must be held by the caller
+func (e *Engine) stopAdapterJobs(adapters ...Adapter) {
+	for _, adapter := range adapters {
+		if cancel, ok := e.adapterJobCancels[adapter.Name()]; ok {
+			cancel()
+			delete(e.adapterJobCancels, adapter.Name())
+		}
+	}
+}
+
+// adapterUsage Counts the executions that are using each adapter, keyed by
+// adapter name, so that work can be put off until an adapter is no longer in
+// use
+type adapterUsage struct {
+	counts map[string]int
+	idle   map[string][]func()
+	mutex  sync.Mutex
+}
+
+// acquire Marks an adapter as being used by an execution
+func (u *adapterUsage) acquire(name string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.counts == nil {
+		u.counts = make(map[string]int)
+	}
+
+	u.counts[name]++
+}
+
+// release Marks an execution as no longer using an adapter. If nothing else is
+// using it, the functions passed to `whenIdle()` are called
+func (u *adapterUsage) release(name string) {
+	u.mutex.Lock()
+
+	u.counts[name]--
+
+	var idle []func()
+	if u.counts[name] <= 0 {
+		delete(u.counts, name)
+		idle = u.idle[name]
+		delete(u.idle, name)
+	}
+
+	u.mutex.Unlock()
+
+	for _, f := range idle {
+		f()
+	}
+}
+
+// whenIdle Calls `f` once no executions are using the adapter, which is
+// straight away if it isn't in use
+func (u *adapterUsage) whenIdle(name string, f func()) {
+	u.mutex.Lock()
+
+	if u.counts[name] > 0 {
+		if u.idle == nil {
+			u.idle = make(map[string][]func())
+		}
+
+		u.idle[name] = append(u.idle[name], f)
+		u.mutex.Unlock()
+
+		return
+	}
+
+	u.mutex.Unlock()
+
+	f()
+}
+
+// adaptersChanged Updates everything that depends on the available adapters
+// and their scopes. The scope subscriptions are updated, and a heartbeat is
+// sent in the background so that changes are reported without waiting for the
+// next scheduled heartbeat
+func (e *Engine) adaptersChanged() {
+	err := e.updateScopeSubscriptions()
+	if err != nil {
+		log.WithError(err).Error("Failed to update scope subscriptions after adapters changed")
+	}
+
+	if e.EngineConfig.HeartbeatOptions == nil || e.EngineConfig.HeartbeatOptions.HealthCheck == nil {
+		return
+	}
+
+	ctx := e.backgroundJobContext
+
+	go func() {
+		err := e.SendHeartbeat(ctx)
+		if err != nil {
+			log.WithError(err).Error("Failed to send heartbeat after adapters changed")
+		}
+	}()
 }
 
 // Connect Connects to NATS
@@ -236,18 +637,22 @@ func (e *Engine) connect() error {
 			return fmt.Errorf("error subscribing to cancel.all: %w", err)
 		}
 
-		err = e.subscribe("request.scope.>", sdp.NewAsyncRawQueryHandler("WildcardQueryHandler", func(ctx context.Context, m *nats.Msg, i *sdp.Query) {
-			e.HandleQuery(ctx, i)
-		}))
+		err = e.updateScopeSubscriptions()
 		if err != nil {
-			return fmt.Errorf("error subscribing to request.scope.>: %w", err)
+			return err
 		}
 
-		err = e.subscribe("cancel.scope.>", sdp.NewAsyncRawCancelQueryHandler("WildcardCancelQueryHandler", func(ctx context.Context, m *nats.Msg, i *sdp.CancelQuery) {
-			e.HandleCancelQuery(ctx, i)
-		}))
-		if err != nil {
-			return fmt.Errorf("error subscribing to cancel.scope.>: %w", err)
+		// Only listen for items if there are triggers that could fire,
+		// otherwise we'd be processing every item on the network for nothing
+		if e.hasTriggers() {
+			err = e.subscribe("query.>", sdp.NewQueryResponseHandler("TriggerHandler", func(ctx context.Context, i *sdp.QueryResponse) {
+				if item := i.GetNewItem(); item != nil {
+					e.ProcessTriggers(ctx, item)
+				}
+			}))
+			if err != nil {
+				return fmt.Errorf("error subscribing to query.>: %w", err)
+			}
 		}
 
 		return nil
@@ -299,12 +704,43 @@ func (e *Engine) disconnect() error {
 }
 
 // Start performs all of the initialisation steps required for the engine to
-// work. Note that this creates NATS subscriptions for all available adapters so
-// modifying the Adapters value after an engine has been started will not have
-// any effect until the engine is restarted
+// work. Adapters can be added and removed after the engine has been started
+// using `AddAdapters()` and `RemoveAdapters()`. If starting fails, the error
+// is reported by `LivenessCheck()` until the engine is started successfully
 func (e *Engine) Start() error {
-	e.listExecutionPool = pool.New().WithMaxGoroutines(e.EngineConfig.MaxParallelExecutions)
-	e.getExecutionPool = pool.New().WithMaxGoroutines(e.EngineConfig.MaxParallelExecutions)
+	err := e.start()
+
+	e.startedAtMutex.Lock()
+	e.startErr = err
+	e.startedAtMutex.Unlock()
+
+	return err
+}
+
+// start Does the work of `Start()`. If this fails, everything that it had
+// started is stopped again
+func (e *Engine) start() (err error) {
+	e.resetPools()
+
+	defer func() {
+		if err != nil {
+			e.abortStart()
+		}
+	}()
+
+	// The health server is started first so that probes report that the
+	// engine isn't ready yet rather than failing to connect, and so that
+	// liveness can report if a later step fails. It is kept running across
+	// restarts
+	if e.EngineConfig.HealthServerAddress != "" && e.healthServer == nil {
+		server, err := startHTTPServer(e.EngineConfig.HealthServerAddress, e.HealthHandler())
+		if err != nil {
+			return fmt.Errorf("error starting health server: %w", err)
+		}
+		e.healthServer = server
+
+		log.WithField("address", e.EngineConfig.HealthServerAddress).Info("Health server started")
+	}
 
 	e.backgroundJobContext, e.backgroundJobCancel = context.WithCancel(context.Background())
 
@@ -313,16 +749,100 @@ func (e *Engine) Start() error {
 		e.EngineConfig.SourceUUID = uuid.New()
 	}
 
+	// Register the built-in meta adapters unless they are already there, which
+	// will be the case if the engine has been restarted
+	for _, adapter := range newMetaAdapters(e.sh) {
+		if len(e.sh.AdaptersByType(adapter.Type())) > 0 {
+			continue
+		}
+
+		if err := e.sh.AddAdapters(adapter); err != nil {
+			return fmt.Errorf("error adding meta adapter %v: %w", adapter.Name(), err)
+		}
+	}
+
+	if e.EngineConfig.CacheSnapshotPath != "" {
+		err := e.restoreCacheSnapshot(e.EngineConfig.CacheSnapshotPath)
+		if err != nil {
+			log.WithError(err).Error("Failed to restore cache snapshot, starting with empty caches")
+		}
+	}
+
 	// Start background jobs
-	e.sh.StartPurger(e.backgroundJobContext)
+	e.startAllAdapterJobs(e.backgroundJobContext)
 	e.StartSendingHeartbeats(e.backgroundJobContext)
 
-	return e.connect()
+	if e.EngineConfig.CacheWarming != nil {
+		// The context and options are copied here since the engine's fields
+		// can change after this returns, e.g. if it is restarted
+		ctx := e.backgroundJobContext
+		options := *e.EngineConfig.CacheWarming
+
+		e.cacheJobs.Add(1)
+		go func() {
+			defer e.cacheJobs.Done()
+			e.runCacheWarmer(ctx, options)
+		}()
+	}
+
+	if e.EngineConfig.QueryServerAddress != "" {
+		if err := checkLoopbackAddress(e.EngineConfig.QueryServerAddress); err != nil {
+			return fmt.Errorf("error starting query server: %w", err)
+		}
+
+		server, err := startHTTPServer(e.EngineConfig.QueryServerAddress, e.QueryHandler())
+		if err != nil {
+			return fmt.Errorf("error starting query server: %w", err)
+		}
+		e.queryServer = server
+
+		log.WithField("address", e.EngineConfig.QueryServerAddress).Info("Query server started")
+	}
+
+	if e.EngineConfig.MetricsServerAddress != "" {
+		if !tracing.PrometheusEnabled() {
+			return errors.New("error starting metrics server: tracing.InitMeter() must be called with Prometheus enabled first")
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", tracing.PrometheusHandler())
+
+		server, err := startHTTPServer(e.EngineConfig.MetricsServerAddress, mux)
+		if err != nil {
+			return fmt.Errorf("error starting metrics server: %w", err)
+		}
+		e.metricsServer = server
+
+		log.WithField("address", e.EngineConfig.MetricsServerAddress).Info("Metrics server started")
+	}
+
+	err = e.connect()
+	if err != nil {
+		return err
+	}
+
+	e.startedAtMutex.Lock()
+	e.startedAt = time.Now()
+	e.startedAtMutex.Unlock()
+
+	return nil
 }
 
 // subscribe Subscribes to a subject using the current NATS connection.
 // Remember to use sdp.NewMsgHandler to get a nats.MsgHandler with otel propagation and protobuf marshaling
 func (e *Engine) subscribe(subject string, handler nats.MsgHandler) error {
+	return e.queueSubscribe(subject, e.EngineConfig.NATSQueueName, handler)
+}
+
+// subscribeAll Subscribes to a subject without using the queue group, so that
+// every replica of the source receives every message
+func (e *Engine) subscribeAll(subject string, handler nats.MsgHandler) error {
+	return e.queueSubscribe(subject, "", handler)
+}
+
+// queueSubscribe Subscribes to a subject as part of the given queue group, or
+// without a queue group if it is blank
+func (e *Engine) queueSubscribe(subject string, queueName string, handler nats.MsgHandler) error {
 	var subscription *nats.Subscription
 	var err error
 
@@ -334,15 +854,15 @@ func (e *Engine) subscribe(subject string, handler nats.MsgHandler) error {
 	}
 
 	log.WithFields(log.Fields{
-		"queueName":  e.EngineConfig.NATSQueueName,
+		"queueName":  queueName,
 		"subject":    subject,
 		"engineName": e.EngineConfig.SourceName,
 	}).Debug("creating NATS subscription")
 
-	if e.EngineConfig.NATSQueueName == "" {
+	if queueName == "" {
 		subscription, err = e.natsConnection.Subscribe(subject, handler)
 	} else {
-		subscription, err = e.natsConnection.QueueSubscribe(subject, e.EngineConfig.NATSQueueName, handler)
+		subscription, err = e.natsConnection.QueueSubscribe(subject, queueName, handler)
 	}
 	if err != nil {
 		return fmt.Errorf("error subscribing to NATS: %w", err)
@@ -355,12 +875,68 @@ func (e *Engine) subscribe(subject string, handler nats.MsgHandler) error {
 
 // Stop Stops the engine running and disconnects from NATS
 func (e *Engine) Stop() error {
-	err := e.disconnect()
+	e.startedAtMutex.Lock()
+	e.startedAt = time.Time{}
+	e.startedAtMutex.Unlock()
+
+	err := e.drain(e.EngineConfig.DrainTimeout)
+	if err != nil {
+		return fmt.Errorf("error draining engine: %w", err)
+	}
+
+	err = e.disconnect()
 	if err != nil {
 		return err
 	}
 
-	// Stop purging and clear the cache
+	err = e.stopServers()
+	if err != nil {
+		return err
+	}
+
+	// Stop the background jobs and wait for those that write to the caches,
+	// so that the snapshot contains everything they found
+	e.stopBackgroundJobs()
+
+	// Save the caches now that nothing else is writing to them, then clear
+	// those that aren't persistent
+	if e.EngineConfig.CacheSnapshotPath != "" {
+		err = e.saveCacheSnapshot(e.EngineConfig.CacheSnapshotPath)
+		if err != nil {
+			log.WithError(err).Error("Failed to save cache snapshot")
+		}
+	}
+
+	e.sh.clearTransientCaches()
+
+	e.draining.Store(false)
+
+	return nil
+}
+
+// stopServers Stops the query and metrics servers, if they are running. The
+// health server is left running
+func (e *Engine) stopServers() error {
+	err := stopHTTPServer(e.queryServer)
+	if err != nil {
+		return fmt.Errorf("error stopping query server: %w", err)
+	}
+	e.queryServer = nil
+
+	err = stopHTTPServer(e.metricsServer)
+	if err != nil {
+		return fmt.Errorf("error stopping metrics server: %w", err)
+	}
+	e.metricsServer = nil
+
+	return nil
+}
+
+// stopBackgroundJobs Stops the background jobs, such as cache purgers,
+// heartbeats and cache warming, and waits for those that write to the caches
+// to finish
+func (e *Engine) stopBackgroundJobs() {
+	e.stopAllAdapterJobs()
 	if e.backgroundJobCancel != nil {
 		e.backgroundJobCancel()
 	}
@@ -368,7 +944,38 @@ func (e *Engine) Stop() error {
 		e.heartbeatCancel()
 	}
 
-	e.sh.ClearCaches()
+	e.revalidations.cancelAll()
+	if !e.revalidations.wait(drainCancelTimeout) {
+		log.Error("Cache revalidations did not finish after being cancelled")
+	}
+	e.cacheJobs.Wait()
+}
+
+// abortStart Undoes the parts of `start()` that had completed before it
+// failed, so that a failed start doesn't leave servers listening or background
+// jobs running. The health server is kept so that liveness can report the
+// failure
+func (e *Engine) abortStart() {
+	if err := e.disconnect(); err != nil {
+		log.WithError(err).Error("Failed to disconnect after engine failed to start")
+	}
+
+	if err := e.stopServers(); err != nil {
+		log.WithError(err).Error("Failed to stop servers after engine failed to start")
+	}
+
+	e.stopBackgroundJobs()
+}
+
+// StopHealthServer Stops the health server. This isn't stopped by `Stop()` so
+// that probes keep working while the engine is restarted, so should be called
+// once the engine is no longer needed
+func (e *Engine) StopHealthServer() error {
+	err := stopHTTPServer(e.healthServer)
+	if err != nil {
+		return fmt.Errorf("error stopping health server: %w", err)
+	}
+	e.healthServer = nil
 
 	return nil
 }
@@ -416,6 +1023,7 @@ func (e *Engine) HealthCheck(ctx context.Context) error {
 		attribute.Bool("ovm.nats.connected", natsConnected),
 		attribute.Int("ovm.discovery.listExecutionPoolCount", int(listExecutionPoolCount.Load())),
 		attribute.Int("ovm.discovery.getExecutionPoolCount", int(getExecutionPoolCount.Load())),
+		attribute.Int("ovm.discovery.openCircuitBreakers", len(e.breakers.Open())),
 	)
 
 	if !natsConnected {
@@ -436,6 +1044,10 @@ func (e *Engine) HandleCancelQuery(ctx context.Context, cancelQuery *sdp.CancelQ
 		return
 	}
 
+	// Queries started by triggers send their results to the same place, so
+	// are cancelled too
+	e.cancelTriggeredQueries(u)
+
 	rt, err := e.GetTrackedQuery(u)
 	if err != nil {
 		log.Debugf("Could not find tracked query %v. Possibly it has already finished", u.String())
@@ -450,14 +1062,16 @@ func (e *Engine) HandleCancelQuery(ctx context.Context, cancelQuery *sdp.CancelQ
 	}
 }
 
-// ClearCache Completely clears the cache
+// ClearCache Completely clears the cache. Use `InvalidateCache()` to evict
+// specific results
 func (e *Engine) ClearCache() {
 	e.sh.ClearCaches()
 }
 
-// ClearAdapters Deletes all adapters from the engine, allowing new adapters to be
-// added using `AddAdapter()`. Note that this requires a restart using
-// `Restart()` in order to take effect
+// ClearAdapters Deletes all adapters from the engine, including the built-in
+// meta adapters, allowing new adapters to be added using `AddAdapters()`. Note
+// that this requires a restart using `Restart()` in order to take effect. Use
+// `RemoveAdapters()` to remove adapters from a running engine
 func (e *Engine) ClearAdapters() {
 	e.sh.ClearAllAdapters()
 }
@@ -4,11 +4,13 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"slices"
 	"sync"
 	"testing"
 
 	"time"
 
+	"connectrpc.com/connect"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats-server/v2/test"
@@ -752,3 +754,300 @@ func GetTestOAuthTokenClient(t *testing.T, account string) auth.TokenClient {
 		testTokenSource,
 	)
 }
+
+// newRunningTestEngine Returns an engine that behaves as if it has been
+// started, without connecting to NATS, and a function that returns the next
+// heartbeat that it sends
+func newRunningTestEngine(t *testing.T) (*Engine, func(t *testing.T) *sdp.SubmitSourceHeartbeatRequest) {
+	t.Helper()
+
+	requests := make(chan *connect.Request[sdp.SubmitSourceHeartbeatRequest], 10)
+	responses := make(chan *connect.Response[sdp.SubmitSourceHeartbeatResponse], 10)
+
+	e, err := NewEngine(&EngineConfig{
+		MaxParallelExecutions: 10,
+		HeartbeatOptions: &HeartbeatOptions{
+			ManagementClient: testHeartbeatClient{
+				Requests:  requests,
+				Responses: responses,
+			},
+			HealthCheck: func() error { return nil },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.backgroundJobContext, e.backgroundJobCancel = context.WithCancel(context.Background())
+	t.Cleanup(e.backgroundJobCancel)
+	e.startAllAdapterJobs(e.backgroundJobContext)
+	e.startedAt = time.Now()
+
+	nextHeartbeat := func(t *testing.T) *sdp.SubmitSourceHeartbeatRequest {
+		t.Helper()
+
+		responses <- &connect.Response[sdp.SubmitSourceHeartbeatResponse]{
+			Msg: &sdp.SubmitSourceHeartbeatResponse{},
+		}
+
+		select {
+		case req := <-requests:
+			return req.Msg
+		case <-time.After(time.Second):
+			t.Fatal("expected a heartbeat to be sent")
+			return nil
+		}
+	}
+
+	return e, nextHeartbeat
+}
+
+func TestHotAddRemoveAdapters(t *testing.T) {
+	e, nextHeartbeat := newRunningTestEngine(t)
+
+	query := &sdp.Query{
+		Type:   "person",
+		Method: sdp.QueryMethod_GET,
+		Query:  "Dylan",
+		Scope:  "hot",
+	}
+
+	adapter := TestAdapter{
+		ReturnScopes: []string{"hot"},
+		ReturnName:   "hot",
+	}
+
+	t.Run("adding", func(t *testing.T) {
+		err := e.AddAdapters(&adapter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if scopes := nextHeartbeat(t).GetAvailableScopes(); !slices.Contains(scopes, "hot") {
+			t.Errorf("expected heartbeat to include the new scope, got %v", scopes)
+		}
+
+		e.adapterJobsMutex.Lock()
+		_, purging := e.adapterJobCancels[adapter.Name()]
+		e.adapterJobsMutex.Unlock()
+
+		if !purging {
+			t.Error("expected a purger to be started for the new adapter")
+		}
+
+		for item, err := range e.Query(context.Background(), query) {
+			if err != nil || item == nil {
+				t.Errorf("expected an item, got error %v", err)
+			}
+		}
+	})
+
+	t.Run("removing", func(t *testing.T) {
+		e.RemoveAdapters(&adapter)
+
+		if scopes := nextHeartbeat(t).GetAvailableScopes(); slices.Contains(scopes, "hot") {
+			t.Errorf("expected heartbeat not to include the removed scope, got %v", scopes)
+		}
+
+		e.adapterJobsMutex.Lock()
+		_, purging := e.adapterJobCancels[adapter.Name()]
+		e.adapterJobsMutex.Unlock()
+
+		if purging {
+			t.Error("expected the purger to be stopped for the removed adapter")
+		}
+
+		for _, err := range e.Query(context.Background(), query) {
+			if err.GetErrorType() != sdp.QueryError_NOSCOPE {
+				t.Errorf("expected NOSCOPE error, got %v", err)
+			}
+		}
+	})
+
+	t.Run("removing during a query", func(t *testing.T) {
+		slow := SpeedTestAdapter{QueryDelay: 100 * time.Millisecond}
+
+		err := e.AddAdapters(&slow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nextHeartbeat(t)
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			e.RemoveAdapters(&slow)
+		}()
+
+		var numItems int
+		for item, err := range e.Query(context.Background(), &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "test",
+		}) {
+			if err != nil {
+				t.Error(err)
+			}
+			if item != nil {
+				numItems++
+			}
+		}
+
+		if numItems != 1 {
+			t.Errorf("expected the in-flight query to finish, got %v items", numItems)
+		}
+		nextHeartbeat(t)
+	})
+}
+
+func TestAdapterJobs(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hasJobs := func(adapter Adapter) bool {
+		e.adapterJobsMutex.Lock()
+		defer e.adapterJobsMutex.Unlock()
+
+		_, ok := e.adapterJobCancels[adapter.Name()]
+		return ok
+	}
+
+	before := &TestAdapter{ReturnName: "before"}
+	err = e.AddAdapters(before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasJobs(before) {
+		t.Error("expected jobs not to be started before the engine is running")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e.startAllAdapterJobs(ctx)
+
+	if !hasJobs(before) {
+		t.Error("expected jobs to be started for existing adapters")
+	}
+
+	// Adapters added as soon as jobs have started get jobs too, without
+	// waiting for the engine to be marked as started
+	after := &TestAdapter{ReturnName: "after"}
+	err = e.AddAdapters(after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasJobs(after) {
+		t.Error("expected jobs to be started for an adapter added while running")
+	}
+
+	e.stopAllAdapterJobs()
+
+	stopped := &TestAdapter{ReturnName: "stopped"}
+	err = e.AddAdapters(stopped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasJobs(before) || hasJobs(after) || hasJobs(stopped) {
+		t.Error("expected no jobs once stopped")
+	}
+}
+
+func TestRemoveAdaptersInUse(t *testing.T) {
+	ctx := context.Background()
+
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := &TestAdapter{ReturnName: "busy", CacheDuration: time.Minute}
+	err = e.AddAdapters(adapter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := adapter.Get(ctx, "test", "one", false); err != nil {
+		t.Fatal(err)
+	}
+	adapter.resetCalls()
+
+	// Simulates a query that is still running against the adapter
+	e.adapterUsage.acquire(adapter.Name())
+
+	e.RemoveAdapters(adapter)
+
+	if _, err := adapter.Get(ctx, "test", "one", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(adapter.GetCalls) != 0 {
+		t.Errorf("expected the cache to be kept while the adapter is in use, got %v GET calls", len(adapter.GetCalls))
+	}
+
+	e.adapterUsage.release(adapter.Name())
+
+	if _, err := adapter.Get(ctx, "test", "one", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(adapter.GetCalls) != 1 {
+		t.Errorf("expected the cache to be cleared once the adapter is idle, got %v GET calls", len(adapter.GetCalls))
+	}
+}
+
+func TestStartFailureStopsEverything(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{
+		QueryServerAddress:   "127.0.0.1:0",
+		MetricsServerAddress: "not a valid address",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := &TestAdapter{ReturnName: "start-failure"}
+	err = e.AddAdapters(adapter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.Start()
+	if err == nil {
+		t.Fatal("expected Start to fail")
+	}
+
+	if e.queryServer != nil {
+		t.Error("expected the query server to be stopped")
+	}
+
+	if e.backgroundJobContext.Err() == nil {
+		t.Error("expected background jobs to be cancelled")
+	}
+
+	e.adapterJobsMutex.Lock()
+	numJobs := len(e.adapterJobCancels)
+	e.adapterJobsMutex.Unlock()
+
+	if numJobs != 0 {
+		t.Errorf("expected adapter jobs to be stopped, got %v", numJobs)
+	}
+}
+
+func TestMetricsServerRequiresPrometheus(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{
+		MetricsServerAddress: "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing in these tests enables Prometheus, so there would be nothing to
+	// serve
+	err = e.Start()
+	if err == nil {
+		t.Fatal("expected Start to fail")
+	}
+
+	if e.metricsServer != nil {
+		t.Error("expected the metrics server not to be started")
+	}
+}
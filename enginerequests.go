@@ -14,6 +14,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/sourcegraph/conc/pool"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
@@ -31,8 +32,67 @@ func NewResponseSubject() string {
 }
 
 // HandleQuery Handles a single query. This includes responses, linking
-// etc.
+// etc. Since the engine subscribes to both `request.all` and
+// `request.scope.>`, the same query can arrive more than once. Queries with a
+// UUID that is already being handled, or was handled within
+// `DuplicateQueryWindow`, are ignored
 func (e *Engine) HandleQuery(ctx context.Context, query *sdp.Query) {
+	if u, err := uuid.FromBytes(query.GetUUID()); err == nil {
+		if !e.seenQueries.Claim(u, e.DuplicateQueryWindow) {
+			metrics.duplicateQueries.Add(ctx, 1)
+			log.WithContext(ctx).WithField("ovm.sdp.uuid", u.String()).Debug("Ignoring duplicate query")
+			return
+		}
+		defer e.seenQueries.Release(u)
+	}
+
+	e.handleQuery(ctx, query, e.queryConnection(), nil)
+}
+
+// queryConnection Returns the connection that responses to queries should be
+// sent on
+func (e *Engine) queryConnection() sdp.EncodedConnection {
+	if e.IsNATSConnected() {
+		return e.natsConnection
+	}
+
+	return NilConnection{}
+}
+
+// handleQuery Handles a single query, sending responses to `pub`. Items and
+// errors are sent to `results`, or the engine's NATS connection if this is nil
+func (e *Engine) handleQuery(ctx context.Context, query *sdp.Query, pub sdp.EncodedConnection, results sdp.EncodedConnection) {
+	e.runQuery(ctx, query, pub, results, false)
+}
+
+// runQuery Does the work of `handleQuery()`. If `triggered` is true the query
+// was started by a trigger and shares the UUID of the query that found the
+// triggering item, so it is tracked with `trackTriggeredQuery()` rather than
+// replacing that query in `trackedQueries`
+func (e *Engine) runQuery(ctx context.Context, query *sdp.Query, pub sdp.EncodedConnection, results sdp.EncodedConnection, triggered bool) {
+	if e.IsDraining() {
+		log.WithContext(ctx).WithField("ovm.sdp.type", query.GetType()).Debug("Ignoring query since the engine is draining")
+		return
+	}
+
+	numExpandedQueries := len(e.sh.ExpandQuery(query))
+
+	if numExpandedQueries == 0 {
+		// If we don't have any relevant adapters, exit
+		return
+	}
+
+	// Only queries that will be run are counted. Draining is checked again
+	// once the query is counted, since a drain could have started after the
+	// check above without seeing it
+	e.inFlightQueries.Add(1)
+	defer e.inFlightQueries.Add(-1)
+
+	if e.IsDraining() {
+		log.WithContext(ctx).WithField("ovm.sdp.type", query.GetType()).Debug("Ignoring query since the engine is draining")
+		return
+	}
+
 	var deadlineOverride bool
 
 	// If there is no deadline OR further in the future than MaxRequestTimeout, clamp the deadline to MaxRequestTimeout
@@ -47,13 +107,6 @@ func (e *Engine) HandleQuery(ctx context.Context, query *sdp.Query) {
 	ctx, cancel := query.TimeoutContext(ctx)
 	defer cancel()
 
-	numExpandedQueries := len(e.sh.ExpandQuery(query))
-
-	if numExpandedQueries == 0 {
-		// If we don't have any relevant adapters, exit
-		return
-	}
-
 	// Extract and parse the UUID
 	u, uuidErr := uuid.FromBytes(query.GetUUID())
 
@@ -83,15 +136,7 @@ func (e *Engine) HandleQuery(ctx context.Context, query *sdp.Query) {
 		ResponseSubject: query.Subject(),
 	}
 
-	var pub sdp.EncodedConnection
-
-	if e.IsNATSConnected() {
-		span.SetAttributes(attribute.Bool("ovm.nats.connected", true))
-		pub = e.natsConnection
-	} else {
-		span.SetAttributes(attribute.Bool("ovm.nats.connected", false))
-		pub = NilConnection{}
-	}
+	span.SetAttributes(attribute.Bool("ovm.nats.connected", e.IsNATSConnected()))
 
 	ru := uuid.New()
 	responder.Start(
@@ -102,24 +147,39 @@ func (e *Engine) HandleQuery(ctx context.Context, query *sdp.Query) {
 	)
 
 	qt := QueryTracker{
-		Query:   query,
-		Engine:  e,
-		Context: ctx,
-		Cancel:  cancel,
+		Query:              query,
+		Engine:             e,
+		Context:            ctx,
+		Cancel:             cancel,
+		ResponseConnection: results,
 	}
 
 	if uuidErr == nil {
-		e.TrackQuery(u, &qt)
-		defer e.DeleteTrackedQuery(u)
+		if triggered {
+			e.trackTriggeredQuery(u, &qt)
+			defer e.deleteTriggeredQuery(u, &qt)
+		} else if e.trackNewQuery(u, &qt) {
+			defer e.DeleteTrackedQuery(u)
+		}
 	}
 
-	_, _, err := qt.Execute(ctx)
+	err := qt.Stream(ctx)
+
+	outcome := "complete"
+	defer func() {
+		metrics.queries.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("ovm.sdp.method", query.GetMethod().String()),
+			attribute.String("ovm.discovery.outcome", outcome),
+		))
+	}()
 
 	// If all failed then return an error
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
+			outcome = "cancelled"
 			responder.CancelWithContext(ctx)
 		} else {
+			outcome = "error"
 			responder.ErrorWithContext(ctx)
 		}
 
@@ -157,10 +217,13 @@ func (e *Engine) ExecuteQuery(ctx context.Context, query *sdp.Query, items chan<
 		return ctx.Err()
 	}
 
-	expanded := e.sh.ExpandQuery(query)
+	expanded, decisions := e.sh.expandQuery(query)
 
+	decisionStrings, truncated := expansionDecisionStrings(decisions)
 	span.SetAttributes(
 		attribute.Int("ovm.adapter.numExpandedQueries", len(expanded)),
+		attribute.StringSlice("ovm.adapter.expansionDecisions", decisionStrings),
+		attribute.Int("ovm.adapter.expansionDecisionsTruncated", truncated),
 	)
 
 	if len(expanded) == 0 {
@@ -173,9 +236,20 @@ func (e *Engine) ExecuteQuery(ctx context.Context, query *sdp.Query, items chan<
 		return errors.New("no matching adapters found")
 	}
 
+	// The pools are replaced when the engine starts, so are read under the
+	// lock rather than from the engine for each execution
+	listPool, getPool := e.executionPools()
+
 	// These are used to calculate whether all adapters have failed or not
 	var numAdapters atomic.Int32
 
+	// If different adapters of the same type are queried for the same scope,
+	// they could return the same item. Items from these executions are
+	// buffered so that only the result from the highest weight adapter is
+	// returned. Everything else is streamed straight away
+	competing := competingQueries(expanded)
+	weighted := newWeightedItems()
+
 	// Since we need to wait for only the processing of this query's executions, we need a separate WaitGroup here
 	// Overall MaxParallelExecutions evaluation is handled by e.executionPool
 	wg := sync.WaitGroup{}
@@ -187,14 +261,44 @@ func (e *Engine) ExecuteQuery(ctx context.Context, query *sdp.Query, items chan<
 		localQ, localAdapter := q, adapter
 
 		var p *pool.Pool
+		var poolName string
+		var inUse *atomic.Int32
 		if localQ.GetMethod() == sdp.QueryMethod_LIST {
-			p = e.listExecutionPool
+			p = listPool
+			poolName = "list"
+			inUse = &e.listExecutionsInUse
 			listExecutionPoolCount.Add(1)
 		} else {
-			p = e.getExecutionPool
+			p = getPool
+			poolName = "get"
+			inUse = &e.getExecutionsInUse
 			getExecutionPoolCount.Add(1)
 		}
 
+		// Executions are counted whether or not they are part of a query that
+		// is being handled, such as those from `Query()`, so that draining
+		// waits for them
+		e.inFlightExecutions.Add(1)
+
+		// finish Marks the execution as complete
+		finish := func() {
+			if localQ.GetMethod() == sdp.QueryMethod_LIST {
+				listExecutionPoolCount.Add(-1)
+			} else {
+				getExecutionPoolCount.Add(-1)
+			}
+			e.inFlightExecutions.Add(-1)
+
+			// Delete our query from the map so that we can track which
+			// ones are still running
+			expandedMutex.Lock()
+			defer expandedMutex.Unlock()
+			delete(expanded, localQ)
+
+			// Mark the work as done
+			wg.Done()
+		}
+
 		// push all queued items through a goroutine to avoid blocking `ExecuteQuery` from progressing
 		// as `executionPool.Go()` will block once the max parallelism is hit
 		go func() {
@@ -204,25 +308,34 @@ func (e *Engine) ExecuteQuery(ctx context.Context, query *sdp.Query, items chan<
 				attribute.Int("ovm.discovery.listExecutionPoolCount", int(listExecutionPoolCount.Load())),
 				attribute.Int("ovm.discovery.getExecutionPoolCount", int(getExecutionPoolCount.Load())),
 			)
+
+			// Wait for the adapter's own concurrency limit before taking a
+			// slot in the shared pool, so that an adapter with a backlog of
+			// throttled queries doesn't fill the pool and starve the others
+			execCtx := ctx
+			throttle := e.throttles.Get(localAdapter)
+			if throttle != nil {
+				if err := throttle.AcquireSlot(ctx); err != nil {
+					// This only fails if the context is cancelled, in which
+					// case there is nothing to report
+					finish()
+					return
+				}
+				execCtx = withHeldSlot(ctx, throttle)
+			}
+
+			queuedAt := time.Now()
 			p.Go(func() {
 				defer LogRecoverToReturn(ctx, "ExecuteQuery inner")
-				defer func() {
-					// Delete our query from the map so that we can track which
-					// ones are still running
-					expandedMutex.Lock()
-					defer expandedMutex.Unlock()
-					delete(expanded, localQ)
-
-					// Mark the work as done
-					wg.Done()
-				}()
-				defer func() {
-					if localQ.GetMethod() == sdp.QueryMethod_LIST {
-						listExecutionPoolCount.Add(-1)
-					} else {
-						getExecutionPoolCount.Add(-1)
-					}
-				}()
+				metrics.poolWait.Record(ctx, time.Since(queuedAt).Seconds(), metric.WithAttributes(
+					attribute.String("ovm.discovery.pool", poolName),
+				))
+				defer finish()
+				if throttle != nil {
+					defer throttle.ReleaseSlot()
+				}
+				inUse.Add(1)
+				defer inUse.Add(-1)
 				numAdapters.Add(1)
 
 				// If the context is cancelled, don't even bother doing
@@ -234,7 +347,11 @@ func (e *Engine) ExecuteQuery(ctx context.Context, query *sdp.Query, items chan<
 				}
 
 				// Execute the query against the adapter
-				e.Execute(ctx, localQ, localAdapter, items, errs)
+				if items != nil && competing[localQ] {
+					weighted.Execute(execCtx, e, localQ, localAdapter, errs)
+				} else {
+					e.Execute(execCtx, localQ, localAdapter, items, errs)
+				}
 			})
 		}()
 	}
@@ -280,14 +397,155 @@ func (e *Engine) ExecuteQuery(ctx context.Context, query *sdp.Query, items chan<
 		}()
 	}
 
-	// If the context is cancelled, return that error
+	// If the context is cancelled, return that error. The buffered items are
+	// discarded since nothing may be receiving them any more
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
 
+	// Send the winning items from any adapters that were competing
+	numDiscarded := weighted.Flush(items)
+	if numDiscarded > 0 {
+		span.SetAttributes(
+			attribute.Int("ovm.discovery.numLowerWeightItemsDiscarded", numDiscarded),
+		)
+	}
+
 	return nil
 }
 
+// competingQueries Returns the expanded queries whose items could have the
+// same GloballyUniqueName as items from a different adapter. Since this
+// includes the scope, this is only possible when different adapters of the
+// same type are queried for the same scope, or when an adapter is queried with
+// a wildcard or glob pattern scope, in which case the scopes of its items
+// aren't known in advance
+func competingQueries(expanded map[*sdp.Query]Adapter) map[*sdp.Query]bool {
+	isOpen := func(scope string) bool {
+		return IsWildcard(scope) || isGlobPattern(scope)
+	}
+
+	// The names of the adapters for each type, for each type and scope, and
+	// for each type that are queried with an open scope
+	typeAdapters := make(map[string]map[string]bool)
+	scopeAdapters := make(map[string]map[string]bool)
+	openAdapters := make(map[string]map[string]bool)
+
+	add := func(m map[string]map[string]bool, key string, name string) {
+		if m[key] == nil {
+			m[key] = make(map[string]bool)
+		}
+		m[key][name] = true
+	}
+
+	// othersIn Returns whether the set contains adapters other than `name`
+	othersIn := func(set map[string]bool, name string) bool {
+		return len(set) > 1 || (len(set) == 1 && !set[name])
+	}
+
+	for q, adapter := range expanded {
+		add(typeAdapters, q.GetType(), adapter.Name())
+		add(scopeAdapters, q.GetType()+"\x00"+q.GetScope(), adapter.Name())
+		if isOpen(q.GetScope()) {
+			add(openAdapters, q.GetType(), adapter.Name())
+		}
+	}
+
+	competing := make(map[*sdp.Query]bool)
+	for q, adapter := range expanded {
+		name := adapter.Name()
+
+		if isOpen(q.GetScope()) {
+			competing[q] = othersIn(typeAdapters[q.GetType()], name)
+		} else {
+			competing[q] = othersIn(scopeAdapters[q.GetType()+"\x00"+q.GetScope()], name) || othersIn(openAdapters[q.GetType()], name)
+		}
+	}
+
+	return competing
+}
+
+// weightedItem An item along with the weight of the adapter that found it
+type weightedItem struct {
+	item   *sdp.Item
+	weight int
+}
+
+// weightedItems Collects items from adapters that could return the same
+// items, keeping only the item from the highest weight adapter for each
+// GloballyUniqueName
+type weightedItems struct {
+	items        map[string]weightedItem
+	order        []string
+	numDiscarded int
+	mutex        sync.Mutex
+}
+
+func newWeightedItems() *weightedItems {
+	return &weightedItems{
+		items: make(map[string]weightedItem),
+	}
+}
+
+// Add Adds an item, replacing any existing item with the same
+// GloballyUniqueName if this one has a higher weight. If the weights are equal
+// the item that was found first wins
+func (w *weightedItems) Add(item *sdp.Item, weight int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	gun := item.GloballyUniqueName()
+
+	existing, exists := w.items[gun]
+	if !exists {
+		w.order = append(w.order, gun)
+	} else {
+		w.numDiscarded++
+
+		if existing.weight >= weight {
+			return
+		}
+	}
+
+	w.items[gun] = weightedItem{
+		item:   item,
+		weight: weight,
+	}
+}
+
+// Execute Runs a query against an adapter, collecting the items rather than
+// sending them to the caller
+func (w *weightedItems) Execute(ctx context.Context, e *Engine, q *sdp.Query, adapter Adapter, errs chan<- *sdp.QueryError) {
+	weight := adapterWeight(adapter)
+	adapterItems := make(chan *sdp.Item)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for item := range adapterItems {
+			w.Add(item, weight)
+		}
+	}()
+
+	e.Execute(ctx, q, adapter, adapterItems, errs)
+	close(adapterItems)
+	<-done
+}
+
+// Flush Sends all collected items to the channel in the order they were first
+// found. Returns the number of items that were discarded because a higher (or
+// equal) weight adapter returned the same item
+func (w *weightedItems) Flush(items chan<- *sdp.Item) int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, gun := range w.order {
+		items <- w.items[gun].item
+	}
+
+	return w.numDiscarded
+}
+
 // Runs a query against an adapter. Returns an error if the query fails in a
 // "fatal" way that should consider the query as failed. Other non-fatal errors
 // should be sent on the stream. Channels for items and errors will NOT be
@@ -303,26 +561,10 @@ func (e *Engine) Execute(ctx context.Context, q *sdp.Query, adapter Adapter, ite
 	))
 	defer span.End()
 
-	// We want to avoid having a Get and a List running at the same time, we'd
-	// rather run the List first, populate the cache, then have the Get just
-	// grab the value from the cache. To this end we use a GetListMutex to allow
-	// a List to block all subsequent Get queries until it is done
-	switch q.GetMethod() {
-	case sdp.QueryMethod_GET:
-		e.gfm.GetLock(q.GetScope(), q.GetType())
-		defer e.gfm.GetUnlock(q.GetScope(), q.GetType())
-	case sdp.QueryMethod_LIST:
-		e.gfm.ListLock(q.GetScope(), q.GetType())
-		defer e.gfm.ListUnlock(q.GetScope(), q.GetType())
-	case sdp.QueryMethod_SEARCH:
-		// We don't need to lock for a search since they are independent and
-		// will only ever have a cache hit if the query is identical
-	}
-
-	span.SetAttributes(
-		attribute.String("ovm.adapter.queryType", q.GetType()),
-		attribute.String("ovm.adapter.queryScope", q.GetScope()),
-	)
+	// Stops the adapter's cache being cleared while this is using it, if the
+	// adapter is removed
+	e.adapterUsage.acquire(adapter.Name())
+	defer e.adapterUsage.release(adapter.Name())
 
 	// Ensure that the span is closed when the context is done. This is based on
 	// the assumption that some adapters may not respect the context deadline and
@@ -345,6 +587,16 @@ func (e *Engine) Execute(ctx context.Context, q *sdp.Query, adapter Adapter, ite
 	// are passed back to the caller
 	var numItems atomic.Int32
 	var numErrs atomic.Int32
+
+	start := time.Now()
+	defer func() {
+		metrics.recordExecution(ctx, adapter, q.GetMethod().String(), time.Since(start), int64(numItems.Load()), int64(numErrs.Load()))
+	}()
+
+	// Results that are served stale are timestamped with when they were
+	// discovered, rather than now, so that their age can be seen
+	stale, isStale := e.staleResults(ctx, q, adapter)
+
 	var itemHandler ItemHandler = func(item *sdp.Item) {
 		if item == nil {
 			return
@@ -363,9 +615,14 @@ func (e *Engine) Execute(ctx context.Context, q *sdp.Query, adapter Adapter, ite
 			return
 		}
 
+		timestamp := time.Now()
+		if isStale && !stale.Stored.IsZero() {
+			timestamp = stale.Stored
+		}
+
 		// Store metadata
 		item.Metadata = &sdp.Metadata{
-			Timestamp:   timestamppb.New(time.Now()),
+			Timestamp:   timestamppb.New(timestamp),
 			SourceName:  adapter.Name(),
 			SourceQuery: q,
 		}
@@ -391,24 +648,160 @@ func (e *Engine) Execute(ctx context.Context, q *sdp.Query, adapter Adapter, ite
 		numErrs.Add(1)
 		errs <- convertToSDPError(err, q, adapter, e.EngineConfig.SourceName)
 	}
-	stream := NewQueryResultStream(itemHandler, errHandler)
-	defer stream.Close()
+
+	if isStale {
+		// Serve the stale results straight away and refresh them in the
+		// background, rather than making the caller wait for the adapter
+		span.SetAttributes(attribute.Bool("ovm.adapter.servedStale", true))
+
+		for _, item := range stale.Items {
+			itemHandler(item)
+		}
+		if stale.Error != nil {
+			errHandler(stale.Error)
+		}
+
+		e.revalidate(ctx, q, adapter)
+	} else {
+		e.executeCoalesced(ctx, q, adapter, itemHandler, errHandler)
+	}
+
+	span.SetAttributes(
+		attribute.Int("ovm.adapter.numItems", int(numItems.Load())),
+		attribute.Int("ovm.adapter.numErrors", int(numErrs.Load())),
+	)
+}
+
+// runAdapter Runs a query against an adapter, applying the circuit breaker,
+// rate limits and GetListMutex for that adapter. Raw results from the adapter
+// are passed to the handlers
+func (e *Engine) runAdapter(ctx context.Context, q *sdp.Query, adapter Adapter, itemHandler ItemHandler, errHandler ErrHandler) {
+	span := trace.SpanFromContext(ctx)
+
+	// Short-circuit adapters that have been failing consistently rather than
+	// waiting for them to time out again. The outcome is recorded once the
+	// query is complete
+	var numItems atomic.Int32
+	var numFailures atomic.Int32
+	var adapterCalled bool
+
+	if e.BreakerThreshold > 0 {
+		breaker := e.breakers.Get(adapter, q.GetScope())
+
+		if !breaker.Allow(e.BreakerCooldown) {
+			_, failures := breaker.State()
+			span.SetAttributes(attribute.Bool("ovm.adapter.circuitBreakerOpen", true))
+
+			errHandler(&sdp.QueryError{
+				ErrorType:   sdp.QueryError_OTHER,
+				ErrorString: fmt.Sprintf("circuit breaker open for adapter %v in scope %v after %v consecutive failures, not querying adapter", adapter.Name(), q.GetScope(), failures),
+			})
+			return
+		}
+
+		defer func() {
+			outcome := breakerIgnored
+			if adapterCalled {
+				outcome = executionOutcome(ctx, numItems.Load(), numFailures.Load())
+			}
+
+			breaker.Record(outcome, e.BreakerThreshold)
+		}()
+	}
+
+	// Wait for the adapter's concurrency limit before taking any locks,
+	// unless a slot was already taken before entering the execution pool.
+	// Since a slot is always taken before the GetListMutex, whoever holds a
+	// lock is never waiting for a slot, which avoids deadlocks
+	throttle := e.throttles.Get(adapter)
+	if throttle != nil && !holdsSlot(ctx, throttle) {
+		err := throttle.AcquireSlot(ctx)
+		if err != nil {
+			errHandler(&sdp.QueryError{
+				ErrorType:   sdp.QueryError_OTHER,
+				ErrorString: fmt.Sprintf("error waiting for adapter concurrency limit: %v", err),
+			})
+			return
+		}
+		defer throttle.ReleaseSlot()
+	}
+
+	// We want to avoid having a Get and a List running at the same time, we'd
+	// rather run the List first, populate the cache, then have the Get just
+	// grab the value from the cache. To this end we use a GetListMutex to allow
+	// a List to block all subsequent Get queries until it is done
+	switch q.GetMethod() {
+	case sdp.QueryMethod_GET:
+		e.gfm.GetLock(q.GetScope(), q.GetType())
+		defer e.gfm.GetUnlock(q.GetScope(), q.GetType())
+	case sdp.QueryMethod_LIST:
+		e.gfm.ListLock(q.GetScope(), q.GetType())
+		defer e.gfm.ListUnlock(q.GetScope(), q.GetType())
+	case sdp.QueryMethod_SEARCH:
+		// We don't need to lock for a search since they are independent and
+		// will only ever have a cache hit if the query is identical
+	}
 
 	// Check that our context is okay before doing anything expensive
 	if ctx.Err() != nil {
-		span.RecordError(ctx.Err())
+		errHandler(&sdp.QueryError{
+			ErrorType:   sdp.QueryError_OTHER,
+			ErrorString: ctx.Err().Error(),
+		})
+		return
+	}
 
-		errs <- &sdp.QueryError{
-			UUID:          q.GetUUID(),
-			ErrorType:     sdp.QueryError_OTHER,
-			ErrorString:   ctx.Err().Error(),
-			Scope:         q.GetScope(),
-			ResponderName: e.EngineConfig.SourceName,
-			ItemType:      q.GetType(),
+	// Count the results of this call for the circuit breaker
+	countingItemHandler := func(item *sdp.Item) {
+		if item != nil {
+			numItems.Add(1)
 		}
-		return
+		itemHandler(item)
+	}
+	countingErrHandler := func(err error) {
+		if err != nil && isBreakerFailure(err) {
+			numFailures.Add(1)
+		}
+		errHandler(err)
 	}
 
+	adapterCalled = true
+
+	streamOpts := e.streamOptions(ctx)
+
+	// Every call, including retries, waits for the adapter's rate limit
+	call := callAdapter
+	if throttle != nil {
+		call = throttle.limitRate(callAdapter)
+	}
+
+	if policy := e.retryPolicy(adapter); policy != nil {
+		executeWithRetries(ctx, q, adapter, policy, call, streamOpts, countingItemHandler, countingErrHandler)
+	} else {
+		stream := NewQueryResultStream(countingItemHandler, countingErrHandler, streamOpts...)
+		call(ctx, q, adapter, stream)
+		stream.Close()
+	}
+}
+
+// adapterCall Runs a query against an adapter, sending the results to the
+// stream
+type adapterCall func(ctx context.Context, q *sdp.Query, adapter Adapter, stream *QueryResultStream)
+
+// streamOptions Returns the options for the streams that adapters send their
+// results to
+func (e *Engine) streamOptions(ctx context.Context) []QueryResultStreamOption {
+	return []QueryResultStreamOption{
+		WithStreamContext(ctx),
+		WithStreamBufferSize(e.EngineConfig.StreamBufferSize),
+		WithStreamItemLimit(e.EngineConfig.StreamItemLimit),
+		WithStreamByteLimit(e.EngineConfig.StreamByteLimit),
+	}
+}
+
+// callAdapter Runs a query against an adapter using the most appropriate
+// method, sending the results to the stream
+func callAdapter(ctx context.Context, q *sdp.Query, adapter Adapter, stream *QueryResultStream) {
 	switch q.GetMethod() {
 	case sdp.QueryMethod_GET:
 		newItem, err := adapter.Get(ctx, q.GetScope(), q.GetQuery(), q.GetIgnoreCache())
@@ -428,7 +821,9 @@ func (e *Engine) Execute(ctx context.Context, q *sdp.Query, adapter Adapter, ite
 			resultItems, err := listableAdapter.List(ctx, q.GetScope(), q.GetIgnoreCache())
 
 			for _, i := range resultItems {
-				stream.SendItem(i)
+				if stream.TrySendItem(i) != nil {
+					break
+				}
 			}
 			if err != nil {
 				stream.SendError(err)
@@ -448,7 +843,9 @@ func (e *Engine) Execute(ctx context.Context, q *sdp.Query, adapter Adapter, ite
 			resultItems, err := searchableAdapter.Search(ctx, q.GetScope(), q.GetQuery(), q.GetIgnoreCache())
 
 			for _, i := range resultItems {
-				stream.SendItem(i)
+				if stream.TrySendItem(i) != nil {
+					break
+				}
 			}
 			if err != nil {
 				stream.SendError(err)
@@ -461,10 +858,32 @@ func (e *Engine) Execute(ctx context.Context, q *sdp.Query, adapter Adapter, ite
 		}
 	}
 
-	span.SetAttributes(
-		attribute.Int("ovm.adapter.numItems", int(numItems.Load())),
-		attribute.Int("ovm.adapter.numErrors", int(numErrs.Load())),
-	)
+	if stream.Truncated() {
+		stream.SendError(&sdp.QueryError{
+			ErrorType:   sdp.QueryError_OTHER,
+			ErrorString: fmt.Sprintf("results have been truncated: %v", ErrStreamLimitReached),
+		})
+	}
+}
+
+// executionOutcome Determines whether a query that was sent to an adapter
+// should count as a success or failure for its circuit breaker. Queries that
+// were cancelled by the caller are ignored, and any item being returned counts
+// as a success since the adapter is evidently working
+func executionOutcome(ctx context.Context, numItems int32, numFailures int32) breakerOutcome {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return breakerIgnored
+	}
+
+	if numItems > 0 {
+		return breakerSuccess
+	}
+
+	if numFailures > 0 || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return breakerFailure
+	}
+
+	return breakerSuccess
 }
 
 // Converts any error type to an SDP error, if it isn't already
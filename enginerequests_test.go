@@ -2,7 +2,9 @@ package discovery
 
 import (
 	"context"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -319,6 +321,107 @@ func TestWildcardAdapterExpansion(t *testing.T) {
 	})
 }
 
+func TestWeightedAdapters(t *testing.T) {
+	heavyAdapter := TestAdapter{
+		ReturnType:   "person",
+		ReturnName:   "heavy",
+		ReturnScopes: []string{sdp.WILDCARD},
+		ReturnWeight: 10,
+	}
+
+	lightAdapter := TestAdapter{
+		ReturnType:   "person",
+		ReturnName:   "light",
+		ReturnScopes: []string{"test"},
+		ReturnWeight: 1,
+	}
+
+	e := newStartedEngine(t, "TestWeightedAdapters", nil, &lightAdapter, &heavyAdapter)
+
+	t.Run("only the highest weight item is returned", func(t *testing.T) {
+		q := &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "test",
+		}
+
+		items, errs, err := e.executeQuerySync(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range errs {
+			t.Error(e)
+		}
+
+		if len(heavyAdapter.GetCalls) != 1 || len(lightAdapter.GetCalls) != 1 {
+			t.Errorf("expected both adapters to be queried, got %v and %v calls", len(heavyAdapter.GetCalls), len(lightAdapter.GetCalls))
+		}
+
+		if len(items) != 1 {
+			t.Fatalf("expected 1 item, got %v", len(items))
+		}
+
+		if source := items[0].GetMetadata().GetSourceName(); source != heavyAdapter.Name() {
+			t.Errorf("expected item to come from the heavy adapter, got %v", source)
+		}
+	})
+}
+
+func TestCompetingQueries(t *testing.T) {
+	wildcard := &TestAdapter{ReturnName: "wildcard", ReturnScopes: []string{sdp.WILDCARD}}
+	specific := &TestAdapter{ReturnName: "specific", ReturnScopes: []string{"a", "b"}}
+	other := &TestAdapter{ReturnName: "other", ReturnType: "dog", ReturnScopes: []string{"a"}}
+
+	query := func(typ string, scope string) *sdp.Query {
+		return &sdp.Query{Type: typ, Scope: scope}
+	}
+
+	t.Run("one adapter with many scopes", func(t *testing.T) {
+		a, b := query("person", "a"), query("person", "b")
+
+		competing := competingQueries(map[*sdp.Query]Adapter{a: specific, b: specific})
+
+		if competing[a] || competing[b] {
+			t.Error("expected items from different scopes of one adapter to be streamed")
+		}
+	})
+
+	t.Run("different types", func(t *testing.T) {
+		a, dog := query("person", "a"), query("dog", "a")
+
+		competing := competingQueries(map[*sdp.Query]Adapter{a: specific, dog: other})
+
+		if competing[a] || competing[dog] {
+			t.Error("expected items of different types to be streamed")
+		}
+	})
+
+	t.Run("different adapters for the same scope", func(t *testing.T) {
+		a, b, wildcardA := query("person", "a"), query("person", "b"), query("person", "a")
+
+		competing := competingQueries(map[*sdp.Query]Adapter{a: specific, b: specific, wildcardA: wildcard})
+
+		if !competing[a] || !competing[wildcardA] {
+			t.Error("expected items from both adapters in scope a to be buffered")
+		}
+		if competing[b] {
+			t.Error("expected items in scope b to be streamed")
+		}
+	})
+
+	t.Run("wildcard scope", func(t *testing.T) {
+		a, open := query("person", "a"), query("person", sdp.WILDCARD)
+
+		competing := competingQueries(map[*sdp.Query]Adapter{a: specific, open: wildcard})
+
+		if !competing[a] || !competing[open] {
+			t.Error("expected items from an adapter queried with a wildcard scope to be buffered")
+		}
+	})
+}
+
 func TestSendQuerySync(t *testing.T) {
 	SkipWithoutNats(t)
 
@@ -451,3 +554,73 @@ func TestExpandQuery(t *testing.T) {
 		}
 	})
 }
+
+// multiItemAdapter is a TestAdapter whose LIST returns `NumItems` items
+type multiItemAdapter struct {
+	TestAdapter
+
+	NumItems int
+}
+
+func (m *multiItemAdapter) List(ctx context.Context, scope string, ignoreCache bool) ([]*sdp.Item, error) {
+	items := make([]*sdp.Item, 0, m.NumItems)
+	for i := range m.NumItems {
+		items = append(items, m.NewTestItem(scope, fmt.Sprintf("item-%v", i)))
+	}
+
+	return items, nil
+}
+
+func TestExecuteStreamItemLimit(t *testing.T) {
+	tests := map[string]struct {
+		NumItems  int
+		Truncated bool
+	}{
+		"below the limit": {NumItems: 1},
+		"at the limit":    {NumItems: 2},
+		"over the limit":  {NumItems: 3, Truncated: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			e, err := NewEngine(&EngineConfig{StreamItemLimit: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			adapter := &multiItemAdapter{
+				TestAdapter: TestAdapter{ReturnScopes: []string{"test"}},
+				NumItems:    test.NumItems,
+			}
+
+			items := make(chan *sdp.Item, 10)
+			errs := make(chan *sdp.QueryError, 10)
+
+			e.Execute(context.Background(), &sdp.Query{
+				Type:   "person",
+				Method: sdp.QueryMethod_LIST,
+				Scope:  "test",
+			}, adapter, items, errs)
+
+			close(items)
+			close(errs)
+
+			if expected := min(test.NumItems, 2); len(items) != expected {
+				t.Errorf("expected %v items, got %v", expected, len(items))
+			}
+
+			var truncated bool
+			for err := range errs {
+				if strings.Contains(err.GetErrorString(), "truncated") {
+					truncated = true
+				} else {
+					t.Error(err)
+				}
+			}
+
+			if truncated != test.Truncated {
+				t.Errorf("expected truncated to be %v, got %v", test.Truncated, truncated)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long each adapter's health check is allowed to run for when checking
+// readiness
+const adapterHealthCheckTimeout = 10 * time.Second
+
+// DefaultAdapterHealthCheckInterval is how long the results of adapter health
+// checks are reused for by `ReadinessCheck()`
+const DefaultAdapterHealthCheckInterval = 30 * time.Second
+
+// ErrNotStarted is returned by health checks when the engine hasn't finished
+// starting, or has been stopped
+var ErrNotStarted = errors.New("engine is not started")
+
+// IsStarted Returns whether the engine has finished starting
+func (e *Engine) IsStarted() bool {
+	e.startedAtMutex.RLock()
+	defer e.startedAtMutex.RUnlock()
+
+	return !e.startedAt.IsZero()
+}
+
+// LivenessCheck Returns an error if the engine is no longer able to function
+// and should be restarted. An engine whose last call to `Start()` failed is
+// not live. An engine that is still starting or has been stopped is considered
+// to be live, once started it is live as long as it is connected to NATS
+func (e *Engine) LivenessCheck(ctx context.Context) error {
+	e.startedAtMutex.RLock()
+	started := !e.startedAt.IsZero()
+	startErr := e.startErr
+	e.startedAtMutex.RUnlock()
+
+	if startErr != nil {
+		return fmt.Errorf("engine failed to start: %w", startErr)
+	}
+
+	if !started {
+		return nil
+	}
+
+	return e.HealthCheck(ctx)
+}
+
+// ReadinessCheck Returns an error if the engine is not currently able to serve
+// queries. This combines:
+//
+//   - Whether the engine has finished starting
+//   - The NATS connection status
+//   - How long it has been since the last successful heartbeat, if heartbeats
+//     are enabled
+//   - The result of `HeartbeatOptions.HealthCheck`, if set
+//   - The most recent result of `HealthCheck()` for all adapters that
+//     implement `HealthCheckableAdapter`. These are checked in the background
+//     at most every `AdapterHealthCheckInterval` so that probes return
+//     quickly, which means that a change in an adapter's health is reported
+//     by the probe after the next check
+//
+// All failing checks are included in the returned error
+func (e *Engine) ReadinessCheck(ctx context.Context) error {
+	if !e.IsStarted() {
+		return ErrNotStarted
+	}
+
+	errs := []error{
+		e.HealthCheck(ctx),
+		e.heartbeatHealthCheck(),
+	}
+
+	if e.EngineConfig.HeartbeatOptions != nil && e.EngineConfig.HeartbeatOptions.HealthCheck != nil {
+		errs = append(errs, e.EngineConfig.HeartbeatOptions.HealthCheck())
+	}
+
+	errs = append(errs, e.cachedAdapterHealthCheck())
+
+	return errors.Join(errs...)
+}
+
+// adapterHealth Stores the most recent result of the adapters' health checks
+type adapterHealth struct {
+	err       error
+	checkedAt time.Time
+	checking  bool
+	mutex     sync.Mutex
+}
+
+// cachedAdapterHealthCheck Returns the most recent result of
+// `adapterHealthCheck()`, starting a new check in the background if the
+// result is older than `AdapterHealthCheckInterval`. Returns nil until the
+// first check has completed
+func (e *Engine) cachedAdapterHealthCheck() error {
+	interval := e.AdapterHealthCheckInterval
+	if interval <= 0 {
+		interval = DefaultAdapterHealthCheckInterval
+	}
+
+	e.adapterHealth.mutex.Lock()
+	defer e.adapterHealth.mutex.Unlock()
+
+	if !e.adapterHealth.checking && time.Since(e.adapterHealth.checkedAt) >= interval {
+		e.adapterHealth.checking = true
+
+		go func() {
+			// The check isn't tied to the probe that started it, since other
+			// probes will use the result
+			err := e.adapterHealthCheck(context.Background())
+
+			e.adapterHealth.mutex.Lock()
+			defer e.adapterHealth.mutex.Unlock()
+
+			e.adapterHealth.err = err
+			e.adapterHealth.checkedAt = time.Now()
+			e.adapterHealth.checking = false
+		}()
+	}
+
+	return e.adapterHealth.err
+}
+
+// heartbeatHealthCheck Returns an error if heartbeats are enabled and there
+// hasn't been a successful one within the window that was promised to the
+// API. Until the first heartbeat succeeds, the time the engine started is used
+// instead
+func (e *Engine) heartbeatHealthCheck() error {
+	options := e.EngineConfig.HeartbeatOptions
+	if options == nil || options.Frequency == 0 || options.ManagementClient == nil {
+		return nil
+	}
+
+	last := e.LastHeartbeat()
+	if last.IsZero() {
+		e.startedAtMutex.RLock()
+		last = e.startedAt
+		e.startedAtMutex.RUnlock()
+	}
+
+	maxAge := time.Duration(float64(options.Frequency) * 2.5)
+	if age := time.Since(last); age > maxAge {
+		return fmt.Errorf("no successful heartbeat for %v, expected one at least every %v", age.Round(time.Second), maxAge)
+	}
+
+	return nil
+}
+
+// adapterHealthCheck Runs the health check of every adapter that implements
+// `HealthCheckableAdapter` in parallel and returns the combined errors
+func (e *Engine) adapterHealthCheck(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, adapterHealthCheckTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var errs []error
+
+	for _, adapter := range e.sh.Adapters() {
+		checkable, ok := adapter.(HealthCheckableAdapter)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := checkable.HealthCheck(ctx)
+			if err != nil {
+				mutex.Lock()
+				errs = append(errs, fmt.Errorf("adapter %v is unhealthy: %w", checkable.Name(), err))
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// HealthHandler Returns an HTTP handler that serves `/healthz` based on
+// `LivenessCheck()` and `/readyz` based on `ReadinessCheck()`. These are
+// intended to be used as Kubernetes liveness and readiness probes. Healthy
+// checks return a 200, unhealthy checks return a 503 with the reason in the
+// body.
+//
+// This handler is served on `EngineConfig.HealthServerAddress` when the engine
+// is started, but can also be mounted in an existing server
+func (e *Engine) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthCheckHandler(e.LivenessCheck))
+	mux.HandleFunc("/readyz", healthCheckHandler(e.ReadinessCheck))
+
+	return mux
+}
+
+// healthCheckHandler Converts a health check function into an HTTP handler
+func healthCheckHandler(check func(ctx context.Context) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+
+		err := check(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err.Error())
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	}
+}
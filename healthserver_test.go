@@ -0,0 +1,301 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// healthCheckAdapter is a TestAdapter that also implements
+// HealthCheckableAdapter
+type healthCheckAdapter struct {
+	TestAdapter
+	Err error
+
+	errMutex sync.Mutex
+}
+
+func (h *healthCheckAdapter) HealthCheck(ctx context.Context) error {
+	h.errMutex.Lock()
+	defer h.errMutex.Unlock()
+
+	return h.Err
+}
+
+// setErr Sets the error returned by `HealthCheck()` while checks may be
+// running in the background
+func (h *healthCheckAdapter) setErr(err error) {
+	h.errMutex.Lock()
+	defer h.errMutex.Unlock()
+
+	h.Err = err
+}
+
+// getHealth Requests a path from the handler and returns the status and body
+func getHealth(t *testing.T, handler http.Handler, path string) (int, string) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(body)
+}
+
+func TestHealthHandlerNotStarted(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("liveness", func(t *testing.T) {
+		status, _ := getHealth(t, e.HealthHandler(), "/healthz")
+		if status != http.StatusOK {
+			t.Errorf("expected status %v while starting, got %v", http.StatusOK, status)
+		}
+	})
+
+	t.Run("readiness", func(t *testing.T) {
+		status, body := getHealth(t, e.HealthHandler(), "/readyz")
+		if status != http.StatusServiceUnavailable {
+			t.Errorf("expected status %v, got %v", http.StatusServiceUnavailable, status)
+		}
+
+		if !strings.Contains(body, ErrNotStarted.Error()) {
+			t.Errorf("expected body to contain %q, got %q", ErrNotStarted.Error(), body)
+		}
+	})
+}
+
+func TestAdapterHealthCheck(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	healthy := healthCheckAdapter{
+		TestAdapter: TestAdapter{
+			ReturnType:   "healthy",
+			ReturnScopes: []string{"test"},
+			ReturnName:   "healthy-adapter",
+		},
+	}
+	unhealthy := healthCheckAdapter{
+		TestAdapter: TestAdapter{
+			ReturnType:   "unhealthy",
+			ReturnScopes: []string{"test"},
+			ReturnName:   "unhealthy-adapter",
+		},
+		Err: errors.New("credentials expired"),
+	}
+
+	err = e.AddAdapters(&healthy, &unhealthy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.adapterHealthCheck(context.Background())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if !strings.Contains(err.Error(), "unhealthy-adapter") || !strings.Contains(err.Error(), "credentials expired") {
+		t.Errorf("expected error to mention the unhealthy adapter, got %v", err)
+	}
+
+	if strings.Contains(err.Error(), "testAdapter-healthy-adapter") {
+		t.Errorf("did not expect the healthy adapter to be mentioned, got %v", err)
+	}
+
+	unhealthy.Err = nil
+
+	err = e.adapterHealthCheck(context.Background())
+	if err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
+
+func TestHeartbeatHealthCheck(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{
+		HeartbeatOptions: &HeartbeatOptions{
+			ManagementClient: testHeartbeatClient{},
+			Frequency:        time.Second,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("within the grace period after starting", func(t *testing.T) {
+		e.startedAt = time.Now()
+
+		if err := e.heartbeatHealthCheck(); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	})
+
+	t.Run("with no heartbeat since starting", func(t *testing.T) {
+		e.startedAt = time.Now().Add(-time.Minute)
+
+		if err := e.heartbeatHealthCheck(); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("with a recent heartbeat", func(t *testing.T) {
+		e.lastHeartbeat = time.Now()
+
+		if err := e.heartbeatHealthCheck(); err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	})
+
+	t.Run("with a stale heartbeat", func(t *testing.T) {
+		e.lastHeartbeat = time.Now().Add(-time.Minute)
+
+		if err := e.heartbeatHealthCheck(); err == nil {
+			t.Error("expected an error")
+		}
+	})
+}
+
+func TestHealthHandler(t *testing.T) {
+	SkipWithoutNats(t)
+
+	adapter := healthCheckAdapter{
+		TestAdapter: TestAdapter{
+			ReturnType:   "person",
+			ReturnScopes: []string{"test"},
+		},
+	}
+
+	e := newStartedEngine(t, "TestHealthHandler", nil, &adapter)
+	e.AdapterHealthCheckInterval = time.Millisecond
+
+	// waitForReadiness Polls readiness until it returns the expected status,
+	// since adapter health is checked in the background
+	waitForReadiness := func(t *testing.T, expected int) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			status, body := getHealth(t, e.HealthHandler(), "/readyz")
+			if status == expected {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected status %v, got %v: %v", expected, status, body)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitForReadiness(t, http.StatusOK)
+
+	adapter.setErr(errors.New("broken"))
+
+	waitForReadiness(t, http.StatusServiceUnavailable)
+
+	status, _ := getHealth(t, e.HealthHandler(), "/healthz")
+	if status != http.StatusOK {
+		t.Errorf("expected liveness to be unaffected by adapter health, got %v", status)
+	}
+}
+
+func TestCachedAdapterHealthCheck(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := countingHealthCheckAdapter{
+		healthCheckAdapter: healthCheckAdapter{
+			TestAdapter: TestAdapter{ReturnScopes: []string{"test"}},
+			Err:         errors.New("broken"),
+		},
+	}
+
+	err = e.AddAdapters(&adapter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first call starts a check in the background
+	e.cachedAdapterHealthCheck()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.cachedAdapterHealthCheck() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the adapter's error to be reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for range 10 {
+		e.cachedAdapterHealthCheck()
+	}
+
+	if calls := adapter.calls.Load(); calls != 1 {
+		t.Errorf("expected the result to be reused, got %v adapter health checks", calls)
+	}
+}
+
+// countingHealthCheckAdapter is a healthCheckAdapter that counts its health
+// checks
+type countingHealthCheckAdapter struct {
+	healthCheckAdapter
+
+	calls atomic.Int32
+}
+
+func (c *countingHealthCheckAdapter) HealthCheck(ctx context.Context) error {
+	c.calls.Add(1)
+	return c.healthCheckAdapter.HealthCheck(ctx)
+}
+
+func TestLivenessAfterFailedStart(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{
+		HealthServerAddress: "127.0.0.1:0",
+		QueryServerAddress:  "not a valid address",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = e.StopHealthServer()
+	})
+
+	err = e.Start()
+	if err == nil {
+		t.Fatal("expected Start to fail")
+	}
+
+	if err := e.LivenessCheck(context.Background()); err == nil {
+		t.Error("expected liveness to report that starting failed")
+	}
+
+	if err := e.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.healthServer == nil {
+		t.Error("expected the health server to keep running when the engine is stopped")
+	}
+}
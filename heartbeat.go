@@ -25,7 +25,14 @@ func (e *Engine) SendHeartbeat(ctx context.Context) error {
 		return ErrNoHealthcheckDefined
 	}
 
-	healthCheckError := e.EngineConfig.HeartbeatOptions.HealthCheck()
+	// Open circuit breakers and adapters whose scopes have changed to
+	// overlap are reported alongside the source's own health check so that
+	// they are visible to users
+	healthCheckError := errors.Join(
+		e.EngineConfig.HeartbeatOptions.HealthCheck(),
+		e.breakers.Err(),
+		e.sh.ScopeConflicts(),
+	)
 
 	var heartbeatError *string
 
@@ -40,10 +47,11 @@ func (e *Engine) SendHeartbeat(ctx context.Context) error {
 		engineUUID = e.EngineConfig.SourceUUID[:]
 	}
 
-	// Get available types and scopes
+	// Get available types and scopes. The built-in meta adapters are excluded
+	// since every engine has them
 	availableScopesMap := make(map[string]bool)
 	adapterMetadata := []*sdp.AdapterMetadata{}
-	for _, adapter := range e.sh.VisibleAdapters() {
+	for _, adapter := range inventoryAdapters(e.sh) {
 		for _, scope := range adapter.Scopes() {
 			availableScopesMap[scope] = true
 		}
@@ -74,9 +82,24 @@ func (e *Engine) SendHeartbeat(ctx context.Context) error {
 		},
 	})
 
+	if err == nil {
+		e.lastHeartbeatMutex.Lock()
+		e.lastHeartbeat = time.Now()
+		e.lastHeartbeatMutex.Unlock()
+	}
+
 	return err
 }
 
+// LastHeartbeat Returns the time that the last successful heartbeat was sent,
+// or the zero time if none have been sent
+func (e *Engine) LastHeartbeat() time.Time {
+	e.lastHeartbeatMutex.Lock()
+	defer e.lastHeartbeatMutex.Unlock()
+
+	return e.lastHeartbeat
+}
+
 // Starts sending heartbeats at the specified frequency. These will be sent in
 // the background and this function will return immediately. Heartbeats are
 // automatically started when the engine started, but if an adapter has startup
@@ -0,0 +1,218 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	"github.com/overmindtech/sdpcache"
+)
+
+// MemoryCache is an in-memory `SnapshotCache`. It behaves in the same way as
+// `sdpcache.Cache` but its contents can be snapshotted, allowing them to be
+// persisted across restarts using `EngineConfig.CacheSnapshotPath`. Results
+// are only indexed by source name, scope and type, so `sdpcache.Cache` is
+// faster for adapters that cache a very large number of items of one type
+type MemoryCache struct {
+	// Minimum amount of time to wait between purges. Defaults to
+	// `sdpcache.MinWaitDefault`
+	MinWaitTime time.Duration
+
+	// How long to keep results after they expire so that they can be served
+	// stale using `LookupStale()`. Expired results are never returned by
+	// `Lookup()`. Defaults to zero, in which case results are purged as soon
+	// as they expire
+	StaleRetention time.Duration
+
+	// Entries indexed by SST hash then entry ID
+	entries map[sdpcache.SSTHash]map[string]CacheEntry
+	mutex   sync.RWMutex
+	purging atomic.Bool
+}
+
+var _ SnapshotCache = (*MemoryCache)(nil)
+var _ StaleCache = (*MemoryCache)(nil)
+
+// NewMemoryCache Creates an empty memory cache
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{
+		entries: make(map[sdpcache.SSTHash]map[string]CacheEntry),
+	}
+}
+
+// Lookup Returns whether the cache has a result for the given query. This has
+// the same semantics as `sdpcache.Cache.Lookup()`
+func (m *MemoryCache) Lookup(ctx context.Context, srcName string, method sdp.QueryMethod, scope string, typ string, query string, ignoreCache bool) (bool, sdpcache.CacheKey, []*sdp.Item, *sdp.QueryError) {
+	ck := sdpcache.CacheKeyFromParts(srcName, method, scope, typ, query)
+
+	if ignoreCache {
+		return ignoredCacheLookup(ctx, ck)
+	}
+
+	return cacheLookup(ctx, ck, method, m.search(ck, time.Now()), m.Delete)
+}
+
+// LookupStale Returns whether the cache has a result for the given query,
+// including results that expired less than `maxStale` ago. Results are only
+// kept for `StaleRetention` after they expire
+func (m *MemoryCache) LookupStale(ctx context.Context, srcName string, method sdp.QueryMethod, scope string, typ string, query string, maxStale time.Duration) StaleLookup {
+	ck := sdpcache.CacheKeyFromParts(srcName, method, scope, typ, query)
+
+	return staleLookup(ctx, ck, method, m.search(ck, time.Now().Add(-maxStale)), m.Delete)
+}
+
+// StoreItem Stores an item for the given duration
+func (m *MemoryCache) StoreItem(item *sdp.Item, duration time.Duration, ck sdpcache.CacheKey) {
+	if item == nil {
+		return
+	}
+
+	m.store(newItemCacheEntry(item, duration, ck))
+}
+
+// StoreError Stores an error for the given duration
+func (m *MemoryCache) StoreError(err error, duration time.Duration, ck sdpcache.CacheKey) {
+	if err == nil {
+		return
+	}
+
+	m.store(newErrorCacheEntry(err, duration, ck))
+}
+
+// Delete Deletes everything that matches the given cache key
+func (m *MemoryCache) Delete(ck sdpcache.CacheKey) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	hash := ck.SST.Hash()
+
+	for id, entry := range m.entries[hash] {
+		if ck.Matches(entry.indexValues()) {
+			delete(m.entries[hash], id)
+		}
+	}
+}
+
+// Purge Deletes all results that expired more than `StaleRetention` before
+// the given time
+func (m *MemoryCache) Purge(before time.Time) sdpcache.PurgeStats {
+	start := time.Now()
+	stats := sdpcache.PurgeStats{}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for hash, entries := range m.entries {
+		for id, entry := range entries {
+			purgeAt := entry.Expiry.Add(m.StaleRetention)
+
+			if purgeAt.Before(before) {
+				delete(entries, id)
+				stats.NumPurged++
+				continue
+			}
+
+			if stats.NextExpiry == nil || purgeAt.Before(*stats.NextExpiry) {
+				stats.NextExpiry = &purgeAt
+			}
+		}
+
+		if len(entries) == 0 {
+			delete(m.entries, hash)
+		}
+	}
+
+	stats.TimeTaken = time.Since(start)
+
+	return stats
+}
+
+// StartPurger Purges expired results in the background until the context is
+// cancelled
+func (m *MemoryCache) StartPurger(ctx context.Context) error {
+	if !m.purging.CompareAndSwap(false, true) {
+		return errors.New("purger already running")
+	}
+
+	go func() {
+		defer m.purging.Store(false)
+
+		runPurger(ctx, m.Purge, m.MinWaitTime)
+	}()
+
+	return nil
+}
+
+// Clear Deletes everything in the cache
+func (m *MemoryCache) Clear() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.entries = make(map[sdpcache.SSTHash]map[string]CacheEntry)
+}
+
+// Snapshot Returns all of the unexpired entries in the cache
+func (m *MemoryCache) Snapshot() []CacheEntry {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	now := time.Now()
+	snapshot := make([]CacheEntry, 0)
+
+	for _, entries := range m.entries {
+		for _, entry := range entries {
+			if entry.Expiry.After(now) {
+				snapshot = append(snapshot, entry)
+			}
+		}
+	}
+
+	return snapshot
+}
+
+// Restore Adds entries to the cache, keeping their original expiry. Entries
+// that have already expired are ignored. The cache isn't cleared first, so
+// restored entries are merged with any that are already stored, replacing
+// those with the same ID
+func (m *MemoryCache) Restore(entries []CacheEntry) {
+	now := time.Now()
+
+	for _, entry := range entries {
+		if entry.Expiry.After(now) && (entry.Item != nil || entry.Error != nil) {
+			m.store(entry)
+		}
+	}
+}
+
+// store Adds an entry, replacing any existing entry with the same ID
+func (m *MemoryCache) store(entry CacheEntry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	hash := entry.SST.Hash()
+
+	if m.entries[hash] == nil {
+		m.entries[hash] = make(map[string]CacheEntry)
+	}
+
+	m.entries[hash][entry.id()] = entry
+}
+
+// search Returns the entries that match a cache key and expire after `now`
+func (m *MemoryCache) search(ck sdpcache.CacheKey, now time.Time) []CacheEntry {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	results := make([]CacheEntry, 0)
+
+	for _, entry := range m.entries[ck.SST.Hash()] {
+		if entry.Expiry.After(now) && ck.Matches(entry.indexValues()) {
+			results = append(results, entry)
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,108 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	"github.com/overmindtech/sdpcache"
+)
+
+func TestMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	adapter := TestAdapter{}
+
+	t.Run("store and lookup", func(t *testing.T) {
+		cache := NewMemoryCache()
+
+		ck := sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_LIST, "scope", "person", "")
+		cache.StoreItem(adapter.NewTestItem("scope", "one"), time.Minute, ck)
+		cache.StoreItem(adapter.NewTestItem("scope", "two"), time.Minute, ck)
+		cache.StoreItem(adapter.NewTestItem("scope", "three"), -time.Second, ck)
+
+		hit, _, items, _ := cache.Lookup(ctx, "test", sdp.QueryMethod_LIST, "scope", "person", "", false)
+		if !hit || len(items) != 2 {
+			t.Errorf("expected a cache hit with 2 unexpired items, got hit=%v items=%v", hit, len(items))
+		}
+
+		hit, _, items, _ = cache.Lookup(ctx, "test", sdp.QueryMethod_GET, "scope", "person", "two", false)
+		if !hit || len(items) != 1 || items[0].UniqueAttributeValue() != "two" {
+			t.Errorf("expected item two, got hit=%v items=%v", hit, items)
+		}
+
+		// Returned items must be copies
+		items[0].Scope = "changed"
+		_, _, items, _ = cache.Lookup(ctx, "test", sdp.QueryMethod_GET, "scope", "person", "two", false)
+		if items[0].GetScope() != "scope" {
+			t.Error("expected the cached item to be unaffected by changes to the returned item")
+		}
+
+		hit, _, _, _ = cache.Lookup(ctx, "test", sdp.QueryMethod_GET, "scope", "person", "two", true)
+		if hit {
+			t.Error("expected a cache miss when ignoring the cache")
+		}
+
+		cache.Delete(sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_GET, "scope", "person", "one"))
+		hit, _, _, _ = cache.Lookup(ctx, "test", sdp.QueryMethod_GET, "scope", "person", "one", false)
+		if hit {
+			t.Error("expected a cache miss after deleting")
+		}
+
+		stats := cache.Purge(time.Now())
+		if stats.NumPurged != 1 {
+			t.Errorf("expected 1 expired item to be purged, got %v", stats.NumPurged)
+		}
+
+		cache.Clear()
+		hit, _, _, _ = cache.Lookup(ctx, "test", sdp.QueryMethod_LIST, "scope", "person", "", false)
+		if hit {
+			t.Error("expected a cache miss after clearing")
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		cache := NewMemoryCache()
+
+		ck := sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_GET, "scope", "person", "missing")
+		cache.StoreError(&sdp.QueryError{ErrorType: sdp.QueryError_NOTFOUND}, time.Minute, ck)
+
+		hit, _, _, qErr := cache.Lookup(ctx, "test", sdp.QueryMethod_GET, "scope", "person", "missing", false)
+		if !hit || qErr.GetErrorType() != sdp.QueryError_NOTFOUND {
+			t.Errorf("expected a cached NOTFOUND error, got hit=%v err=%v", hit, qErr)
+		}
+	})
+
+	t.Run("snapshot and restore", func(t *testing.T) {
+		cache := NewMemoryCache()
+
+		ck := sdpcache.CacheKeyFromParts("test", sdp.QueryMethod_LIST, "scope", "person", "")
+		cache.StoreItem(adapter.NewTestItem("scope", "one"), time.Minute, ck)
+		cache.StoreItem(adapter.NewTestItem("scope", "two"), -time.Second, ck)
+
+		snapshot := cache.Snapshot()
+		if len(snapshot) != 1 {
+			t.Fatalf("expected 1 unexpired entry in the snapshot, got %v", len(snapshot))
+		}
+
+		expired := snapshot[0]
+		expired.Expiry = time.Now().Add(-time.Second)
+
+		restored := NewMemoryCache()
+		restored.Restore(append(snapshot, expired))
+
+		entries := restored.Snapshot()
+		if len(entries) != 1 {
+			t.Fatalf("expected 1 restored entry, got %v", len(entries))
+		}
+
+		if !entries[0].Expiry.Equal(snapshot[0].Expiry) {
+			t.Errorf("expected the original expiry %v, got %v", snapshot[0].Expiry, entries[0].Expiry)
+		}
+
+		hit, _, items, _ := restored.Lookup(ctx, "test", sdp.QueryMethod_LIST, "scope", "person", "", false)
+		if !hit || len(items) != 1 {
+			t.Errorf("expected a cache hit with 1 item, got hit=%v items=%v", hit, len(items))
+		}
+	})
+}
@@ -0,0 +1,507 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/overmindtech/sdp-go"
+)
+
+// MetaAdapterScope The scope that the built-in meta adapters respond to. Since
+// they describe the engine itself rather than any particular scope, they use a
+// single global scope
+const MetaAdapterScope = "global"
+
+const (
+	SourceMetaAdapterType = "overmind-source"
+	ScopeMetaAdapterType  = "overmind-scope"
+	TypeMetaAdapterType   = "overmind-type"
+)
+
+// metaAdapter is implemented by the built-in adapters that describe the engine.
+// These are excluded from the inventory that they return so that the results
+// only include the adapters that the source author registered
+type metaAdapter interface {
+	isMetaAdapter()
+}
+
+// newMetaAdapters Returns the built-in meta adapters for a given AdapterHost
+func newMetaAdapters(sh *AdapterHost) []Adapter {
+	return []Adapter{
+		&sourceMetaAdapter{sh: sh},
+		&scopeMetaAdapter{sh: sh},
+		&typeMetaAdapter{sh: sh},
+	}
+}
+
+// inventoryAdapters Returns all visible adapters, excluding the meta adapters
+func inventoryAdapters(sh *AdapterHost) []Adapter {
+	adapters := make([]Adapter, 0)
+
+	for _, adapter := range sh.VisibleAdapters() {
+		if _, ok := adapter.(metaAdapter); ok {
+			continue
+		}
+
+		adapters = append(adapters, adapter)
+	}
+
+	return adapters
+}
+
+// checkMetaScope Returns an error if the scope isn't one that the meta adapters
+// respond to
+func checkMetaScope(scope string) error {
+	if scope != MetaAdapterScope {
+		return &sdp.QueryError{
+			ErrorType:   sdp.QueryError_NOSCOPE,
+			ErrorString: fmt.Sprintf("meta adapters only support the '%v' scope", MetaAdapterScope),
+			Scope:       scope,
+		}
+	}
+
+	return nil
+}
+
+// notFound Returns a NOTFOUND error for a given type and query
+func notFound(typ string, scope string, query string) error {
+	return &sdp.QueryError{
+		ErrorType:   sdp.QueryError_NOTFOUND,
+		ErrorString: fmt.Sprintf("%v '%v' not found", typ, query),
+		Scope:       scope,
+	}
+}
+
+// searchRank Ranks how well a candidate matches a search query. Prefix matches
+// rank highest, followed by free-text (substring) matches, followed by fuzzy
+// matches where all characters of the query appear in order. Returns zero if
+// the candidate doesn't match at all. Matching is case-insensitive
+func searchRank(query string, candidate string) int {
+	query = strings.ToLower(query)
+	candidate = strings.ToLower(candidate)
+
+	switch {
+	case strings.HasPrefix(candidate, query):
+		return 3
+	case strings.Contains(candidate, query):
+		return 2
+	case fuzzyMatch(query, candidate):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// fuzzyMatch Returns true if all characters in the query appear in the
+// candidate in the same order, though not necessarily next to each other
+func fuzzyMatch(query string, candidate string) bool {
+	remaining := []rune(query)
+
+	for _, c := range candidate {
+		if len(remaining) == 0 {
+			break
+		}
+
+		if c == remaining[0] {
+			remaining = remaining[1:]
+		}
+	}
+
+	return len(remaining) == 0
+}
+
+// searchNames Returns the names that match the query, best matches first
+func searchNames(query string, names []string) []string {
+	type ranked struct {
+		name string
+		rank int
+	}
+
+	matches := make([]ranked, 0)
+
+	for _, name := range names {
+		if rank := searchRank(query, name); rank > 0 {
+			matches = append(matches, ranked{name: name, rank: rank})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].rank != matches[j].rank {
+			return matches[i].rank > matches[j].rank
+		}
+
+		return matches[i].name < matches[j].name
+	})
+
+	results := make([]string, len(matches))
+	for i, m := range matches {
+		results[i] = m.name
+	}
+
+	return results
+}
+
+// sortedKeys Returns the keys of a set in alphabetical order
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+
+	for k := range set {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// newMetaItem Creates an item in the meta scope with a "name" unique attribute
+func newMetaItem(typ string, attrs map[string]interface{}) (*sdp.Item, error) {
+	attributes, err := sdp.ToAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sdp.Item{
+		Type:            typ,
+		UniqueAttribute: "name",
+		Scope:           MetaAdapterScope,
+		Attributes:      attributes,
+	}, nil
+}
+
+// sourceMetaAdapter Returns the adapters that are registered with the engine
+type sourceMetaAdapter struct {
+	sh *AdapterHost
+}
+
+func (s *sourceMetaAdapter) isMetaAdapter() {}
+
+func (s *sourceMetaAdapter) Type() string {
+	return SourceMetaAdapterType
+}
+
+func (s *sourceMetaAdapter) Name() string {
+	return "overmind-source-adapter"
+}
+
+func (s *sourceMetaAdapter) Scopes() []string {
+	return []string{MetaAdapterScope}
+}
+
+func (s *sourceMetaAdapter) Metadata() *sdp.AdapterMetadata {
+	return &sdp.AdapterMetadata{
+		Type:            SourceMetaAdapterType,
+		DescriptiveName: "Overmind Adapter",
+		SupportedQueryMethods: &sdp.AdapterSupportedQueryMethods{
+			Get:             true,
+			GetDescription:  "Get an adapter by its name or descriptive name",
+			List:            true,
+			ListDescription: "List all adapters",
+		},
+	}
+}
+
+func (s *sourceMetaAdapter) Get(ctx context.Context, scope string, query string, ignoreCache bool) (*sdp.Item, error) {
+	if err := checkMetaScope(scope); err != nil {
+		return nil, err
+	}
+
+	for _, adapter := range inventoryAdapters(s.sh) {
+		if adapter.Name() == query || adapter.Metadata().GetDescriptiveName() == query {
+			return adapterToItem(adapter)
+		}
+	}
+
+	return nil, notFound("adapter", scope, query)
+}
+
+func (s *sourceMetaAdapter) List(ctx context.Context, scope string, ignoreCache bool) ([]*sdp.Item, error) {
+	if err := checkMetaScope(scope); err != nil {
+		return nil, err
+	}
+
+	items := make([]*sdp.Item, 0)
+
+	for _, adapter := range inventoryAdapters(s.sh) {
+		item, err := adapterToItem(adapter)
+		if err != nil {
+			return items, err
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// adapterToItem Converts an adapter to an `overmind-source` item
+func adapterToItem(adapter Adapter) (*sdp.Item, error) {
+	metadata := adapter.Metadata()
+
+	return newMetaItem(SourceMetaAdapterType, map[string]interface{}{
+		"name":            adapter.Name(),
+		"descriptiveName": metadata.GetDescriptiveName(),
+		"type":            adapter.Type(),
+		"scopes":          adapter.Scopes(),
+		"get":             metadata.GetSupportedQueryMethods().GetGet(),
+		"list":            metadata.GetSupportedQueryMethods().GetList(),
+		"search":          metadata.GetSupportedQueryMethods().GetSearch(),
+	})
+}
+
+// scopeMetaAdapter Returns the scopes that the engine's adapters support
+type scopeMetaAdapter struct {
+	sh *AdapterHost
+}
+
+func (s *scopeMetaAdapter) isMetaAdapter() {}
+
+func (s *scopeMetaAdapter) Type() string {
+	return ScopeMetaAdapterType
+}
+
+func (s *scopeMetaAdapter) Name() string {
+	return "overmind-scope-adapter"
+}
+
+func (s *scopeMetaAdapter) Scopes() []string {
+	return []string{MetaAdapterScope}
+}
+
+func (s *scopeMetaAdapter) Metadata() *sdp.AdapterMetadata {
+	return &sdp.AdapterMetadata{
+		Type:            ScopeMetaAdapterType,
+		DescriptiveName: "Overmind Scope",
+		SupportedQueryMethods: &sdp.AdapterSupportedQueryMethods{
+			Get:               true,
+			GetDescription:    "Get a scope by its name",
+			List:              true,
+			ListDescription:   "List all available scopes",
+			Search:            true,
+			SearchDescription: "Search for scopes by name, prefix matches are returned first",
+		},
+	}
+}
+
+// scopeTypes Returns a map of all concrete scopes to the types that are
+// available in each. Adapters that support all scopes can't be listed so are
+// skipped
+func (s *scopeMetaAdapter) scopeTypes() map[string]map[string]bool {
+	scopes := make(map[string]map[string]bool)
+
+	for _, adapter := range inventoryAdapters(s.sh) {
+		for _, scope := range adapter.Scopes() {
+			if IsWildcard(scope) {
+				continue
+			}
+
+			if _, ok := scopes[scope]; !ok {
+				scopes[scope] = make(map[string]bool)
+			}
+
+			scopes[scope][adapter.Type()] = true
+		}
+	}
+
+	return scopes
+}
+
+func (s *scopeMetaAdapter) Get(ctx context.Context, scope string, query string, ignoreCache bool) (*sdp.Item, error) {
+	if err := checkMetaScope(scope); err != nil {
+		return nil, err
+	}
+
+	if types, ok := s.scopeTypes()[query]; ok {
+		return scopeToItem(query, types)
+	}
+
+	return nil, notFound("scope", scope, query)
+}
+
+func (s *scopeMetaAdapter) List(ctx context.Context, scope string, ignoreCache bool) ([]*sdp.Item, error) {
+	if err := checkMetaScope(scope); err != nil {
+		return nil, err
+	}
+
+	scopes := s.scopeTypes()
+	items := make([]*sdp.Item, 0, len(scopes))
+
+	for _, name := range sortedKeys(toSet(scopes)) {
+		item, err := scopeToItem(name, scopes[name])
+		if err != nil {
+			return items, err
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (s *scopeMetaAdapter) Search(ctx context.Context, scope string, query string, ignoreCache bool) ([]*sdp.Item, error) {
+	if err := checkMetaScope(scope); err != nil {
+		return nil, err
+	}
+
+	scopes := s.scopeTypes()
+	items := make([]*sdp.Item, 0)
+
+	for _, name := range searchNames(query, sortedKeys(toSet(scopes))) {
+		item, err := scopeToItem(name, scopes[name])
+		if err != nil {
+			return items, err
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// scopeToItem Converts a scope to an `overmind-scope` item
+func scopeToItem(name string, types map[string]bool) (*sdp.Item, error) {
+	return newMetaItem(ScopeMetaAdapterType, map[string]interface{}{
+		"name":  name,
+		"types": sortedKeys(types),
+	})
+}
+
+// typeMetaAdapter Returns the types that the engine's adapters support
+type typeMetaAdapter struct {
+	sh *AdapterHost
+}
+
+func (t *typeMetaAdapter) isMetaAdapter() {}
+
+func (t *typeMetaAdapter) Type() string {
+	return TypeMetaAdapterType
+}
+
+func (t *typeMetaAdapter) Name() string {
+	return "overmind-type-adapter"
+}
+
+func (t *typeMetaAdapter) Scopes() []string {
+	return []string{MetaAdapterScope}
+}
+
+func (t *typeMetaAdapter) Metadata() *sdp.AdapterMetadata {
+	return &sdp.AdapterMetadata{
+		Type:            TypeMetaAdapterType,
+		DescriptiveName: "Overmind Type",
+		SupportedQueryMethods: &sdp.AdapterSupportedQueryMethods{
+			Get:               true,
+			GetDescription:    "Get a type by its name",
+			List:              true,
+			ListDescription:   "List all available types",
+			Search:            true,
+			SearchDescription: "Search for types by name, prefix matches are returned first",
+		},
+	}
+}
+
+// typeInfo Information about a type, aggregated across all adapters for that
+// type
+type typeInfo struct {
+	descriptiveName string
+	scopes          map[string]bool
+}
+
+// types Returns all available types
+func (t *typeMetaAdapter) types() map[string]*typeInfo {
+	types := make(map[string]*typeInfo)
+
+	for _, adapter := range inventoryAdapters(t.sh) {
+		info, ok := types[adapter.Type()]
+		if !ok {
+			info = &typeInfo{
+				scopes: make(map[string]bool),
+			}
+			types[adapter.Type()] = info
+		}
+
+		if info.descriptiveName == "" {
+			info.descriptiveName = adapter.Metadata().GetDescriptiveName()
+		}
+
+		for _, scope := range adapter.Scopes() {
+			info.scopes[scope] = true
+		}
+	}
+
+	return types
+}
+
+func (t *typeMetaAdapter) Get(ctx context.Context, scope string, query string, ignoreCache bool) (*sdp.Item, error) {
+	if err := checkMetaScope(scope); err != nil {
+		return nil, err
+	}
+
+	if info, ok := t.types()[query]; ok {
+		return typeToItem(query, info)
+	}
+
+	return nil, notFound("type", scope, query)
+}
+
+func (t *typeMetaAdapter) List(ctx context.Context, scope string, ignoreCache bool) ([]*sdp.Item, error) {
+	if err := checkMetaScope(scope); err != nil {
+		return nil, err
+	}
+
+	types := t.types()
+	items := make([]*sdp.Item, 0, len(types))
+
+	for _, name := range sortedKeys(toSet(types)) {
+		item, err := typeToItem(name, types[name])
+		if err != nil {
+			return items, err
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func (t *typeMetaAdapter) Search(ctx context.Context, scope string, query string, ignoreCache bool) ([]*sdp.Item, error) {
+	if err := checkMetaScope(scope); err != nil {
+		return nil, err
+	}
+
+	types := t.types()
+	items := make([]*sdp.Item, 0)
+
+	for _, name := range searchNames(query, sortedKeys(toSet(types))) {
+		item, err := typeToItem(name, types[name])
+		if err != nil {
+			return items, err
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// typeToItem Converts a type to an `overmind-type` item
+func typeToItem(name string, info *typeInfo) (*sdp.Item, error) {
+	return newMetaItem(TypeMetaAdapterType, map[string]interface{}{
+		"name":            name,
+		"descriptiveName": info.descriptiveName,
+		"scopes":          sortedKeys(info.scopes),
+	})
+}
+
+// toSet Returns the keys of a map as a set
+func toSet[V any](m map[string]V) map[string]bool {
+	set := make(map[string]bool, len(m))
+
+	for k := range m {
+		set[k] = true
+	}
+
+	return set
+}
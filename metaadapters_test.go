@@ -0,0 +1,277 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	"github.com/overmindtech/sdp-go/auth"
+)
+
+func newMetaTestHost(t *testing.T) *AdapterHost {
+	t.Helper()
+
+	sh := NewAdapterHost()
+
+	err := sh.AddAdapters(
+		&TestAdapter{
+			ReturnScopes: []string{"prod", "staging"},
+			ReturnType:   "person",
+			ReturnName:   "person-adapter",
+		},
+		&TestAdapter{
+			ReturnScopes: []string{"production-eu"},
+			ReturnType:   "dog",
+			ReturnName:   "dog-adapter",
+		},
+		&TestAdapter{
+			ReturnScopes: []string{sdp.WILDCARD},
+			ReturnType:   "pet-record",
+			ReturnName:   "pet-record-adapter",
+		},
+		&TestAdapter{
+			ReturnScopes: []string{"secret"},
+			ReturnType:   "hidden",
+			ReturnName:   "hidden-adapter",
+			IsHidden:     true,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sh.AddAdapters(newMetaAdapters(sh)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sh
+}
+
+func metaItemNames(t *testing.T, items []*sdp.Item) []string {
+	t.Helper()
+
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		names = append(names, item.UniqueAttributeValue())
+	}
+
+	return names
+}
+
+func TestSourceMetaAdapter(t *testing.T) {
+	sh := newMetaTestHost(t)
+	adapter := sourceMetaAdapter{sh: sh}
+
+	t.Run("Get", func(t *testing.T) {
+		item, err := adapter.Get(context.Background(), MetaAdapterScope, "dog-adapter", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if item.GetType() != SourceMetaAdapterType {
+			t.Errorf("expected type %v, got %v", SourceMetaAdapterType, item.GetType())
+		}
+
+		if item.UniqueAttributeValue() != "dog-adapter" {
+			t.Errorf("expected dog-adapter, got %v", item.UniqueAttributeValue())
+		}
+	})
+
+	t.Run("Get hidden adapter", func(t *testing.T) {
+		_, err := adapter.Get(context.Background(), MetaAdapterScope, "hidden-adapter", false)
+
+		var sdpErr *sdp.QueryError
+		if !errors.As(err, &sdpErr) || sdpErr.GetErrorType() != sdp.QueryError_NOTFOUND {
+			t.Errorf("expected NOTFOUND error, got %v", err)
+		}
+	})
+
+	t.Run("Get with wrong scope", func(t *testing.T) {
+		_, err := adapter.Get(context.Background(), "prod", "dog-adapter", false)
+
+		var sdpErr *sdp.QueryError
+		if !errors.As(err, &sdpErr) || sdpErr.GetErrorType() != sdp.QueryError_NOSCOPE {
+			t.Errorf("expected NOSCOPE error, got %v", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		items, err := adapter.List(context.Background(), MetaAdapterScope, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Hidden adapters and the meta adapters themselves should not be
+		// included
+		if len(items) != 3 {
+			t.Errorf("expected 3 items, got %v: %v", len(items), metaItemNames(t, items))
+		}
+	})
+}
+
+func TestScopeMetaAdapter(t *testing.T) {
+	sh := newMetaTestHost(t)
+	adapter := scopeMetaAdapter{sh: sh}
+
+	t.Run("Get", func(t *testing.T) {
+		item, err := adapter.Get(context.Background(), MetaAdapterScope, "staging", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if item.UniqueAttributeValue() != "staging" {
+			t.Errorf("expected staging, got %v", item.UniqueAttributeValue())
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		items, err := adapter.List(context.Background(), MetaAdapterScope, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := metaItemNames(t, items)
+		expected := []string{"prod", "production-eu", "staging"}
+
+		if len(names) != len(expected) {
+			t.Fatalf("expected %v, got %v", expected, names)
+		}
+
+		for i := range expected {
+			if names[i] != expected[i] {
+				t.Errorf("expected %v, got %v", expected, names)
+			}
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		items, err := adapter.Search(context.Background(), MetaAdapterScope, "prod", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := metaItemNames(t, items)
+
+		if len(names) != 2 || names[0] != "prod" || names[1] != "production-eu" {
+			t.Errorf("expected [prod production-eu], got %v", names)
+		}
+	})
+}
+
+func TestTypeMetaAdapter(t *testing.T) {
+	sh := newMetaTestHost(t)
+	adapter := typeMetaAdapter{sh: sh}
+
+	t.Run("Get", func(t *testing.T) {
+		item, err := adapter.Get(context.Background(), MetaAdapterScope, "person", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if item.UniqueAttributeValue() != "person" {
+			t.Errorf("expected person, got %v", item.UniqueAttributeValue())
+		}
+	})
+
+	t.Run("Get meta type", func(t *testing.T) {
+		_, err := adapter.Get(context.Background(), MetaAdapterScope, TypeMetaAdapterType, false)
+
+		if err == nil {
+			t.Error("expected meta types to be excluded")
+		}
+	})
+
+	t.Run("Search ranks prefixes first", func(t *testing.T) {
+		// "pe" is a prefix of "person" and "pet-record", and a fuzzy match
+		// for nothing else
+		items, err := adapter.Search(context.Background(), MetaAdapterScope, "pe", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := metaItemNames(t, items)
+
+		if len(names) != 2 || names[0] != "person" || names[1] != "pet-record" {
+			t.Errorf("expected [person pet-record], got %v", names)
+		}
+	})
+
+	t.Run("Search free-text and fuzzy", func(t *testing.T) {
+		items, err := adapter.Search(context.Background(), MetaAdapterScope, "rd", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := metaItemNames(t, items)
+
+		// "rd" is a substring of "pet-record" and a fuzzy match for nothing
+		// else
+		if len(names) != 1 || names[0] != "pet-record" {
+			t.Errorf("expected [pet-record], got %v", names)
+		}
+	})
+}
+
+func TestSearchRank(t *testing.T) {
+	tests := []struct {
+		Query     string
+		Candidate string
+		Rank      int
+	}{
+		{Query: "ec2", Candidate: "ec2-instance", Rank: 3},
+		{Query: "EC2", Candidate: "ec2-instance", Rank: 3},
+		{Query: "instance", Candidate: "ec2-instance", Rank: 2},
+		{Query: "ecinst", Candidate: "ec2-instance", Rank: 1},
+		{Query: "xyz", Candidate: "ec2-instance", Rank: 0},
+	}
+
+	for _, test := range tests {
+		if rank := searchRank(test.Query, test.Candidate); rank != test.Rank {
+			t.Errorf("expected %v to rank %v against %v, got %v", test.Query, test.Rank, test.Candidate, rank)
+		}
+	}
+}
+
+func TestEngineRegistersMetaAdapters(t *testing.T) {
+	SkipWithoutNats(t)
+
+	ec := EngineConfig{
+		MaxParallelExecutions: 10,
+		SourceName:            "meta-test",
+		NATSOptions: &auth.NATSOptions{
+			NumRetries:        5,
+			RetryDelay:        time.Second,
+			Servers:           NatsTestURLs,
+			ConnectionName:    "test-connection",
+			ConnectionTimeout: time.Second,
+			MaxReconnects:     5,
+		},
+	}
+
+	e, err := NewEngine(&ec)
+	if err != nil {
+		t.Fatalf("Error initializing Engine: %v", err)
+	}
+
+	// Start twice to make sure that restarting doesn't add the adapters again
+	for i := 0; i < 2; i++ {
+		err = e.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, typ := range []string{SourceMetaAdapterType, ScopeMetaAdapterType, TypeMetaAdapterType} {
+			if l := len(e.sh.AdaptersByType(typ)); l != 1 {
+				t.Errorf("expected 1 %v adapter, got %v", typ, l)
+			}
+		}
+
+		err = e.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package discovery
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Instruments are created from the global MeterProvider. If this is replaced
+// after they are created (e.g. by `tracing.InitMeter()`) they will start
+// recording to the new provider automatically
+var meter = otel.GetMeterProvider().Meter(
+	instrumentationName,
+	metric.WithInstrumentationVersion(instrumentationVersion),
+)
+
+// engineMetrics contains all of the instruments that the engine records to
+type engineMetrics struct {
+	// The number of queries handled by the engine
+	queries metric.Int64Counter
+
+	// The number of queries that were ignored because a query with the same
+	// UUID had already been received
+	duplicateQueries metric.Int64Counter
+
+	// How long each execution of a query against an adapter takes
+	executeDuration metric.Float64Histogram
+
+	// The number of items returned by adapters
+	items metric.Int64Counter
+
+	// The number of errors returned by adapters
+	errors metric.Int64Counter
+
+	// How long executions spend waiting for a slot in the execution pool
+	poolWait metric.Float64Histogram
+}
+
+var metrics = newEngineMetrics()
+
+func newEngineMetrics() *engineMetrics {
+	var err error
+	m := &engineMetrics{}
+
+	m.queries, err = meter.Int64Counter(
+		"ovm.discovery.queries",
+		metric.WithDescription("The number of queries handled by the engine"),
+		metric.WithUnit("{query}"),
+	)
+	logMetricError(err)
+
+	m.duplicateQueries, err = meter.Int64Counter(
+		"ovm.discovery.queries.duplicate",
+		metric.WithDescription("The number of queries that were ignored because a query with the same UUID was already received"),
+		metric.WithUnit("{query}"),
+	)
+	logMetricError(err)
+
+	m.executeDuration, err = meter.Float64Histogram(
+		"ovm.discovery.execute.duration",
+		metric.WithDescription("How long it takes to execute a query against a single adapter"),
+		metric.WithUnit("s"),
+	)
+	logMetricError(err)
+
+	m.items, err = meter.Int64Counter(
+		"ovm.discovery.execute.items",
+		metric.WithDescription("The number of items returned by adapters"),
+		metric.WithUnit("{item}"),
+	)
+	logMetricError(err)
+
+	m.errors, err = meter.Int64Counter(
+		"ovm.discovery.execute.errors",
+		metric.WithDescription("The number of errors returned by adapters"),
+		metric.WithUnit("{error}"),
+	)
+	logMetricError(err)
+
+	m.poolWait, err = meter.Float64Histogram(
+		"ovm.discovery.pool.wait",
+		metric.WithDescription("How long executions wait for a free slot in the execution pool"),
+		metric.WithUnit("s"),
+	)
+	logMetricError(err)
+
+	// Pool occupancy is read from the counters that are already maintained by
+	// ExecuteQuery. These include executions that are waiting for the pool
+	_, err = meter.Int64ObservableGauge(
+		"ovm.discovery.pool.occupancy",
+		metric.WithDescription("The number of executions that are running or waiting in each execution pool"),
+		metric.WithUnit("{execution}"),
+		metric.WithInt64Callback(func(ctx context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(listExecutionPoolCount.Load()), metric.WithAttributes(attribute.String("ovm.discovery.pool", "list")))
+			o.Observe(int64(getExecutionPoolCount.Load()), metric.WithAttributes(attribute.String("ovm.discovery.pool", "get")))
+			return nil
+		}),
+	)
+	logMetricError(err)
+
+	return m
+}
+
+// logMetricError Logs an error creating an instrument. This should only happen
+// if the instrument definition is invalid, in which case the instrument will
+// still be usable but won't record anything
+func logMetricError(err error) {
+	if err != nil {
+		log.WithError(err).Error("Error creating metric instrument")
+	}
+}
+
+// recordExecution Records the outcome of executing a query against an adapter
+func (m *engineMetrics) recordExecution(ctx context.Context, adapter Adapter, method string, duration time.Duration, numItems int64, numErrs int64) {
+	attrs := metric.WithAttributes(
+		attribute.String("ovm.adapter.name", adapter.Name()),
+		attribute.String("ovm.sdp.method", method),
+	)
+
+	m.executeDuration.Record(ctx, duration.Seconds(), attrs)
+	m.items.Add(ctx, numItems, attrs)
+	m.errors.Add(ctx, numErrs, attrs)
+}
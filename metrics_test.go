@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+
+	"github.com/overmindtech/sdp-go"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// findSum Returns the total of all data points for a given Int64 sum metric
+func findSum(t *testing.T, rm metricdata.ResourceMetrics, name string) int64 {
+	t.Helper()
+
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+
+			sum, ok := m.Data.(metricdata.Sum[int64])
+			if !ok {
+				t.Fatalf("expected %v to be an int64 sum, got %T", name, m.Data)
+			}
+
+			var total int64
+			for _, dp := range sum.DataPoints {
+				total += dp.Value
+			}
+
+			return total
+		}
+	}
+
+	return 0
+}
+
+func TestExecuteMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	previous := otel.GetMeterProvider()
+	otel.SetMeterProvider(provider)
+	t.Cleanup(func() {
+		otel.SetMeterProvider(previous)
+		_ = provider.Shutdown(context.Background())
+	})
+
+	e, err := NewEngine(&EngineConfig{SourceName: "TestExecuteMetrics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := TestAdapter{
+		ReturnType:   "person",
+		ReturnScopes: []string{"test"},
+	}
+
+	items := make(chan *sdp.Item, 10)
+	errs := make(chan *sdp.QueryError, 10)
+
+	e.Execute(context.Background(), &sdp.Query{
+		Type:   "person",
+		Method: sdp.QueryMethod_GET,
+		Query:  "Dylan",
+		Scope:  "test",
+	}, &adapter, items, errs)
+
+	e.Execute(context.Background(), &sdp.Query{
+		Type:   "person",
+		Method: sdp.QueryMethod_GET,
+		Query:  "Dylan",
+		Scope:  "error",
+	}, &adapter, items, errs)
+
+	var rm metricdata.ResourceMetrics
+	err = reader.Collect(context.Background(), &rm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := findSum(t, rm, "ovm.discovery.execute.items"); n != 1 {
+		t.Errorf("expected 1 item to be recorded, got %v", n)
+	}
+
+	if n := findSum(t, rm, "ovm.discovery.execute.errors"); n != 1 {
+		t.Errorf("expected 1 error to be recorded, got %v", n)
+	}
+}
@@ -0,0 +1,149 @@
+package discovery
+
+import (
+	"context"
+	"iter"
+	"runtime"
+
+	"github.com/overmindtech/sdp-go"
+	"github.com/sourcegraph/conc/pool"
+)
+
+// Query Runs a query against this engine's adapters and returns an iterator
+// over the results. Each iteration yields either an item or an error, never
+// both. The query is expanded, run in the engine's execution pools and
+// cancelled when the context is cancelled or the caller stops iterating.
+// Nothing is published to NATS so this can be used on an engine that hasn't
+// been started, for example from CLIs and tests
+//
+// Linked items are not followed, use a `QueryTracker` if this is required
+//
+//	for item, err := range e.Query(ctx, query) {
+//		if err != nil {
+//			// Handle the error
+//			continue
+//		}
+//		// Handle the item
+//	}
+func (e *Engine) Query(ctx context.Context, q *sdp.Query) iter.Seq2[*sdp.Item, *sdp.QueryError] {
+	return func(yield func(*sdp.Item, *sdp.QueryError) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		items := make(chan *sdp.Item)
+		errs := make(chan *sdp.QueryError)
+		errChan := make(chan error, 1)
+
+		go func() {
+			defer close(errChan)
+			defer LogRecoverToReturn(ctx, "Query -> ExecuteQuery")
+			errChan <- e.ExecuteQuery(ctx, q, items, errs)
+		}()
+
+		// Executions block until their results are received, so if the
+		// caller stops early the rest need to be discarded in the background
+		// until the cancellation has been noticed
+		stop := func() {
+			cancel()
+			go drainResults(items, errs)
+		}
+
+		var sentError bool
+		for items != nil || errs != nil {
+			select {
+			case item, ok := <-items:
+				if !ok {
+					items = nil
+					continue
+				}
+
+				if !yield(item, nil) {
+					stop()
+					return
+				}
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+
+				sentError = true
+				if !yield(nil, err) {
+					stop()
+					return
+				}
+			}
+		}
+
+		// Errors that happen before any adapters are run, such as the context
+		// already being cancelled, aren't sent on the channel
+		if err := <-errChan; err != nil && !sentError {
+			yield(nil, &sdp.QueryError{
+				UUID:          q.GetUUID(),
+				ErrorType:     sdp.QueryError_OTHER,
+				ErrorString:   err.Error(),
+				Scope:         q.GetScope(),
+				ResponderName: e.EngineConfig.SourceName,
+				ItemType:      q.GetType(),
+			})
+		}
+	}
+}
+
+// drainResults Discards everything sent on the channels until they are closed
+func drainResults(items <-chan *sdp.Item, errs <-chan *sdp.QueryError) {
+	for items != nil || errs != nil {
+		select {
+		case _, ok := <-items:
+			if !ok {
+				items = nil
+			}
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+			}
+		}
+	}
+}
+
+// executionPools Returns the pools that LIST and other executions are run in,
+// creating them if the engine hasn't been started so that queries can be run
+// without connecting to NATS
+func (e *Engine) executionPools() (list *pool.Pool, get *pool.Pool) {
+	e.poolsMutex.Lock()
+	defer e.poolsMutex.Unlock()
+
+	if e.listExecutionPool == nil || e.getExecutionPool == nil {
+		e.createPools()
+	}
+
+	return e.listExecutionPool, e.getExecutionPool
+}
+
+// resetPools Replaces the execution pools with new ones, sized using the
+// current config
+func (e *Engine) resetPools() {
+	e.poolsMutex.Lock()
+	defer e.poolsMutex.Unlock()
+
+	e.createPools()
+}
+
+// createPools Creates the execution pools. `poolsMutex` must be held by the
+// caller
+func (e *Engine) createPools() {
+	maxParallel := e.maxParallelExecutions()
+
+	e.listExecutionPool = pool.New().WithMaxGoroutines(maxParallel)
+	e.getExecutionPool = pool.New().WithMaxGoroutines(maxParallel)
+}
+
+// maxParallelExecutions Returns the number of executions that each pool runs
+// in parallel, falling back to the number of CPUs if this isn't configured
+func (e *Engine) maxParallelExecutions() int {
+	if e.EngineConfig.MaxParallelExecutions < 1 {
+		return runtime.NumCPU()
+	}
+
+	return e.EngineConfig.MaxParallelExecutions
+}
@@ -0,0 +1,174 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+)
+
+func TestEngineQuery(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := TestAdapter{
+		ReturnType:   "person",
+		ReturnScopes: []string{"test1", "test2"},
+	}
+
+	err = e.AddAdapters(&adapter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("returns items from all scopes", func(t *testing.T) {
+		var numItems int
+		for item, err := range e.Query(context.Background(), &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  sdp.WILDCARD,
+		}) {
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+
+			if item.GetMetadata().GetSourceName() != adapter.Name() {
+				t.Errorf("expected item to have metadata, got %v", item.GetMetadata())
+			}
+
+			numItems++
+		}
+
+		if numItems != 2 {
+			t.Errorf("expected 2 items, got %v", numItems)
+		}
+	})
+
+	t.Run("returns errors", func(t *testing.T) {
+		var numErrs int
+		for item, err := range e.Query(context.Background(), &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "nonexistent",
+		}) {
+			if item != nil {
+				t.Errorf("expected no items, got %v", item)
+			}
+
+			if err.GetErrorType() != sdp.QueryError_NOSCOPE {
+				t.Errorf("expected NOSCOPE error, got %v", err)
+			}
+
+			numErrs++
+		}
+
+		if numErrs != 1 {
+			t.Errorf("expected 1 error, got %v", numErrs)
+		}
+	})
+
+	t.Run("stopping early", func(t *testing.T) {
+		for range e.Query(context.Background(), &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  sdp.WILDCARD,
+		}) {
+			break
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		var numErrs int
+		for _, err := range e.Query(ctx, &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "test1",
+		}) {
+			if err == nil {
+				t.Error("expected an error")
+			}
+			numErrs++
+		}
+
+		if numErrs != 1 {
+			t.Errorf("expected 1 error, got %v", numErrs)
+		}
+	})
+
+	t.Run("slow adapter", func(t *testing.T) {
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = e.AddAdapters(&SpeedTestAdapter{QueryDelay: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		for range e.Query(ctx, &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "test",
+		}) {
+		}
+
+		if time.Since(start) > 500*time.Millisecond {
+			t.Errorf("expected query to stop when the context was cancelled, took %v", time.Since(start))
+		}
+	})
+}
+
+func TestExecutionPools(t *testing.T) {
+	t.Run("unconfigured parallelism falls back to the number of CPUs", func(t *testing.T) {
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// This is what happens when the engine starts, and would panic if
+		// the pools were sized with MaxParallelExecutions directly
+		e.resetPools()
+
+		list, get := e.executionPools()
+		if list == nil || get == nil {
+			t.Fatal("expected both pools to be created")
+		}
+		if n := list.MaxGoroutines(); n < 1 {
+			t.Errorf("expected the pools to allow at least 1 execution, got %v", n)
+		}
+	})
+
+	t.Run("pools are created on first use", func(t *testing.T) {
+		e, err := NewEngine(&EngineConfig{MaxParallelExecutions: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list, _ := e.executionPools()
+		if n := list.MaxGoroutines(); n != 3 {
+			t.Errorf("expected 3 executions to be allowed, got %v", n)
+		}
+
+		again, _ := e.executionPools()
+		if again != list {
+			t.Error("expected the existing pools to be reused")
+		}
+	})
+}
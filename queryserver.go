@@ -0,0 +1,239 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/overmindtech/sdp-go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// The maximum size of a query that will be accepted by the query server
+const maxQueryBodySize = 1024 * 1024
+
+// How long to wait for in-flight HTTP requests when stopping a server
+const httpServerShutdownTimeout = 10 * time.Second
+
+// startHTTPServer Starts an HTTP server in the background on the given
+// address. The listener is created before returning so that errors such as the
+// address being in use are returned to the caller
+func startHTTPServer(address string, handler http.Handler) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).WithField("address", address).Error("HTTP server failed")
+		}
+	}()
+
+	return server, nil
+}
+
+// checkLoopbackAddress Returns an error unless the address only listens on a
+// loopback interface, i.e. its host is "localhost" or a loopback IP. An empty
+// host would listen on every interface, so is rejected
+func checkLoopbackAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("error parsing address %v: %w", address, err)
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+
+	return fmt.Errorf("address %v is not a loopback address", address)
+}
+
+// stopHTTPServer Gracefully stops an HTTP server, if it was started
+func stopHTTPServer(server *http.Server) error {
+	if server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), httpServerShutdownTimeout)
+	defer cancel()
+
+	return server.Shutdown(ctx)
+}
+
+// QueryHandler Returns an HTTP handler that accepts an `sdp.Query` as JSON in
+// the body of a POST request, executes it against this engine, and streams the
+// resulting `sdp.QueryResponse` messages back as newline-delimited JSON. This
+// allows the engine to be queried directly without a NATS cluster, for example
+// during development or from internal tools.
+//
+// This handler is served on `EngineConfig.QueryServerAddress` when the engine
+// is started, but can also be mounted in an existing server
+func (e *Engine) QueryHandler() http.Handler {
+	return otelhttp.NewHandler(http.HandlerFunc(e.serveQuery), "QueryHandler")
+}
+
+// serveQuery Handles a single HTTP query request
+func (e *Engine) serveQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if e.IsDraining() {
+		http.Error(w, "engine is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxQueryBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	query := &sdp.Query{}
+	err = protojson.Unmarshal(body, query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error parsing query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Queries need a UUID for their response subject and so that they can be
+	// tracked
+	if len(query.GetUUID()) == 0 {
+		u := uuid.New()
+		query.UUID = u[:]
+	}
+
+	if len(e.sh.ExpandQuery(query)) == 0 {
+		http.Error(w, "no matching adapters found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	conn := newHTTPResponseConnection(w)
+	defer conn.Close()
+
+	// The request context is cancelled if the client goes away, which will
+	// also cancel the query
+	e.handleQuery(r.Context(), query, conn, conn)
+}
+
+// httpResponseConnection is an `sdp.EncodedConnection` that writes published
+// messages to an HTTP response as newline-delimited JSON rather than sending
+// them over NATS. Subjects are ignored since everything published relates to
+// the single query being served
+type httpResponseConnection struct {
+	NilConnection
+
+	w       http.ResponseWriter
+	flusher http.Flusher
+	closed  bool
+	mutex   sync.Mutex
+}
+
+// assert interface implementation
+var _ sdp.EncodedConnection = (*httpResponseConnection)(nil)
+
+func newHTTPResponseConnection(w http.ResponseWriter) *httpResponseConnection {
+	conn := &httpResponseConnection{
+		w: w,
+	}
+
+	if f, ok := w.(http.Flusher); ok {
+		conn.flusher = f
+	}
+
+	return conn
+}
+
+// Publish Writes the message to the response as a single line of JSON
+func (c *httpResponseConnection) Publish(ctx context.Context, subj string, m proto.Message) error {
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return errors.New("response has already been completed")
+	}
+
+	_, err = c.w.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+
+	if c.flusher != nil {
+		c.flusher.Flush()
+	}
+
+	return nil
+}
+
+// PublishMsg Writes the message data to the response as-is
+func (c *httpResponseConnection) PublishMsg(ctx context.Context, msg *nats.Msg) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return errors.New("response has already been completed")
+	}
+
+	_, err := c.w.Write(append(msg.Data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	if c.flusher != nil {
+		c.flusher.Flush()
+	}
+
+	return nil
+}
+
+// Status Returns nats.CLOSED once the response has been completed
+func (c *httpResponseConnection) Status() nats.Status {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nats.CLOSED
+	}
+
+	return nats.CONNECTED
+}
+
+// Close Stops any further writes to the response. This must be called before
+// the HTTP handler returns since the response can't be written to after that
+func (c *httpResponseConnection) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+}
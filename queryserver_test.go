@@ -0,0 +1,208 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/overmindtech/sdp-go"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestHTTPResponseConnection(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	conn := newHTTPResponseConnection(recorder)
+
+	err := conn.Publish(context.Background(), "query.test", &sdp.QueryResponse{
+		ResponseType: &sdp.QueryResponse_Error{
+			Error: &sdp.QueryError{
+				ErrorType:   sdp.QueryError_NOTFOUND,
+				ErrorString: "not found",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+
+	err = conn.Publish(context.Background(), "query.test", &sdp.QueryResponse{})
+	if err == nil {
+		t.Error("expected an error publishing after the connection was closed")
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(recorder.Body.Bytes()), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line, got %v", len(lines))
+	}
+
+	var response sdp.QueryResponse
+	err = protojson.Unmarshal(lines[0], &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.GetError().GetErrorString() != "not found" {
+		t.Errorf("expected error 'not found', got %v", response.GetError().GetErrorString())
+	}
+}
+
+func TestCheckLoopbackAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"localhost:8089", true},
+		{"127.0.0.1:8089", true},
+		{"[::1]:8089", true},
+		{":8089", false},
+		{"0.0.0.0:8089", false},
+		{"[::]:8089", false},
+		{"10.0.0.1:8089", false},
+		{"example.com:8089", false},
+		{"not a valid address", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := checkLoopbackAddress(tt.address)
+			if tt.allowed && err != nil {
+				t.Errorf("expected %v to be allowed, got %v", tt.address, err)
+			}
+			if !tt.allowed && err == nil {
+				t.Errorf("expected %v to be rejected", tt.address)
+			}
+		})
+	}
+}
+
+func TestQueryHandlerBadRequests(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(e.QueryHandler())
+	defer server.Close()
+
+	t.Run("wrong method", func(t *testing.T) {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("expected status %v, got %v", http.StatusMethodNotAllowed, resp.StatusCode)
+		}
+	})
+
+	t.Run("invalid body", func(t *testing.T) {
+		resp, err := http.Post(server.URL, "application/json", bytes.NewBufferString("not json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status %v, got %v", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+
+	t.Run("no matching adapters", func(t *testing.T) {
+		body, err := protojson.Marshal(&sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "test",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.Post(server.URL, "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected status %v, got %v", http.StatusNotFound, resp.StatusCode)
+		}
+	})
+}
+
+func TestQueryHandler(t *testing.T) {
+	SkipWithoutNats(t)
+
+	adapter := TestAdapter{
+		ReturnType:   "person",
+		ReturnScopes: []string{"test"},
+	}
+
+	e := newStartedEngine(t, "TestQueryHandler", nil, &adapter)
+
+	server := httptest.NewServer(e.QueryHandler())
+	defer server.Close()
+
+	body, err := protojson.Marshal(&sdp.Query{
+		Type:   "person",
+		Method: sdp.QueryMethod_GET,
+		Query:  "Dylan",
+		Scope:  "test",
+		RecursionBehaviour: &sdp.Query_RecursionBehaviour{
+			LinkDepth: 1,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(server.URL, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, resp.StatusCode)
+	}
+
+	var items []*sdp.Item
+	var finalState sdp.ResponderState
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var response sdp.QueryResponse
+		err = protojson.Unmarshal(scanner.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch r := response.GetResponseType().(type) {
+		case *sdp.QueryResponse_NewItem:
+			items = append(items, r.NewItem)
+		case *sdp.QueryResponse_Error:
+			t.Error(r.Error)
+		case *sdp.QueryResponse_Response:
+			finalState = r.Response.GetState()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The TestAdapter links every item to one other person, so with a link
+	// depth of 1 we expect 2 items
+	if len(items) != 2 {
+		t.Errorf("expected 2 items, got %v", len(items))
+	}
+
+	if finalState != sdp.ResponderState_COMPLETE {
+		t.Errorf("expected final state to be COMPLETE, got %v", finalState)
+	}
+}
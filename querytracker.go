@@ -3,9 +3,12 @@ package discovery
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sync"
 
 	"github.com/overmindtech/sdp-go"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 )
 
@@ -22,6 +25,34 @@ type QueryTracker struct {
 
 	// The engine that this is connected to, used for sending NATS messages
 	Engine *Engine
+
+	// The connection that items and errors should be published to. If this is
+	// nil the engine's NATS connection will be used
+	ResponseConnection sdp.EncodedConnection
+
+	// Optional callbacks that are called with each new item and error as they
+	// are found, after they have been published. These are never called
+	// concurrently, but they should return quickly since they block the query
+	OnItem  func(item *sdp.Item)
+	OnError func(err *sdp.QueryError)
+
+	// The GloballyUniqueNames of the items and the queries that have already
+	// been run so that linking doesn't return duplicates or loop forever.
+	// Results themselves aren't stored, and `seenItems` is nil when linking is
+	// disabled since there is nothing to deduplicate against
+	seenItems    map[string]bool
+	seenQueries  map[string]bool
+	resultsMutex sync.Mutex
+
+	// Serialises calls to the callbacks
+	callbackMutex sync.Mutex
+
+	// Internal callbacks used by `Execute()` to collect results
+	collectItem  func(item *sdp.Item)
+	collectError func(err *sdp.QueryError)
+
+	// Tracks linked queries that are still running
+	linkWG sync.WaitGroup
 }
 
 // Execute Executes a given item query and publishes results and errors on the
@@ -29,28 +60,101 @@ type QueryTracker struct {
 // error. The final error will be populated if all adapters failed, or some other
 // error was encountered while trying run the query
 //
+// Since this holds every result in memory, callers that don't need the full
+// list should use `Stream()` instead
+//
 // If the context is cancelled, all query work will stop
 func (qt *QueryTracker) Execute(ctx context.Context) ([]*sdp.Item, []*sdp.QueryError, error) {
+	sdpItems := make([]*sdp.Item, 0)
+	sdpErrs := make([]*sdp.QueryError, 0)
+
+	qt.collectItem = func(item *sdp.Item) {
+		sdpItems = append(sdpItems, item)
+	}
+	qt.collectError = func(err *sdp.QueryError) {
+		sdpErrs = append(sdpErrs, err)
+	}
+	defer func() {
+		qt.collectItem = nil
+		qt.collectError = nil
+	}()
+
+	err := qt.Stream(ctx)
+
+	return sdpItems, sdpErrs, err
+}
+
+// Stream Executes a given item query and publishes results and errors on the
+// relevant nats subjects as they are found, passing them to `OnItem` and
+// `OnError` if set. Unlike `Execute()` results are not kept once they have
+// been handled. If the query has a `LinkDepth` of zero nothing is kept per
+// result, so memory use stays flat regardless of the size of the result set.
+// When linking, the GloballyUniqueName of each item is kept for deduplication.
+// Returns an error if all adapters failed, or some other error was
+// encountered while trying run the query
+//
+// If the query has a `LinkDepth` greater than zero, the `LinkedItemQueries` of
+// each item that is found will also be executed (provided that this engine has
+// adapters that can answer them) until the link depth is exhausted. Items found
+// by these linked queries are deduplicated and published on the same subject
+// as the original query
+//
+// If the context is cancelled, all query work will stop
+func (qt *QueryTracker) Stream(ctx context.Context) error {
 	if qt.Query == nil {
-		return nil, nil, nil
+		return nil
 	}
 
 	if qt.Engine == nil {
-		return nil, nil, errors.New("no engine supplied, cannot execute")
+		return errors.New("no engine supplied, cannot execute")
 	}
 
 	span := trace.SpanFromContext(ctx)
 
+	qt.resultsMutex.Lock()
+	qt.seenItems = nil
+	if qt.Query.GetRecursionBehaviour().GetLinkDepth() > 0 {
+		qt.seenItems = make(map[string]bool)
+	}
+	qt.seenQueries = map[string]bool{
+		queryKey(qt.Query): true,
+	}
+	qt.resultsMutex.Unlock()
+
+	// Run the root query. Linked queries will be started in the background as
+	// items are found
+	err := qt.executeQuery(ctx, qt.Query, qt.Query.GetRecursionBehaviour().GetLinkDepth())
+
+	// Wait for all linked queries to complete
+	qt.linkWG.Wait()
+
+	qt.resultsMutex.Lock()
+	numQueries := len(qt.seenQueries)
+	qt.resultsMutex.Unlock()
+
+	span.SetAttributes(
+		attribute.Int("ovm.discovery.numLinkedQueries", numQueries-1),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return ctx.Err()
+}
+
+// executeQuery Executes a single query, publishing the results as they arrive.
+// If `linkDepth` is greater than zero, the linked item queries of any new items
+// will be executed in the background with a link depth of one less
+func (qt *QueryTracker) executeQuery(ctx context.Context, query *sdp.Query, linkDepth uint32) error {
 	items := make(chan *sdp.Item)
 	errs := make(chan *sdp.QueryError)
 	errChan := make(chan error)
-	sdpErrs := make([]*sdp.QueryError, 0)
-	sdpItems := make([]*sdp.Item, 0)
 
 	// Run the query
 	go func(e chan error) {
 		defer LogRecoverToReturn(ctx, "Execute -> ExecuteQuery")
-		e <- qt.Engine.ExecuteQuery(ctx, qt.Query, items, errs)
+		e <- qt.Engine.ExecuteQuery(ctx, query, items, errs)
 	}(errChan)
 
 	// Process the items and errors as they come in
@@ -58,40 +162,15 @@ func (qt *QueryTracker) Execute(ctx context.Context) ([]*sdp.Item, []*sdp.QueryE
 		select {
 		case item, ok := <-items:
 			if ok {
-				sdpItems = append(sdpItems, item)
-
-				if qt.Query.Subject() != "" && qt.Engine.natsConnection != nil {
-					// Respond with the Item
-					err := qt.Engine.natsConnection.Publish(ctx, qt.Query.Subject(), &sdp.QueryResponse{
-						ResponseType: &sdp.QueryResponse_NewItem{
-							NewItem: item,
-						},
-					})
-
-					if err != nil {
-						span.RecordError(err)
-						log.WithFields(log.Fields{
-							"error": err,
-						}).Error("Response publishing error")
-					}
+				if qt.handleItem(ctx, item) && linkDepth > 0 {
+					qt.linkItem(ctx, item, linkDepth-1)
 				}
 			} else {
 				items = nil
 			}
 		case err, ok := <-errs:
 			if ok {
-				sdpErrs = append(sdpErrs, err)
-
-				if qt.Query.Subject() != "" && qt.Engine.natsConnection != nil {
-					pubErr := qt.Engine.natsConnection.Publish(ctx, qt.Query.Subject(), &sdp.QueryResponse{ResponseType: &sdp.QueryResponse_Error{Error: err}})
-
-					if pubErr != nil {
-						span.RecordError(err)
-						log.WithFields(log.Fields{
-							"error": err,
-						}).Error("Error publishing item query error")
-					}
-				}
+				qt.handleError(ctx, err)
 			} else {
 				errs = nil
 			}
@@ -105,11 +184,151 @@ func (qt *QueryTracker) Execute(ctx context.Context) ([]*sdp.Item, []*sdp.QueryE
 	}
 
 	// Get the result of the execution
-	err := <-errChan
+	return <-errChan
+}
 
-	if err != nil {
-		return sdpItems, sdpErrs, err
+// handleItem Publishes an item and passes it to the callbacks. Returns false if
+// the item has already been seen as part of this query, in which case it is
+// discarded. Items are only deduplicated when linking
+func (qt *QueryTracker) handleItem(ctx context.Context, item *sdp.Item) bool {
+	qt.resultsMutex.Lock()
+	if qt.seenItems != nil {
+		if qt.seenItems[item.GloballyUniqueName()] {
+			qt.resultsMutex.Unlock()
+			return false
+		}
+		qt.seenItems[item.GloballyUniqueName()] = true
+	}
+	qt.resultsMutex.Unlock()
+
+	if conn := qt.responseConnection(); qt.Query.Subject() != "" && conn != nil {
+		// Respond with the Item
+		err := conn.Publish(ctx, qt.Query.Subject(), &sdp.QueryResponse{
+			ResponseType: &sdp.QueryResponse_NewItem{
+				NewItem: item,
+			},
+		})
+
+		if err != nil {
+			trace.SpanFromContext(ctx).RecordError(err)
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Response publishing error")
+		}
+	}
+
+	qt.callbackMutex.Lock()
+	defer qt.callbackMutex.Unlock()
+
+	if qt.collectItem != nil {
+		qt.collectItem(item)
+	}
+
+	if qt.OnItem != nil {
+		qt.OnItem(item)
+	}
+
+	return true
+}
+
+// handleError Publishes a query error and passes it to the callbacks
+func (qt *QueryTracker) handleError(ctx context.Context, err *sdp.QueryError) {
+	if conn := qt.responseConnection(); qt.Query.Subject() != "" && conn != nil {
+		pubErr := conn.Publish(ctx, qt.Query.Subject(), &sdp.QueryResponse{ResponseType: &sdp.QueryResponse_Error{Error: err}})
+
+		if pubErr != nil {
+			trace.SpanFromContext(ctx).RecordError(err)
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Error publishing item query error")
+		}
+	}
+
+	qt.callbackMutex.Lock()
+	defer qt.callbackMutex.Unlock()
+
+	if qt.collectError != nil {
+		qt.collectError(err)
+	}
+
+	if qt.OnError != nil {
+		qt.OnError(err)
+	}
+}
+
+// responseConnection Returns the connection that results should be published
+// to
+func (qt *QueryTracker) responseConnection() sdp.EncodedConnection {
+	if qt.ResponseConnection != nil {
+		return qt.ResponseConnection
 	}
 
-	return sdpItems, sdpErrs, ctx.Err()
+	return qt.Engine.natsConnection
+}
+
+// linkItem Starts executing the linked item queries of an item in the
+// background. Queries that this engine doesn't have any adapters for are
+// skipped since they will be answered by whichever source is responsible for
+// them, as are queries that have already been run as part of this query
+func (qt *QueryTracker) linkItem(ctx context.Context, item *sdp.Item, linkDepth uint32) {
+	followOnlyBlastPropagation := qt.Query.GetRecursionBehaviour().GetFollowOnlyBlastPropagation()
+
+	for _, liq := range item.GetLinkedItemQueries() {
+		if liq.GetQuery() == nil {
+			continue
+		}
+
+		if followOnlyBlastPropagation && !liq.GetBlastPropagation().GetIn() && !liq.GetBlastPropagation().GetOut() {
+			continue
+		}
+
+		linkedQuery := sdp.Query{}
+		liq.GetQuery().Copy(&linkedQuery)
+
+		// Linked queries inherit everything apart from what to query from
+		// the original query so that results are sent to the same place
+		linkedQuery.UUID = qt.Query.GetUUID()
+		linkedQuery.Deadline = qt.Query.GetDeadline()
+		linkedQuery.IgnoreCache = qt.Query.GetIgnoreCache()
+		linkedQuery.RecursionBehaviour = &sdp.Query_RecursionBehaviour{
+			LinkDepth:                  linkDepth,
+			FollowOnlyBlastPropagation: followOnlyBlastPropagation,
+		}
+
+		if len(qt.Engine.sh.ExpandQuery(&linkedQuery)) == 0 {
+			continue
+		}
+
+		qt.resultsMutex.Lock()
+		key := queryKey(&linkedQuery)
+		seen := qt.seenQueries[key]
+		qt.seenQueries[key] = true
+		qt.resultsMutex.Unlock()
+
+		if seen {
+			continue
+		}
+
+		qt.linkWG.Add(1)
+		go func() {
+			defer qt.linkWG.Done()
+			defer LogRecoverToReturn(ctx, "Execute -> linkItem")
+
+			err := qt.executeQuery(ctx, &linkedQuery, linkDepth)
+			if err != nil {
+				log.WithContext(ctx).WithError(err).WithFields(log.Fields{
+					"ovm.sdp.type":   linkedQuery.GetType(),
+					"ovm.sdp.method": linkedQuery.GetMethod().String(),
+					"ovm.sdp.query":  linkedQuery.GetQuery(),
+					"ovm.sdp.scope":  linkedQuery.GetScope(),
+				}).Debug("Linked query failed")
+			}
+		}()
+	}
+}
+
+// queryKey Returns a key that uniquely identifies what a query will return,
+// used for deduplicating linked queries
+func queryKey(q *sdp.Query) string {
+	return fmt.Sprintf("%v.%v.%v.%v", q.GetMethod(), q.GetScope(), q.GetType(), q.GetQuery())
 }
@@ -131,6 +131,39 @@ func TestExecute(t *testing.T) {
 		}
 	})
 
+	t.Run("With linking", func(t *testing.T) {
+		t.Parallel()
+
+		qt := QueryTracker{
+			Engine: e,
+			Query: &sdp.Query{
+				Type:   "person",
+				Method: sdp.QueryMethod_GET,
+				Query:  "Jeff",
+				RecursionBehaviour: &sdp.Query_RecursionBehaviour{
+					LinkDepth: 2,
+				},
+				Scope: "test",
+			},
+		}
+
+		items, errs, err := qt.Execute(context.Background())
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		for _, e := range errs {
+			t.Error(e)
+		}
+
+		// Each item links to one other person, so we should get the original
+		// item plus one for each level of linking
+		if l := len(items); l != 3 {
+			t.Errorf("expected 3 items, got %v", l)
+		}
+	})
+
 	t.Run("With no engine", func(t *testing.T) {
 		t.Parallel()
 
@@ -170,6 +203,101 @@ func TestExecute(t *testing.T) {
 
 }
 
+func TestStream(t *testing.T) {
+	adapter := TestAdapter{
+		ReturnType: "person",
+		ReturnScopes: []string{
+			"test",
+		},
+	}
+
+	e := newStartedEngine(t, "TestStream", nil, &adapter)
+
+	var items []*sdp.Item
+	var errs []*sdp.QueryError
+	var calling bool
+
+	qt := QueryTracker{
+		Engine: e,
+		Query: &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Jeff",
+			RecursionBehaviour: &sdp.Query_RecursionBehaviour{
+				LinkDepth: 2,
+			},
+			Scope: "test",
+		},
+		OnItem: func(item *sdp.Item) {
+			if calling {
+				t.Error("callbacks called concurrently")
+			}
+			calling = true
+			items = append(items, item)
+			calling = false
+		},
+		OnError: func(err *sdp.QueryError) {
+			errs = append(errs, err)
+		},
+	}
+
+	err := qt.Stream(context.Background())
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, e := range errs {
+		t.Error(e)
+	}
+
+	if l := len(items); l != 3 {
+		t.Errorf("expected 3 items, got %v", l)
+	}
+
+	t.Run("Execute also calls callbacks", func(t *testing.T) {
+		items = nil
+
+		found, _, err := qt.Execute(context.Background())
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		if len(found) != len(items) {
+			t.Errorf("expected callbacks to see the same %v items as Execute, got %v", len(found), len(items))
+		}
+	})
+
+	t.Run("nothing is kept per item without linking", func(t *testing.T) {
+		items = nil
+
+		qt := QueryTracker{
+			Engine: e,
+			Query: &sdp.Query{
+				Type:   "person",
+				Method: sdp.QueryMethod_LIST,
+				Scope:  "test",
+			},
+			OnItem: func(item *sdp.Item) {
+				items = append(items, item)
+			},
+		}
+
+		err := qt.Stream(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+
+		if len(items) == 0 {
+			t.Error("expected items")
+		}
+		if qt.seenItems != nil {
+			t.Errorf("expected no item names to be kept, got %v", len(qt.seenItems))
+		}
+	})
+}
+
 func TestTimeout(t *testing.T) {
 	adapter := SpeedTestAdapter{
 		QueryDelay: 100 * time.Millisecond,
@@ -0,0 +1,164 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// adapterThrottle Enforces the limits of a single `RateLimitedAdapter`
+type adapterThrottle struct {
+	// Buffered to the max concurrency, nil if concurrency is unlimited
+	slots chan struct{}
+
+	// Nil if the rate is unlimited
+	limiter *rate.Limiter
+}
+
+func newAdapterThrottle(adapter RateLimitedAdapter) *adapterThrottle {
+	t := &adapterThrottle{}
+
+	if n := adapter.MaxConcurrency(); n > 0 {
+		t.slots = make(chan struct{}, n)
+	}
+
+	if limit, burst := adapter.RateLimit(); limit != rate.Inf {
+		if burst < 1 {
+			burst = 1
+		}
+		t.limiter = rate.NewLimiter(limit, burst)
+	}
+
+	return t
+}
+
+// AcquireSlot Waits for a free slot. The time spent waiting is recorded on
+// the span in the context. If this returns without an error, `ReleaseSlot()`
+// must be called once the query is complete
+func (t *adapterThrottle) AcquireSlot(ctx context.Context) error {
+	if t.slots == nil {
+		return nil
+	}
+
+	start := time.Now()
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("ovm.adapter.concurrencyWaitMs", time.Since(start).Milliseconds()))
+
+	return nil
+}
+
+// ReleaseSlot Frees the slot taken by `AcquireSlot()`
+func (t *adapterThrottle) ReleaseSlot() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// Wait Waits for the rate limit to allow another call to the adapter. The
+// time spent waiting is recorded on the span in the context
+func (t *adapterThrottle) Wait(ctx context.Context) error {
+	if t.limiter == nil {
+		return nil
+	}
+
+	start := time.Now()
+	err := t.limiter.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64("ovm.adapter.rateLimitWaitMs", time.Since(start).Milliseconds()))
+
+	return nil
+}
+
+// limitRate Wraps an adapter call so that each call, including each retry,
+// waits for the rate limit
+func (t *adapterThrottle) limitRate(call adapterCall) adapterCall {
+	if t.limiter == nil {
+		return call
+	}
+
+	return func(ctx context.Context, q *sdp.Query, adapter Adapter, stream *QueryResultStream) {
+		err := t.Wait(ctx)
+		if err != nil {
+			// Avoid mentioning the rate limit since this would look like a
+			// transient error and be retried
+			stream.SendError(&sdp.QueryError{
+				ErrorType:   sdp.QueryError_OTHER,
+				ErrorString: fmt.Sprintf("gave up waiting to query adapter: %v", err),
+			})
+			return
+		}
+
+		call(ctx, q, adapter, stream)
+	}
+}
+
+// heldSlotKey is the context key that records which throttle the caller holds
+// a slot of
+type heldSlotKey struct{}
+
+// withHeldSlot Returns a context recording that the caller holds a slot of the
+// throttle, so that another slot isn't taken further down the call stack. Pass
+// nil to record that no slot is held
+func withHeldSlot(ctx context.Context, t *adapterThrottle) context.Context {
+	return context.WithValue(ctx, heldSlotKey{}, t)
+}
+
+// holdsSlot Returns whether the context records that a slot of the throttle
+// is held
+func holdsSlot(ctx context.Context, t *adapterThrottle) bool {
+	held, _ := ctx.Value(heldSlotKey{}).(*adapterThrottle)
+
+	return held != nil && held == t
+}
+
+// adapterThrottles Stores the throttle for each rate limited adapter. These
+// are created when the adapter is first queried and are keyed by adapter name
+type adapterThrottles struct {
+	throttles map[string]*adapterThrottle
+	mutex     sync.Mutex
+}
+
+// Get Returns the throttle for an adapter, or nil if the adapter doesn't
+// implement `RateLimitedAdapter`
+func (a *adapterThrottles) Get(adapter Adapter) *adapterThrottle {
+	limited, ok := adapter.(RateLimitedAdapter)
+	if !ok {
+		return nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.throttles == nil {
+		a.throttles = make(map[string]*adapterThrottle)
+	}
+
+	t, ok := a.throttles[adapter.Name()]
+	if !ok {
+		t = newAdapterThrottle(limited)
+		a.throttles[adapter.Name()] = t
+	}
+
+	return t
+}
+
+// Remove Deletes the throttle for an adapter. Executions that are already
+// holding the throttle are unaffected
+func (a *adapterThrottles) Remove(name string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.throttles, name)
+}
@@ -0,0 +1,257 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitedTestAdapter records the maximum number of queries it has seen
+// running in parallel
+type rateLimitedTestAdapter struct {
+	SpeedTestAdapter
+
+	ReturnMaxConcurrency int
+	ReturnLimit          rate.Limit
+	ReturnBurst          int
+
+	running    atomic.Int32
+	maxRunning atomic.Int32
+}
+
+func (r *rateLimitedTestAdapter) MaxConcurrency() int {
+	return r.ReturnMaxConcurrency
+}
+
+func (r *rateLimitedTestAdapter) RateLimit() (rate.Limit, int) {
+	return r.ReturnLimit, r.ReturnBurst
+}
+
+func (r *rateLimitedTestAdapter) Get(ctx context.Context, scope string, query string, ignoreCache bool) (*sdp.Item, error) {
+	n := r.running.Add(1)
+	defer r.running.Add(-1)
+
+	for {
+		current := r.maxRunning.Load()
+		if n <= current || r.maxRunning.CompareAndSwap(current, n) {
+			break
+		}
+	}
+
+	return r.SpeedTestAdapter.Get(ctx, scope, query, ignoreCache)
+}
+
+// executeParallel Runs `n` GET queries against the adapter in parallel and
+// returns how long they took
+func executeParallel(t *testing.T, e *Engine, adapter Adapter, n int) time.Duration {
+	t.Helper()
+
+	items := make(chan *sdp.Item, n)
+	errs := make(chan *sdp.QueryError, n)
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.Execute(context.Background(), &sdp.Query{
+				Type:   "person",
+				Method: sdp.QueryMethod_GET,
+				Query:  RandomName(),
+				Scope:  "test",
+			}, adapter, items, errs)
+		}()
+	}
+	wg.Wait()
+
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	return time.Since(start)
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := rateLimitedTestAdapter{
+		SpeedTestAdapter:     SpeedTestAdapter{QueryDelay: 50 * time.Millisecond},
+		ReturnMaxConcurrency: 2,
+		ReturnLimit:          rate.Inf,
+	}
+
+	executeParallel(t, e, &adapter, 6)
+
+	if n := adapter.maxRunning.Load(); n != 2 {
+		t.Errorf("expected at most 2 queries to run in parallel, got %v", n)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := rateLimitedTestAdapter{
+		SpeedTestAdapter: SpeedTestAdapter{QueryDelay: time.Millisecond},
+		ReturnLimit:      rate.Every(50 * time.Millisecond),
+		ReturnBurst:      1,
+	}
+
+	// The first query uses the burst, the other 4 have to wait 50ms each
+	duration := executeParallel(t, e, &adapter, 5)
+
+	if duration < 200*time.Millisecond {
+		t.Errorf("expected rate limiting to take at least 200ms, took %v", duration)
+	}
+}
+
+func TestRateLimitCancelled(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := rateLimitedTestAdapter{
+		SpeedTestAdapter:     SpeedTestAdapter{QueryDelay: time.Millisecond},
+		ReturnMaxConcurrency: 1,
+		ReturnLimit:          rate.Inf,
+	}
+
+	// Take the only slot so that the query has to wait
+	throttle := e.throttles.Get(&adapter)
+	err = throttle.AcquireSlot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer throttle.ReleaseSlot()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	items := make(chan *sdp.Item, 1)
+	errs := make(chan *sdp.QueryError, 1)
+
+	e.Execute(ctx, &sdp.Query{
+		Type:   "person",
+		Method: sdp.QueryMethod_GET,
+		Query:  "Dylan",
+		Scope:  "test",
+	}, &adapter, items, errs)
+
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", len(errs))
+	}
+
+	if len(items) != 0 {
+		t.Errorf("expected no items, got %v", len(items))
+	}
+
+	if adapter.running.Load() != 0 || adapter.maxRunning.Load() != 0 {
+		t.Error("expected the adapter not to have been queried")
+	}
+}
+
+// rateLimitedFlakyAdapter is a flakyTestAdapter with a rate limit
+type rateLimitedFlakyAdapter struct {
+	flakyTestAdapter
+
+	ReturnLimit rate.Limit
+}
+
+func (r *rateLimitedFlakyAdapter) MaxConcurrency() int {
+	return 0
+}
+
+func (r *rateLimitedFlakyAdapter) RateLimit() (rate.Limit, int) {
+	return r.ReturnLimit, 1
+}
+
+func TestRateLimitRetries(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := rateLimitedFlakyAdapter{
+		flakyTestAdapter: flakyTestAdapter{
+			Failures: 2,
+			Err:      statusCodeError{code: 503},
+			Policy:   &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Nanosecond},
+		},
+		ReturnLimit: rate.Every(50 * time.Millisecond),
+	}
+
+	// The first attempt uses the burst, the 2 retries have to wait 50ms each
+	duration := executeParallel(t, e, &adapter, 1)
+
+	if calls := adapter.calls.Load(); calls != 3 {
+		t.Errorf("expected 3 attempts, got %v", calls)
+	}
+
+	if duration < 100*time.Millisecond {
+		t.Errorf("expected each retry to wait for the rate limit, took %v", duration)
+	}
+}
+
+func TestThrottledAdapterDoesNotStarvePool(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{MaxParallelExecutions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slow := rateLimitedTestAdapter{
+		SpeedTestAdapter:     SpeedTestAdapter{QueryDelay: 100 * time.Millisecond, ReturnType: "slow"},
+		ReturnMaxConcurrency: 1,
+		ReturnLimit:          rate.Inf,
+	}
+	fast := TestAdapter{ReturnName: "fast", ReturnType: "fast"}
+
+	err = e.AddAdapters(&slow, &fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	// Build up a backlog of queries waiting for the slow adapter
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range e.Query(ctx, &sdp.Query{Type: "slow", Method: sdp.QueryMethod_GET, Query: RandomName(), Scope: "test"}) {
+			}
+		}()
+	}
+	defer wg.Wait()
+
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	for _, err := range e.Query(ctx, &sdp.Query{Type: "fast", Method: sdp.QueryMethod_GET, Query: "Dylan", Scope: "test"}) {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	if duration := time.Since(start); duration > 80*time.Millisecond {
+		t.Errorf("expected the fast adapter not to wait for the slow adapter's backlog, took %v", duration)
+	}
+
+	if n := slow.maxRunning.Load(); n != 1 {
+		t.Errorf("expected at most 1 slow query to run in parallel, got %v", n)
+	}
+}
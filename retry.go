@@ -0,0 +1,279 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultRetryMaxAttempts is the number of attempts made by a RetryPolicy that
+// doesn't specify MaxAttempts
+const DefaultRetryMaxAttempts = 3
+
+// DefaultRetryInitialBackoff is the base backoff of a RetryPolicy that doesn't
+// specify InitialBackoff
+const DefaultRetryInitialBackoff = 100 * time.Millisecond
+
+// DefaultRetryMaxBackoff is the maximum backoff of a RetryPolicy that doesn't
+// specify MaxBackoff
+const DefaultRetryMaxBackoff = 10 * time.Second
+
+// RetryPolicy determines how queries against an adapter are retried when the
+// adapter returns transient errors. An attempt is only retried if it returned
+// no items and all of its errors were transient, so items are never
+// duplicated. Backoff is exponential with full jitter, and no retry will be
+// made if the backoff would pass the deadline of the query.
+//
+// Note that while retries are enabled, errors sent on the stream are held
+// until the attempt that produced them is complete
+type RetryPolicy struct {
+	// The maximum number of attempts, including the first. Defaults to
+	// `DefaultRetryMaxAttempts`
+	MaxAttempts int
+
+	// The backoff before the first retry, this doubles for each subsequent
+	// retry. Defaults to `DefaultRetryInitialBackoff`
+	InitialBackoff time.Duration
+
+	// The maximum backoff between attempts. Defaults to
+	// `DefaultRetryMaxBackoff`
+	MaxBackoff time.Duration
+
+	// Determines whether an error is transient and should be retried.
+	// Defaults to `IsTransientError`
+	IsTransient func(err error) bool
+}
+
+// RetryingAdapter adapters that define a `RetryPolicy()` method will have
+// queries that fail with transient errors retried by the engine. This takes
+// precedence over `EngineConfig.RetryPolicy`. If this returns nil the engine's
+// policy is used
+type RetryingAdapter interface {
+	Adapter
+	RetryPolicy() *RetryPolicy
+}
+
+// maxAttempts Returns the maximum number of attempts, applying the default
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts > 0 {
+		return p.MaxAttempts
+	}
+
+	return DefaultRetryMaxAttempts
+}
+
+// isTransient Returns whether an error should be retried, applying the default
+func (p *RetryPolicy) isTransient(err error) bool {
+	if p.IsTransient != nil {
+		return p.IsTransient(err)
+	}
+
+	return IsTransientError(err)
+}
+
+// backoff Returns how long to wait after a given attempt (starting at 1). This
+// is a random duration between zero and the exponential backoff, capped at
+// MaxBackoff
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = DefaultRetryInitialBackoff
+	}
+
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultRetryMaxBackoff
+	}
+
+	ceiling := maxBackoff
+	// Avoid overflowing the shift for large attempt numbers
+	if attempt < 32 {
+		if exp := initial << (attempt - 1); exp > 0 && exp < maxBackoff {
+			ceiling = exp
+		}
+	}
+
+	return rand.N(ceiling + 1) // nolint:gosec // jitter doesn't need to be cryptographically secure
+}
+
+// transientMessages are substrings of error messages that indicate a transient
+// error. These are needed since adapters often convert errors into
+// `sdp.QueryError`s, losing the original error type
+var transientMessages = []string{
+	"throttl",
+	"too many requests",
+	"rate exceeded",
+	"rate limit",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"internal server error",
+	"bad gateway",
+	"service unavailable",
+	"gateway timeout",
+	"temporarily unavailable",
+}
+
+// IsTransientError Returns whether an error is likely to be resolved by
+// retrying. This includes throttling, connection errors, network timeouts and
+// HTTP 429 or 5xx responses. Cancellations, deadlines and NOTFOUND or NOSCOPE
+// errors are never transient
+func IsTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var sdpErr *sdp.QueryError
+	if errors.As(err, &sdpErr) {
+		switch sdpErr.GetErrorType() {
+		case sdp.QueryError_NOTFOUND, sdp.QueryError_NOSCOPE:
+			return false
+		}
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	// Many SDKs expose the status code of failed HTTP requests using one of
+	// these methods
+	var httpErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &httpErr) {
+		return isTransientStatusCode(httpErr.HTTPStatusCode())
+	}
+
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		return isTransientStatusCode(statusErr.StatusCode())
+	}
+
+	message := strings.ToLower(err.Error())
+	for _, m := range transientMessages {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTransientStatusCode Returns whether an HTTP status code indicates that the
+// request could succeed if retried
+func isTransientStatusCode(code int) bool {
+	return code == 429 || code >= 500
+}
+
+// retryPolicy Returns the retry policy for an adapter, or nil if queries
+// against it shouldn't be retried
+func (e *Engine) retryPolicy(adapter Adapter) *RetryPolicy {
+	if r, ok := adapter.(RetryingAdapter); ok {
+		if policy := r.RetryPolicy(); policy != nil {
+			return policy
+		}
+	}
+
+	return e.EngineConfig.RetryPolicy
+}
+
+// executeWithRetries Calls an adapter using `call`, retrying attempts that
+// return no items and only transient errors. Items are passed to the handler
+// as soon as they are found, errors are passed once it has been decided that
+// the attempt that produced them won't be retried
+func executeWithRetries(ctx context.Context, q *sdp.Query, adapter Adapter, policy *RetryPolicy, call adapterCall, streamOpts []QueryResultStreamOption, itemHandler ItemHandler, errHandler ErrHandler) {
+	span := trace.SpanFromContext(ctx)
+
+	attempt := 1
+	defer func() {
+		span.SetAttributes(attribute.Int("ovm.adapter.attempts", attempt))
+	}()
+
+	for ; ; attempt++ {
+		var itemsFound bool
+		var attemptErrs []error
+
+		stream := NewQueryResultStream(
+			func(item *sdp.Item) {
+				if item != nil {
+					itemsFound = true
+				}
+				itemHandler(item)
+			},
+			func(err error) {
+				if err != nil {
+					attemptErrs = append(attemptErrs, err)
+				}
+			},
+			streamOpts...,
+		)
+		call(ctx, q, adapter, stream)
+		// Closing waits for the handlers, so the results of this attempt are
+		// safe to read after this
+		stream.Close()
+
+		backoff, retry := policy.shouldRetry(ctx, attempt, itemsFound, attemptErrs)
+		if !retry {
+			for _, err := range attemptErrs {
+				errHandler(err)
+			}
+			return
+		}
+
+		span.AddEvent("Retrying query", trace.WithAttributes(
+			attribute.Int("ovm.adapter.attempt", attempt),
+			attribute.String("ovm.adapter.backoff", backoff.String()),
+			attribute.String("ovm.adapter.error", errors.Join(attemptErrs...).Error()),
+		))
+
+		log.WithContext(ctx).WithFields(log.Fields{
+			"ovm.adapter.name":    adapter.Name(),
+			"ovm.adapter.attempt": attempt,
+			"ovm.adapter.backoff": backoff.String(),
+		}).Debug("Retrying query after transient error")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			for _, err := range attemptErrs {
+				errHandler(err)
+			}
+			return
+		}
+	}
+}
+
+// shouldRetry Returns whether an attempt should be retried, and how long to
+// wait before doing so
+func (p *RetryPolicy) shouldRetry(ctx context.Context, attempt int, itemsFound bool, attemptErrs []error) (time.Duration, bool) {
+	if itemsFound || len(attemptErrs) == 0 || attempt >= p.maxAttempts() || ctx.Err() != nil {
+		return 0, false
+	}
+
+	for _, err := range attemptErrs {
+		if !p.isTransient(err) {
+			return 0, false
+		}
+	}
+
+	backoff := p.backoff(attempt)
+
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+		return 0, false
+	}
+
+	return backoff, true
+}
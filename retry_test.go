@@ -0,0 +1,257 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+)
+
+// flakyTestAdapter fails the first `Failures` queries with `Err`, then succeeds
+type flakyTestAdapter struct {
+	SpeedTestAdapter
+
+	Failures int32
+	Err      error
+	Policy   *RetryPolicy
+
+	calls atomic.Int32
+}
+
+func (f *flakyTestAdapter) RetryPolicy() *RetryPolicy {
+	return f.Policy
+}
+
+func (f *flakyTestAdapter) Get(ctx context.Context, scope string, query string, ignoreCache bool) (*sdp.Item, error) {
+	if f.calls.Add(1) <= f.Failures {
+		return nil, f.Err
+	}
+
+	return f.SpeedTestAdapter.Get(ctx, scope, query, ignoreCache)
+}
+
+// statusCodeError is an error that exposes an HTTP status code in the same way
+// as many SDKs
+type statusCodeError struct {
+	code int
+}
+
+func (s statusCodeError) Error() string {
+	return fmt.Sprintf("request failed with status %v", s.code)
+}
+
+func (s statusCodeError) HTTPStatusCode() int {
+	return s.code
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := map[string]struct {
+		err       error
+		transient bool
+	}{
+		"nil":                {nil, false},
+		"cancelled":          {context.Canceled, false},
+		"deadline":           {fmt.Errorf("wrapped: %w", context.DeadlineExceeded), false},
+		"connection reset":   {fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		"throttling message": {errors.New("ThrottlingException: Rate exceeded"), true},
+		"429":                {statusCodeError{429}, true},
+		"503":                {statusCodeError{503}, true},
+		"403":                {statusCodeError{403}, false},
+		"not found": {&sdp.QueryError{
+			ErrorType:   sdp.QueryError_NOTFOUND,
+			ErrorString: "service unavailable",
+		}, false},
+		"converted throttling": {&sdp.QueryError{
+			ErrorType:   sdp.QueryError_OTHER,
+			ErrorString: "Too Many Requests",
+		}, true},
+		"other": {errors.New("access denied"), false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if actual := IsTransientError(test.err); actual != test.transient {
+				t.Errorf("expected %v, got %v", test.transient, actual)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	}
+
+	for attempt := 1; attempt < 100; attempt++ {
+		backoff := policy.backoff(attempt)
+
+		if backoff < 0 || backoff > policy.MaxBackoff {
+			t.Fatalf("attempt %v: backoff %v outside of 0-%v", attempt, backoff, policy.MaxBackoff)
+		}
+
+		if attempt == 1 && backoff > policy.InitialBackoff {
+			t.Errorf("expected first backoff to be at most %v, got %v", policy.InitialBackoff, backoff)
+		}
+	}
+}
+
+func TestExecuteRetries(t *testing.T) {
+	execute := func(t *testing.T, e *Engine, adapter Adapter, ctx context.Context) ([]*sdp.Item, []*sdp.QueryError) {
+		t.Helper()
+
+		items := make(chan *sdp.Item, 10)
+		errs := make(chan *sdp.QueryError, 10)
+
+		e.Execute(ctx, &sdp.Query{
+			Type:   "person",
+			Method: sdp.QueryMethod_GET,
+			Query:  "Dylan",
+			Scope:  "test",
+		}, adapter, items, errs)
+
+		close(items)
+		close(errs)
+
+		var foundItems []*sdp.Item
+		for item := range items {
+			foundItems = append(foundItems, item)
+		}
+
+		var foundErrs []*sdp.QueryError
+		for err := range errs {
+			foundErrs = append(foundErrs, err)
+		}
+
+		return foundItems, foundErrs
+	}
+
+	newEngine := func(t *testing.T, policy *RetryPolicy) *Engine {
+		t.Helper()
+
+		e, err := NewEngine(&EngineConfig{RetryPolicy: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return e
+	}
+
+	fastPolicy := &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+	}
+
+	t.Run("retries transient errors", func(t *testing.T) {
+		e := newEngine(t, fastPolicy)
+		adapter := flakyTestAdapter{
+			Failures: 2,
+			Err:      errors.New("throttling"),
+		}
+
+		items, errs := execute(t, e, &adapter, context.Background())
+
+		if len(items) != 1 || len(errs) != 0 {
+			t.Errorf("expected 1 item and no errors, got %v items and errors %v", len(items), errs)
+		}
+
+		if calls := adapter.calls.Load(); calls != 3 {
+			t.Errorf("expected 3 calls, got %v", calls)
+		}
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		e := newEngine(t, fastPolicy)
+		adapter := flakyTestAdapter{
+			Failures: 5,
+			Err:      errors.New("throttling"),
+		}
+
+		items, errs := execute(t, e, &adapter, context.Background())
+
+		if len(items) != 0 || len(errs) != 1 {
+			t.Errorf("expected no items and 1 error, got %v items and errors %v", len(items), errs)
+		}
+
+		if calls := adapter.calls.Load(); calls != 3 {
+			t.Errorf("expected 3 calls, got %v", calls)
+		}
+	})
+
+	t.Run("does not retry permanent errors", func(t *testing.T) {
+		e := newEngine(t, fastPolicy)
+		adapter := flakyTestAdapter{
+			Failures: 1,
+			Err:      errors.New("access denied"),
+		}
+
+		_, errs := execute(t, e, &adapter, context.Background())
+
+		if len(errs) != 1 {
+			t.Errorf("expected 1 error, got %v", errs)
+		}
+
+		if calls := adapter.calls.Load(); calls != 1 {
+			t.Errorf("expected 1 call, got %v", calls)
+		}
+	})
+
+	t.Run("does not retry without a policy", func(t *testing.T) {
+		e := newEngine(t, nil)
+		adapter := flakyTestAdapter{
+			Failures: 1,
+			Err:      errors.New("throttling"),
+		}
+
+		execute(t, e, &adapter, context.Background())
+
+		if calls := adapter.calls.Load(); calls != 1 {
+			t.Errorf("expected 1 call, got %v", calls)
+		}
+	})
+
+	t.Run("adapter policy takes precedence", func(t *testing.T) {
+		e := newEngine(t, nil)
+		adapter := flakyTestAdapter{
+			Failures: 1,
+			Err:      errors.New("throttling"),
+			Policy:   fastPolicy,
+		}
+
+		items, _ := execute(t, e, &adapter, context.Background())
+
+		if len(items) != 1 {
+			t.Errorf("expected 1 item, got %v", len(items))
+		}
+	})
+
+	t.Run("respects the deadline", func(t *testing.T) {
+		e := newEngine(t, &RetryPolicy{
+			MaxAttempts:    10,
+			InitialBackoff: time.Second,
+			MaxBackoff:     time.Second,
+			// Force the backoff to be long by making every error transient
+			IsTransient: func(err error) bool { return true },
+		})
+		adapter := flakyTestAdapter{
+			Failures: 10,
+			Err:      errors.New("anything"),
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		execute(t, e, &adapter, ctx)
+
+		if time.Since(start) > time.Second {
+			t.Errorf("expected retries to stop at the deadline, took %v", time.Since(start))
+		}
+	})
+}
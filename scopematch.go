@@ -0,0 +1,132 @@
+package discovery
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// maxExpansionDecisions is the maximum number of expansion decisions that are
+// recorded on a span, so that wildcard queries against engines with many
+// adapters don't create huge spans
+const maxExpansionDecisions = 100
+
+// expansionDecision Records whether a query was routed to an adapter scope,
+// and why
+type expansionDecision struct {
+	Adapter      string
+	AdapterScope string
+
+	// Whether the query will be run against the adapter
+	Matched bool
+
+	// The scope that the adapter will be queried with, if matched
+	Scope string
+
+	// Why the query was or wasn't matched
+	Reason string
+}
+
+func (d expansionDecision) String() string {
+	result := "skipped"
+	if d.Matched {
+		result = fmt.Sprintf("matched as %v", d.Scope)
+	}
+
+	return fmt.Sprintf("%v [%v]: %v (%v)", d.Adapter, d.AdapterScope, result, d.Reason)
+}
+
+// isGlobScopesAdapter Returns whether an adapter's scopes should be treated as
+// glob patterns
+func isGlobScopesAdapter(adapter Adapter) bool {
+	if g, ok := adapter.(GlobScopesAdapter); ok {
+		return g.GlobScopes()
+	}
+
+	return false
+}
+
+// isGlobPattern Returns whether a scope contains any glob pattern syntax
+func isGlobPattern(scope string) bool {
+	return strings.ContainsAny(scope, `*?[\`)
+}
+
+// matchScope Decides whether a query for `queryScope` should be run against
+// one of an adapter's scopes, and which scope the adapter should be queried
+// with. The rules are, in order:
+//
+//   - Adapter scopes of "*" match everything, and are queried with the
+//     query's scope
+//   - Wildcard query scopes match every scope of visible adapters. Glob
+//     patterns can't be expanded so are queried with the wildcard
+//   - Glob patterns, for adapters that implement `GlobScopesAdapter`, match
+//     using `path.Match()` and are queried with the query's scope
+//   - Otherwise the scopes must be equal
+func matchScope(adapter Adapter, adapterScope string, queryScope string) expansionDecision {
+	decision := expansionDecision{
+		Adapter:      adapter.Name(),
+		AdapterScope: adapterScope,
+	}
+
+	isHidden := false
+	if hs, ok := adapter.(HiddenAdapter); ok {
+		isHidden = hs.Hidden()
+	}
+
+	isGlob := isGlobScopesAdapter(adapter) && isGlobPattern(adapterScope)
+
+	switch {
+	case IsWildcard(adapterScope):
+		decision.Matched = true
+		decision.Scope = queryScope
+		decision.Reason = "adapter supports all scopes"
+	case IsWildcard(queryScope) && isHidden:
+		decision.Reason = "hidden adapters don't respond to wildcard scopes"
+	case IsWildcard(queryScope) && isGlob:
+		decision.Matched = true
+		decision.Scope = queryScope
+		decision.Reason = "wildcard query scope, adapter scope is a pattern"
+	case IsWildcard(queryScope):
+		decision.Matched = true
+		decision.Scope = adapterScope
+		decision.Reason = "wildcard query scope"
+	case isGlob:
+		matched, err := path.Match(adapterScope, queryScope)
+
+		switch {
+		case err != nil:
+			decision.Reason = fmt.Sprintf("invalid pattern: %v", err)
+		case matched:
+			decision.Matched = true
+			decision.Scope = queryScope
+			decision.Reason = "pattern match"
+		default:
+			decision.Reason = "pattern doesn't match"
+		}
+	case adapterScope == queryScope:
+		decision.Matched = true
+		decision.Scope = adapterScope
+		decision.Reason = "exact match"
+	default:
+		decision.Reason = "scope doesn't match"
+	}
+
+	return decision
+}
+
+// expansionDecisionStrings Returns the decisions as strings for recording on
+// a span, along with the number that were left out to keep the span small
+func expansionDecisionStrings(decisions []expansionDecision) ([]string, int) {
+	truncated := 0
+	if len(decisions) > maxExpansionDecisions {
+		truncated = len(decisions) - maxExpansionDecisions
+		decisions = decisions[:maxExpansionDecisions]
+	}
+
+	strs := make([]string, len(decisions))
+	for i, decision := range decisions {
+		strs[i] = decision.String()
+	}
+
+	return strs, truncated
+}
@@ -0,0 +1,103 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/overmindtech/sdp-go"
+)
+
+// globScopesTestAdapter is a TestAdapter whose scopes are glob patterns
+type globScopesTestAdapter struct {
+	TestAdapter
+}
+
+func (g *globScopesTestAdapter) GlobScopes() bool {
+	return true
+}
+
+func TestMatchScope(t *testing.T) {
+	exact := &TestAdapter{}
+	hidden := &TestAdapter{IsHidden: true}
+	glob := &globScopesTestAdapter{}
+
+	tests := []struct {
+		name         string
+		adapter      Adapter
+		adapterScope string
+		queryScope   string
+		matched      bool
+		scope        string
+	}{
+		{"exact", exact, "123", "123", true, "123"},
+		{"prefix", exact, "123", "1", false, ""},
+		{"substring", exact, "dev-2", "dev", false, ""},
+		{"adapter wildcard", exact, "*", "123", true, "123"},
+		{"query wildcard", exact, "123", "*", true, "123"},
+		{"hidden query wildcard", hidden, "123", "*", false, ""},
+		{"hidden adapter wildcard", hidden, "*", "*", true, "*"},
+		{"pattern without opting in", exact, "123.*", "123.eu-west-2", false, ""},
+		{"pattern", glob, "123.*", "123.eu-west-2", true, "123.eu-west-2"},
+		{"pattern doesn't match", glob, "123.*", "456.eu-west-2", false, ""},
+		{"pattern with query wildcard", glob, "123.*", "*", true, "*"},
+		{"plain scope on glob adapter", glob, "dev", "dev-2", false, ""},
+		{"character class", glob, "dev-[0-9]", "dev-2", true, "dev-2"},
+		{"invalid pattern", glob, "dev-[", "dev-[", false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := matchScope(test.adapter, test.adapterScope, test.queryScope)
+
+			if decision.Matched != test.matched {
+				t.Errorf("expected matched to be %v, got %v", test.matched, decision)
+			}
+
+			if decision.Scope != test.scope {
+				t.Errorf("expected scope %q, got %v", test.scope, decision)
+			}
+
+			if decision.Reason == "" {
+				t.Error("expected a reason")
+			}
+		})
+	}
+}
+
+func TestExpandQueryDecisions(t *testing.T) {
+	sh := NewAdapterHost()
+
+	err := sh.AddAdapters(
+		&TestAdapter{ReturnName: "exact", ReturnScopes: []string{"dev", "dev-2"}},
+		&globScopesTestAdapter{TestAdapter{ReturnName: "glob", ReturnType: "glob", ReturnScopes: []string{"dev-*"}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expanded, decisions := sh.expandQuery(&sdp.Query{
+		Type:  sdp.WILDCARD,
+		Scope: "dev-2",
+	})
+
+	if len(expanded) != 2 {
+		t.Errorf("expected 2 queries, got %v", len(expanded))
+	}
+
+	for query := range expanded {
+		if query.GetScope() != "dev-2" {
+			t.Errorf("expected expanded scope to be dev-2, got %v", query.GetScope())
+		}
+	}
+
+	if len(decisions) != 3 {
+		t.Errorf("expected a decision for each adapter scope, got %v", decisions)
+	}
+
+	t.Run("truncation", func(t *testing.T) {
+		strs, truncated := expansionDecisionStrings(make([]expansionDecision, maxExpansionDecisions+5))
+
+		if len(strs) != maxExpansionDecisions || truncated != 5 {
+			t.Errorf("expected %v decisions with 5 truncated, got %v and %v", maxExpansionDecisions, len(strs), truncated)
+		}
+	})
+}
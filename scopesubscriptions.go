@@ -0,0 +1,170 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/overmindtech/sdp-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// scopeSubjectPrefixes are the prefixes of the subjects that queries,
+// cancellations and cache invalidations for a specific scope are sent on
+var scopeSubjectPrefixes = []string{"request.scope.", "cancel.scope.", invalidationSubjectPrefix}
+
+// isScopeSubject Returns whether a subject is for queries, cancellations or
+// cache invalidations in a specific scope
+func isScopeSubject(subject string) bool {
+	for _, prefix := range scopeSubjectPrefixes {
+		if strings.HasPrefix(subject, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validSubjectScope Returns whether a scope can be used in a NATS subject
+// without breaking the subject or being interpreted as a wildcard
+func validSubjectScope(scope string) bool {
+	if strings.ContainsAny(scope, " \t\r\n") {
+		return false
+	}
+
+	for _, token := range strings.Split(scope, ".") {
+		if token == "" || token == "*" || token == ">" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// subscribedScopes Returns the scopes that the engine should receive queries
+// for, sorted. If any adapter supports all scopes, has a glob pattern scope,
+// or has a scope that can't be used in a NATS subject, this is just ">" which
+// matches every scope
+func (e *Engine) subscribedScopes() []string {
+	scopes := make(map[string]bool)
+
+	for _, adapter := range e.sh.Adapters() {
+		isGlob := isGlobScopesAdapter(adapter)
+
+		for _, scope := range adapter.Scopes() {
+			if IsWildcard(scope) || (isGlob && isGlobPattern(scope)) || !validSubjectScope(scope) {
+				return []string{">"}
+			}
+
+			scopes[scope] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(scopes))
+	for scope := range scopes {
+		sorted = append(sorted, scope)
+	}
+	sort.Strings(sorted)
+
+	return sorted
+}
+
+// updateScopeSubscriptions Subscribes to queries, cancellations and cache
+// invalidations for the scopes that the engine's adapters serve, and unsubscribes from scopes that
+// are no longer served. This means that the engine doesn't receive queries for
+// scopes that it can't answer. Does nothing if the engine isn't connected, or
+// is draining
+func (e *Engine) updateScopeSubscriptions() error {
+	e.scopeSubscriptionsMutex.Lock()
+	defer e.scopeSubscriptionsMutex.Unlock()
+
+	if e.IsDraining() {
+		return nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, scope := range e.subscribedScopes() {
+		for _, prefix := range scopeSubjectPrefixes {
+			wanted[prefix+scope] = true
+		}
+	}
+
+	existing, connected, err := e.unsubscribeScopes(wanted)
+	if err != nil || !connected {
+		return err
+	}
+
+	subjects := make([]string, 0, len(wanted))
+	for subject := range wanted {
+		if !existing[subject] {
+			subjects = append(subjects, subject)
+		}
+	}
+	sort.Strings(subjects)
+
+	for _, subject := range subjects {
+		switch {
+		case strings.HasPrefix(subject, "request."):
+			err = e.subscribe(subject, sdp.NewAsyncRawQueryHandler("ScopeQueryHandler", func(ctx context.Context, _ *nats.Msg, i *sdp.Query) {
+				e.HandleQuery(ctx, i)
+			}))
+		case strings.HasPrefix(subject, "cancel."):
+			err = e.subscribe(subject, sdp.NewAsyncRawCancelQueryHandler("ScopeCancelQueryHandler", func(ctx context.Context, _ *nats.Msg, i *sdp.CancelQuery) {
+				e.HandleCancelQuery(ctx, i)
+			}))
+		default:
+			// Every replica needs to evict its own cache, so invalidations
+			// don't use the queue group
+			err = e.subscribeAll(subject, e.handleCacheInvalidation)
+		}
+		if err != nil {
+			return fmt.Errorf("error subscribing to %v: %w", subject, err)
+		}
+	}
+
+	return nil
+}
+
+// unsubscribeScopes Removes scope subscriptions whose subjects aren't wanted.
+// Returns the subjects of the scope subscriptions that remain, and whether the
+// engine is connected
+func (e *Engine) unsubscribeScopes(wanted map[string]bool) (map[string]bool, bool, error) {
+	e.natsConnectionMutex.Lock()
+	defer e.natsConnectionMutex.Unlock()
+
+	existing := make(map[string]bool)
+
+	if e.natsConnection == nil || e.natsConnection.Underlying() == nil {
+		return existing, false, nil
+	}
+
+	remaining := make([]*nats.Subscription, 0, len(e.subscriptions))
+
+	for i, subscription := range e.subscriptions {
+		if !isScopeSubject(subscription.Subject) {
+			remaining = append(remaining, subscription)
+			continue
+		}
+
+		if wanted[subscription.Subject] {
+			remaining = append(remaining, subscription)
+			existing[subscription.Subject] = true
+			continue
+		}
+
+		err := subscription.Unsubscribe()
+		if err != nil {
+			// Keep the subscriptions that haven't been checked yet
+			e.subscriptions = append(remaining, e.subscriptions[i:]...)
+			return nil, true, fmt.Errorf("error unsubscribing from %v: %w", subscription.Subject, err)
+		}
+
+		log.WithField("subject", subscription.Subject).Debug("Unsubscribed from scope")
+	}
+
+	e.subscriptions = remaining
+
+	return existing, true, nil
+}
@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestValidSubjectScope(t *testing.T) {
+	tests := map[string]bool{
+		"test":                   true,
+		"123456789012.eu-west-2": true,
+		"*":                      false,
+		"":                       false,
+		"foo.*":                  false,
+		"foo.>":                  false,
+		"foo..bar":               false,
+		"has space":              false,
+	}
+
+	for scope, expected := range tests {
+		if actual := validSubjectScope(scope); actual != expected {
+			t.Errorf("expected validSubjectScope(%q) to be %v, got %v", scope, expected, actual)
+		}
+	}
+}
+
+func TestSubscribedScopes(t *testing.T) {
+	t.Run("specific scopes", func(t *testing.T) {
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = e.AddAdapters(
+			&TestAdapter{ReturnName: "a", ReturnType: "a", ReturnScopes: []string{"b", "a"}},
+			&TestAdapter{ReturnName: "b", ReturnType: "b", ReturnScopes: []string{"a"}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if scopes := e.subscribedScopes(); !slices.Equal(scopes, []string{"a", "b"}) {
+			t.Errorf("expected [a b], got %v", scopes)
+		}
+	})
+
+	t.Run("wildcard scope", func(t *testing.T) {
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = e.AddAdapters(
+			&TestAdapter{ReturnName: "a", ReturnType: "a", ReturnScopes: []string{"a"}},
+			&TestAdapter{ReturnName: "b", ReturnType: "b", ReturnScopes: []string{"*"}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if scopes := e.subscribedScopes(); !slices.Equal(scopes, []string{">"}) {
+			t.Errorf("expected [>], got %v", scopes)
+		}
+	})
+}
+
+func TestScopeSubscriptions(t *testing.T) {
+	SkipWithoutNats(t)
+
+	subjects := func(e *Engine) []string {
+		e.natsConnectionMutex.Lock()
+		defer e.natsConnectionMutex.Unlock()
+
+		subjects := make([]string, 0)
+		for _, subscription := range e.subscriptions {
+			if isScopeSubject(subscription.Subject) {
+				subjects = append(subjects, subscription.Subject)
+			}
+		}
+		slices.Sort(subjects)
+
+		return subjects
+	}
+
+	adapter := TestAdapter{ReturnName: "first", ReturnScopes: []string{"first"}}
+	e := newStartedEngine(t, "TestScopeSubscriptions", nil, &adapter)
+
+	// The meta adapters respond in the global scope
+	expected := []string{
+		"cancel.scope.first",
+		"cancel.scope.global",
+		"invalidate.scope.first",
+		"invalidate.scope.global",
+		"request.scope.first",
+		"request.scope.global",
+	}
+	if actual := subjects(e); !slices.Equal(actual, expected) {
+		t.Errorf("expected subscriptions %v, got %v", expected, actual)
+	}
+
+	t.Run("adding an adapter", func(t *testing.T) {
+		err := e.AddAdapters(&TestAdapter{ReturnName: "second", ReturnType: "second", ReturnScopes: []string{"second"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual := subjects(e); !slices.Contains(actual, "request.scope.second") {
+			t.Errorf("expected a subscription for the new scope, got %v", actual)
+		}
+	})
+
+	t.Run("removing an adapter", func(t *testing.T) {
+		e.RemoveAdapters(&adapter)
+
+		if actual := subjects(e); slices.Contains(actual, "request.scope.first") {
+			t.Errorf("expected the subscription for the removed scope to be removed, got %v", actual)
+		}
+	})
+
+	t.Run("adding a wildcard adapter", func(t *testing.T) {
+		err := e.AddAdapters(&TestAdapter{ReturnName: "wildcard", ReturnType: "wildcard", ReturnScopes: []string{"*"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"cancel.scope.>", "invalidate.scope.>", "request.scope.>"}
+		if actual := subjects(e); !slices.Equal(actual, expected) {
+			t.Errorf("expected subscriptions %v, got %v", expected, actual)
+		}
+	})
+}
@@ -81,17 +81,22 @@ type TestAdapter struct {
 }
 
 // assert interface implementation
-var _ CachingAdapter = (*TestAdapter)(nil)
+var _ CacheProvider = (*TestAdapter)(nil)
 
-// ClearCalls Clears the call counters between tests
+// ClearCalls Clears the call counters and cache between tests
 func (s *TestAdapter) ClearCalls() {
+	s.resetCalls()
+	s.cache.Clear()
+}
+
+// resetCalls Clears the call counters, keeping the cache
+func (s *TestAdapter) resetCalls() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	s.ListCalls = make([][]string, 0)
 	s.SearchCalls = make([][]string, 0)
 	s.GetCalls = make([][]string, 0)
-	s.cache.Clear()
 }
 
 func (s *TestAdapter) Type() string {
@@ -107,6 +112,10 @@ func (s *TestAdapter) Name() string {
 }
 
 func (s *TestAdapter) DefaultCacheDuration() time.Duration {
+	if s.CacheDuration != 0 {
+		return s.CacheDuration
+	}
+
 	return 100 * time.Millisecond
 }
 
@@ -127,7 +136,7 @@ func (s *TestAdapter) ensureCache() {
 	}
 }
 
-func (s *TestAdapter) Cache() *sdpcache.Cache {
+func (s *TestAdapter) Cache() Cache {
 	s.ensureCache()
 	return s.cache
 }
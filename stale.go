@@ -0,0 +1,199 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// staleResults Returns the results of a query that expired less than
+// `EngineConfig.StaleWhileRevalidate` ago, if the adapter's cache implements
+// `StaleCache`. Results are only returned if they have expired, since fresh
+// results are served by the adapter from its cache as usual
+func (e *Engine) staleResults(ctx context.Context, q *sdp.Query, adapter Adapter) (StaleLookup, bool) {
+	maxStale := e.EngineConfig.StaleWhileRevalidate
+	if maxStale <= 0 || q.GetIgnoreCache() {
+		return StaleLookup{}, false
+	}
+
+	cache, ok := adapterCache(adapter).(StaleCache)
+	if !ok {
+		return StaleLookup{}, false
+	}
+
+	lookup := cache.LookupStale(ctx, adapter.Name(), q.GetMethod(), q.GetScope(), q.GetType(), q.GetQuery(), maxStale)
+
+	return lookup, lookup.Hit && lookup.Stale
+}
+
+// revalidations Tracks the stale results that are being refreshed in the
+// background, so that only one refresh runs for each query and so that they
+// can be cancelled and waited for when the engine stops
+type revalidations struct {
+	running map[coalesceKey]context.CancelFunc
+	mutex   sync.Mutex
+}
+
+// start Returns whether a refresh should be started for the key, marking it
+// as running if so. `cancel` is called if the refresh is cancelled by
+// `cancelAll()`
+func (r *revalidations) start(key coalesceKey, cancel context.CancelFunc) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.running == nil {
+		r.running = make(map[coalesceKey]context.CancelFunc)
+	}
+
+	if _, ok := r.running[key]; ok {
+		return false
+	}
+
+	r.running[key] = cancel
+
+	return true
+}
+
+// finish Marks the refresh for a key as complete
+func (r *revalidations) finish(key coalesceKey) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.running, key)
+}
+
+// cancelAll Cancels all running refreshes
+func (r *revalidations) cancelAll() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, cancel := range r.running {
+		cancel()
+	}
+}
+
+// numRunning Returns the number of refreshes that are running
+func (r *revalidations) numRunning() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.running)
+}
+
+// wait Waits up to `timeout` for all running refreshes to finish. Returns
+// false if some are still running
+func (r *revalidations) wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for r.numRunning() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(drainPollInterval)
+	}
+
+	return true
+}
+
+// revalidate Refreshes stale results in the background by running the query
+// against the adapter with the cache ignored, which stores fresh results in
+// the adapter's cache. The refresh isn't cancelled when the query that found
+// the stale results finishes, but is limited to `MaxRequestTimeout` and is
+// cancelled when the engine stops. Refreshes aren't started while the engine
+// is draining
+func (e *Engine) revalidate(ctx context.Context, q *sdp.Query, adapter Adapter) {
+	refresh := &sdp.Query{}
+	q.Copy(refresh)
+	refresh.IgnoreCache = true
+
+	// The refresh outlives the query that found the stale results, so takes
+	// its own adapter concurrency slot below rather than sharing the query's
+	ctx, cancel := context.WithTimeout(withHeldSlot(context.WithoutCancel(ctx), nil), e.maxRequestTimeout())
+
+	key := newCoalesceKey(refresh, adapter)
+	if !e.revalidations.start(key, cancel) {
+		cancel()
+		return
+	}
+
+	// This is checked after the refresh is registered, since `Stop()` sets
+	// the engine as draining before cancelling the registered refreshes
+	if e.IsDraining() {
+		e.revalidations.finish(key)
+		cancel()
+		return
+	}
+
+	e.adapterUsage.acquire(adapter.Name())
+
+	go func() {
+		defer LogRecoverToReturn(ctx, "revalidate")
+		defer cancel()
+		defer e.revalidations.finish(key)
+		defer e.adapterUsage.release(adapter.Name())
+
+		// Link to the query that found the stale results rather than being
+		// part of its trace
+		ctx, span := tracer.Start(ctx, "Revalidate",
+			trace.WithNewRoot(),
+			trace.WithLinks(trace.LinkFromContext(ctx)),
+			trace.WithAttributes(
+				attribute.String("ovm.adapter.queryMethod", refresh.GetMethod().String()),
+				attribute.String("ovm.adapter.queryType", refresh.GetType()),
+				attribute.String("ovm.adapter.queryScope", refresh.GetScope()),
+				attribute.String("ovm.adapter.name", adapter.Name()),
+				attribute.String("ovm.adapter.query", refresh.GetQuery()),
+			),
+		)
+		defer span.End()
+
+		// Take the adapter's concurrency slot before joining any identical
+		// execution, in the same way as `ExecuteQuery()`. Otherwise this could
+		// lead an execution without a slot while a follower holds the only
+		// one, and neither could make progress
+		if throttle := e.throttles.Get(adapter); throttle != nil {
+			if err := throttle.AcquireSlot(ctx); err != nil {
+				span.RecordError(err)
+				return
+			}
+			defer throttle.ReleaseSlot()
+
+			ctx = withHeldSlot(ctx, throttle)
+		}
+
+		var numErrs atomic.Int32
+		e.executeCoalesced(ctx, refresh, adapter,
+			func(*sdp.Item) {},
+			func(err error) {
+				if err != nil {
+					numErrs.Add(1)
+					span.RecordError(err)
+				}
+			},
+		)
+
+		if numErrs.Load() > 0 {
+			log.WithContext(ctx).WithFields(log.Fields{
+				"ovm.adapter.name": adapter.Name(),
+				"ovm.sdp.type":     refresh.GetType(),
+				"ovm.sdp.scope":    refresh.GetScope(),
+			}).Debug("Errors while revalidating stale cache results")
+		}
+	}()
+}
+
+// maxRequestTimeout Returns the longest that a query can run for
+func (e *Engine) maxRequestTimeout() time.Duration {
+	if e.MaxRequestTimeout > 0 {
+		return e.MaxRequestTimeout
+	}
+
+	return DefaultMaxRequestTimeout
+}
@@ -0,0 +1,304 @@
+package discovery
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/overmindtech/sdp-go"
+	"golang.org/x/time/rate"
+)
+
+// staleTestAdapter is a TestAdapter that caches GETs in a `MemoryCache` for a
+// short time. Calls after the first block until `release` is closed
+type staleTestAdapter struct {
+	TestAdapter
+
+	memoryCache *MemoryCache
+	numCalls    atomic.Int32
+	release     chan struct{}
+}
+
+func newStaleTestAdapter() *staleTestAdapter {
+	cache := NewMemoryCache()
+	cache.StaleRetention = time.Minute
+
+	return &staleTestAdapter{
+		TestAdapter: TestAdapter{ReturnName: "stale"},
+		memoryCache: cache,
+		release:     make(chan struct{}),
+	}
+}
+
+func (s *staleTestAdapter) Cache() Cache {
+	return s.memoryCache
+}
+
+func (s *staleTestAdapter) Get(ctx context.Context, scope string, query string, ignoreCache bool) (*sdp.Item, error) {
+	hit, ck, items, qErr := s.memoryCache.Lookup(ctx, s.Name(), sdp.QueryMethod_GET, scope, s.Type(), query, ignoreCache)
+	if qErr != nil {
+		return nil, qErr
+	}
+	if hit {
+		return items[0], nil
+	}
+
+	if s.numCalls.Add(1) > 1 {
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	item := s.NewTestItem(scope, query)
+	s.memoryCache.StoreItem(item, 10*time.Millisecond, ck)
+
+	return item, nil
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	query := &sdp.Query{
+		Type:   "person",
+		Method: sdp.QueryMethod_GET,
+		Query:  "Dylan",
+		Scope:  "test",
+	}
+
+	// get Runs the query and returns the single item
+	get := func(t *testing.T, e *Engine) *sdp.Item {
+		t.Helper()
+
+		var found *sdp.Item
+		for item, err := range e.Query(context.Background(), query) {
+			if err != nil {
+				t.Error(err)
+				continue
+			}
+			found = item
+		}
+		if found == nil {
+			t.Fatal("expected an item")
+		}
+
+		return found
+	}
+
+	t.Run("expired results are served while being refreshed", func(t *testing.T) {
+		adapter := newStaleTestAdapter()
+		e, err := NewEngine(&EngineConfig{StaleWhileRevalidate: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.AddAdapters(adapter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		first := get(t, e)
+		time.Sleep(20 * time.Millisecond)
+
+		// The refresh is blocked, so this would hang if the query waited
+		// for it
+		stale := get(t, e)
+
+		if stale.GetMetadata().GetTimestamp().AsTime().After(first.GetMetadata().GetTimestamp().AsTime()) {
+			t.Errorf("expected the stale item to be timestamped when it was discovered (%v), got %v", first.GetMetadata().GetTimestamp().AsTime(), stale.GetMetadata().GetTimestamp().AsTime())
+		}
+
+		// Only one refresh runs even if stale results are served again
+		get(t, e)
+
+		close(adapter.release)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if e.revalidations.numRunning() == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("expected the result to be refreshed in the background")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		if calls := adapter.numCalls.Load(); calls != 2 {
+			t.Errorf("expected 2 adapter calls, got %v", calls)
+		}
+
+		lookup := adapter.memoryCache.LookupStale(context.Background(), adapter.Name(), sdp.QueryMethod_GET, "test", "person", "Dylan", time.Minute)
+		if !lookup.Stored.After(first.GetMetadata().GetTimestamp().AsTime()) {
+			t.Error("expected the refreshed result to be stored")
+		}
+	})
+
+	t.Run("refreshes are cancelled when the engine stops", func(t *testing.T) {
+		adapter := newStaleTestAdapter()
+		e, err := NewEngine(&EngineConfig{StaleWhileRevalidate: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.AddAdapters(adapter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		get(t, e)
+		time.Sleep(20 * time.Millisecond)
+
+		// Starts a refresh that blocks until cancelled
+		get(t, e)
+
+		if running := e.revalidations.numRunning(); running != 1 {
+			t.Fatalf("expected 1 refresh to be running, got %v", running)
+		}
+
+		e.revalidations.cancelAll()
+
+		if !e.revalidations.wait(5 * time.Second) {
+			t.Error("expected the refresh to finish once cancelled")
+		}
+	})
+
+	t.Run("refreshes are not started while draining", func(t *testing.T) {
+		adapter := newStaleTestAdapter()
+		close(adapter.release)
+
+		e, err := NewEngine(&EngineConfig{StaleWhileRevalidate: time.Minute})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.AddAdapters(adapter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		get(t, e)
+		time.Sleep(20 * time.Millisecond)
+
+		e.draining.Store(true)
+		e.revalidate(context.Background(), query, adapter)
+
+		if running := e.revalidations.numRunning(); running != 0 {
+			t.Errorf("expected no refreshes to be running, got %v", running)
+		}
+		if calls := adapter.numCalls.Load(); calls != 1 {
+			t.Errorf("expected 1 adapter call, got %v", calls)
+		}
+	})
+
+	t.Run("expired results are not served by default", func(t *testing.T) {
+		adapter := newStaleTestAdapter()
+		close(adapter.release)
+
+		e, err := NewEngine(&EngineConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = e.AddAdapters(adapter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		first := get(t, e)
+		time.Sleep(20 * time.Millisecond)
+		second := get(t, e)
+
+		if calls := adapter.numCalls.Load(); calls != 2 {
+			t.Errorf("expected the adapter to be called again, got %v calls", calls)
+		}
+		if !second.GetMetadata().GetTimestamp().AsTime().After(first.GetMetadata().GetTimestamp().AsTime()) {
+			t.Error("expected a fresh item")
+		}
+	})
+}
+
+func TestMemoryCacheStaleRetention(t *testing.T) {
+	cache := NewMemoryCache()
+	cache.StaleRetention = time.Minute
+
+	ctx := context.Background()
+	_, ck, _, _ := cache.Lookup(ctx, "test", sdp.QueryMethod_GET, "test", "person", "Dylan", false)
+	cache.StoreItem((&TestAdapter{}).NewTestItem("test", "Dylan"), -time.Second, ck)
+
+	if hit, _, _, _ := cache.Lookup(ctx, "test", sdp.QueryMethod_GET, "test", "person", "Dylan", false); hit {
+		t.Error("expected expired results not to be returned by Lookup")
+	}
+
+	lookup := cache.LookupStale(ctx, "test", sdp.QueryMethod_GET, "test", "person", "Dylan", time.Minute)
+	if !lookup.Hit || !lookup.Stale || len(lookup.Items) != 1 {
+		t.Errorf("expected a stale hit, got %+v", lookup)
+	}
+
+	if stats := cache.Purge(time.Now()); stats.NumPurged != 0 {
+		t.Errorf("expected the result to be retained, purged %v", stats.NumPurged)
+	}
+	if stats := cache.Purge(time.Now().Add(time.Minute)); stats.NumPurged != 1 {
+		t.Errorf("expected the result to be purged after the retention, purged %v", stats.NumPurged)
+	}
+}
+
+func TestRevalidateHoldsConcurrencySlot(t *testing.T) {
+	adapter := &rateLimitedTestAdapter{
+		SpeedTestAdapter:     SpeedTestAdapter{QueryDelay: 10 * time.Millisecond},
+		ReturnMaxConcurrency: 1,
+		ReturnLimit:          rate.Inf,
+	}
+
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.AddAdapters(adapter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := &sdp.Query{
+		Type:        "person",
+		Method:      sdp.QueryMethod_GET,
+		Query:       "Dylan",
+		Scope:       "test",
+		IgnoreCache: true,
+	}
+
+	// A user query ignoring the cache has taken the only slot, as it would in
+	// `ExecuteQuery()`, when a revalidation of the same query starts
+	throttle := e.throttles.Get(adapter)
+	err = throttle.AcquireSlot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.revalidate(context.Background(), query, adapter)
+	time.Sleep(50 * time.Millisecond)
+
+	// The user query must not end up following a revalidation that is
+	// waiting for the slot it holds
+	ctx, cancel := context.WithTimeout(withHeldSlot(context.Background(), throttle), 2*time.Second)
+	defer cancel()
+
+	var numItems int
+	e.executeCoalesced(ctx, query, adapter,
+		func(item *sdp.Item) {
+			if item != nil {
+				numItems++
+			}
+		},
+		func(err error) {
+			if err != nil {
+				t.Error(err)
+			}
+		},
+	)
+	throttle.ReleaseSlot()
+
+	if numItems != 1 {
+		t.Errorf("expected 1 item, got %v", numItems)
+	}
+
+	if !e.revalidations.wait(5 * time.Second) {
+		t.Error("expected the revalidation to finish once the slot was free")
+	}
+}
@@ -2,7 +2,9 @@ package tracing
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"runtime/debug"
 	"slices"
@@ -12,15 +14,20 @@ import (
 
 	"github.com/MrAlias/otel-schema-utils/schema"
 	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"go.opentelemetry.io/contrib/detectors/aws/ec2"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
@@ -192,6 +199,97 @@ func ShutdownTracer() {
 	}
 }
 
+var mp *sdkmetric.MeterProvider
+var promRegistry *prometheus.Registry
+
+// MeterOptions Configures how `InitMeter` exports metrics. OTLP and
+// Prometheus can be enabled independently, but at least one must be
+type MeterOptions struct {
+	// Export metrics using OTLP over HTTP
+	OTLP bool
+
+	// Options for the OTLP exporter, such as the endpoint. Only used if
+	// `OTLP` is set
+	OTLPOptions []otlpmetrichttp.Option
+
+	// Make metrics available for scraping by Prometheus using
+	// `PrometheusHandler()`
+	Prometheus bool
+}
+
+// InitMeter Initialises the global MeterProvider, exporting metrics in the
+// ways enabled in the options
+func InitMeter(options MeterOptions) error {
+	if !options.OTLP && !options.Prometheus {
+		return errors.New("no metric exporters enabled, at least one of OTLP or Prometheus is required")
+	}
+
+	providerOpts := []sdkmetric.Option{
+		sdkmetric.WithResource(tracingResource()),
+	}
+
+	if options.OTLP {
+		otlpExp, err := otlpmetrichttp.New(context.Background(), options.OTLPOptions...)
+		if err != nil {
+			return fmt.Errorf("creating OTLP metric exporter: %w", err)
+		}
+
+		providerOpts = append(providerOpts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(otlpExp)))
+	}
+
+	var registry *prometheus.Registry
+	if options.Prometheus {
+		registry = prometheus.NewRegistry()
+		promExp, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+		if err != nil {
+			return fmt.Errorf("creating Prometheus metric exporter: %w", err)
+		}
+
+		providerOpts = append(providerOpts, sdkmetric.WithReader(promExp))
+	}
+
+	mp = sdkmetric.NewMeterProvider(providerOpts...)
+	promRegistry = registry
+	otel.SetMeterProvider(mp)
+
+	return nil
+}
+
+// PrometheusEnabled Returns whether `InitMeter` has been called with
+// Prometheus enabled, and therefore whether `PrometheusHandler()` will serve
+// any metrics
+func PrometheusEnabled() bool {
+	return promRegistry != nil
+}
+
+// PrometheusHandler Returns an HTTP handler that serves metrics in the
+// Prometheus exposition format. Returns 404 for all requests if `InitMeter`
+// hasn't been called with Prometheus enabled
+func PrometheusHandler() http.Handler {
+	if promRegistry == nil {
+		return http.NotFoundHandler()
+	}
+
+	return promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{})
+}
+
+// nolint: contextcheck // deliberate use of local context to avoid getting tangled up in any existing timeouts or cancels
+func ShutdownMeter() {
+	if mp == nil {
+		return
+	}
+
+	// ensure that we do not wait indefinitely on the meter provider shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := mp.ForceFlush(ctx); err != nil {
+		log.WithContext(ctx).Printf("Error flushing meter provider: %v", err)
+	}
+	if err := mp.Shutdown(ctx); err != nil {
+		log.WithContext(ctx).Printf("Error shutting down meter provider: %v", err)
+	}
+}
+
 type UserAgentSampler struct {
 	userAgents          []string
 	innerSampler        sdktrace.Sampler
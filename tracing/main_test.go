@@ -1,7 +1,11 @@
 package tracing
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"go.opentelemetry.io/otel"
 )
 
 func TestTracingResource(t *testing.T) {
@@ -10,3 +14,48 @@ func TestTracingResource(t *testing.T) {
 		t.Error("Could not initialize tracing resource. Check the log!")
 	}
 }
+
+func TestPrometheusHandlerWithoutMeter(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	PrometheusHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected status %v before InitMeter, got %v", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestInitMeter(t *testing.T) {
+	t.Run("no exporters", func(t *testing.T) {
+		if err := InitMeter(MeterOptions{}); err == nil {
+			t.Error("expected an error")
+		}
+	})
+
+	t.Run("Prometheus without OTLP", func(t *testing.T) {
+		previous := otel.GetMeterProvider()
+		t.Cleanup(func() {
+			ShutdownMeter()
+			promRegistry = nil
+			otel.SetMeterProvider(previous)
+		})
+
+		if PrometheusEnabled() {
+			t.Error("expected Prometheus to be disabled before InitMeter")
+		}
+
+		if err := InitMeter(MeterOptions{Prometheus: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		if !PrometheusEnabled() {
+			t.Error("expected Prometheus to be enabled")
+		}
+
+		recorder := httptest.NewRecorder()
+		PrometheusHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		if recorder.Code != http.StatusOK {
+			t.Errorf("expected status %v, got %v", http.StatusOK, recorder.Code)
+		}
+	})
+}
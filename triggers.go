@@ -0,0 +1,212 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/overmindtech/sdp-go"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Trigger defines a query that should be run by the engine when an item
+// matching the `Type` and `UniqueAttributeValueRegex` is discovered anywhere on
+// the NATS network. This allows adapters to be triggered by the discovery of
+// relevant items rather than having to be queried directly
+type Trigger struct {
+	// The type of item that this trigger should fire for
+	Type string
+
+	// The trigger will only fire if both the type and the
+	// UniqueAttributeValueRegex match. If this is nil, all items of the given
+	// type will match
+	UniqueAttributeValueRegex *regexp.Regexp
+
+	// When both of the above match, this function will be called. It should
+	// return the query that should be executed by the engine. Only the
+	// `Type`, `Method` and `Query` need to be set, the rest will be filled in
+	// from the `Metadata.SourceQuery` of the originating item so that the
+	// results are sent to whoever originated the query. If the scope is not
+	// set, the scope of the originating item will be used
+	QueryGenerator func(in *sdp.Item) (*sdp.Query, error)
+}
+
+// ErrTriggerNotMatched is returned by `ProcessItem` when the item does not
+// match the trigger
+var ErrTriggerNotMatched = errors.New("item does not match trigger")
+
+// ProcessItem Checks whether an item matches the trigger and if so, returns
+// the fully populated query that should be executed. Returns
+// `ErrTriggerNotMatched` if the trigger should not fire
+func (t *Trigger) ProcessItem(item *sdp.Item) (*sdp.Query, error) {
+	if item == nil || t.QueryGenerator == nil {
+		return nil, ErrTriggerNotMatched
+	}
+
+	if item.GetType() != t.Type {
+		return nil, ErrTriggerNotMatched
+	}
+
+	if t.UniqueAttributeValueRegex != nil && !t.UniqueAttributeValueRegex.MatchString(item.UniqueAttributeValue()) {
+		return nil, ErrTriggerNotMatched
+	}
+
+	// Without a source query we have no way of knowing where to send the
+	// results
+	sourceQuery := item.GetMetadata().GetSourceQuery()
+	if sourceQuery == nil {
+		return nil, errors.New("item has no Metadata.SourceQuery, cannot determine where to send results")
+	}
+
+	generated, err := t.QueryGenerator(item)
+	if err != nil {
+		return nil, err
+	}
+
+	if generated == nil {
+		return nil, errors.New("trigger QueryGenerator returned a nil query")
+	}
+
+	// Fill in everything apart from what to query from the originating query
+	q := sdp.Query{}
+	sourceQuery.Copy(&q)
+
+	q.Type = generated.GetType()
+	q.Method = generated.GetMethod()
+	q.Query = generated.GetQuery()
+
+	if generated.GetScope() != "" {
+		q.Scope = generated.GetScope()
+	} else {
+		q.Scope = item.GetScope()
+	}
+
+	return &q, nil
+}
+
+// AddTriggers Adds triggers to the engine. Triggers are subscribed to when
+// the engine connects to NATS, so triggers must be added before the engine is
+// started, or the engine must be restarted for them to take effect
+func (e *Engine) AddTriggers(triggers ...Trigger) {
+	e.triggersMutex.Lock()
+	defer e.triggersMutex.Unlock()
+
+	e.triggers = append(e.triggers, triggers...)
+}
+
+// ClearTriggers Removes all triggers from the engine
+func (e *Engine) ClearTriggers() {
+	e.triggersMutex.Lock()
+	defer e.triggersMutex.Unlock()
+
+	e.triggers = nil
+}
+
+// hasTriggers Returns whether any triggers have been registered
+func (e *Engine) hasTriggers() bool {
+	e.triggersMutex.RLock()
+	defer e.triggersMutex.RUnlock()
+
+	return len(e.triggers) > 0
+}
+
+// ProcessTriggers Checks an item against all registered triggers and
+// executes the resulting queries in the background. This is called for every
+// item that the engine sees on the NATS network, but can also be called
+// manually. Items found by this engine's own adapters are ignored, since the
+// engine also sees the results of the queries that its triggers start, and a
+// trigger that matched its own results would fire forever
+func (e *Engine) ProcessTriggers(ctx context.Context, item *sdp.Item) {
+	if item == nil || e.sh.hasAdapterNamed(item.GetMetadata().GetSourceName()) {
+		return
+	}
+
+	e.triggersMutex.RLock()
+	triggers := make([]Trigger, len(e.triggers))
+	copy(triggers, e.triggers)
+	e.triggersMutex.RUnlock()
+
+	for _, trigger := range triggers {
+		q, err := trigger.ProcessItem(item)
+		if err != nil {
+			if !errors.Is(err, ErrTriggerNotMatched) {
+				log.WithContext(ctx).WithError(err).WithFields(log.Fields{
+					"ovm.trigger.type": trigger.Type,
+					"ovm.item.gun":     item.GloballyUniqueName(),
+				}).Error("Error processing trigger")
+			}
+
+			continue
+		}
+
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("ovm.trigger.type", trigger.Type),
+			attribute.String("ovm.trigger.item", item.GloballyUniqueName()),
+		)
+
+		// Run the query in the background using a context that isn't tied to
+		// the message that triggered it. The query's own deadline still
+		// applies. Triggered queries share the UUID of the query that found
+		// the item, so they mustn't be treated as duplicates, and are
+		// cancelled when that query is
+		go func(q *sdp.Query) {
+			defer LogRecoverToReturn(ctx, "ProcessTriggers")
+			e.runQuery(context.WithoutCancel(ctx), q, e.queryConnection(), nil, true)
+		}(q)
+	}
+}
+
+// trackTriggeredQuery Tracks a query started by a trigger under the UUID of
+// the query that found the triggering item. Many triggered queries can share
+// a UUID, for example if the same item is seen on more than one subject
+func (e *Engine) trackTriggeredQuery(u uuid.UUID, qt *QueryTracker) {
+	e.trackedQueriesMutex.Lock()
+	defer e.trackedQueriesMutex.Unlock()
+
+	if e.triggeredQueries == nil {
+		e.triggeredQueries = make(map[uuid.UUID]map[*QueryTracker]struct{})
+	}
+
+	if e.triggeredQueries[u] == nil {
+		e.triggeredQueries[u] = make(map[*QueryTracker]struct{})
+	}
+
+	e.triggeredQueries[u][qt] = struct{}{}
+}
+
+// deleteTriggeredQuery Stops tracking a query started by a trigger
+func (e *Engine) deleteTriggeredQuery(u uuid.UUID, qt *QueryTracker) {
+	e.trackedQueriesMutex.Lock()
+	defer e.trackedQueriesMutex.Unlock()
+
+	delete(e.triggeredQueries[u], qt)
+
+	if len(e.triggeredQueries[u]) == 0 {
+		delete(e.triggeredQueries, u)
+	}
+}
+
+// numTriggeredQueries Returns the number of running queries that were
+// started by triggers for the given UUID
+func (e *Engine) numTriggeredQueries(u uuid.UUID) int {
+	e.trackedQueriesMutex.RLock()
+	defer e.trackedQueriesMutex.RUnlock()
+
+	return len(e.triggeredQueries[u])
+}
+
+// cancelTriggeredQueries Cancels all queries that were started by triggers
+// for the given UUID
+func (e *Engine) cancelTriggeredQueries(u uuid.UUID) {
+	e.trackedQueriesMutex.RLock()
+	defer e.trackedQueriesMutex.RUnlock()
+
+	for qt := range e.triggeredQueries[u] {
+		if qt.Cancel != nil {
+			qt.Cancel()
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/overmindtech/sdp-go"
+	"github.com/overmindtech/sdp-go/auth"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func newTriggerTestItem(itemType string, name string, scope string) *sdp.Item {
+	attributes, _ := sdp.ToAttributes(map[string]interface{}{
+		"name": name,
+	})
+
+	u := uuid.New()
+
+	return &sdp.Item{
+		Type:            itemType,
+		UniqueAttribute: "name",
+		Attributes:      attributes,
+		Scope:           scope,
+		Metadata: &sdp.Metadata{
+			SourceQuery: &sdp.Query{
+				Type:   itemType,
+				Method: sdp.QueryMethod_GET,
+				Query:  name,
+				Scope:  scope,
+				UUID:   u[:],
+				RecursionBehaviour: &sdp.Query_RecursionBehaviour{
+					LinkDepth: 3,
+				},
+				IgnoreCache: true,
+			},
+		},
+	}
+}
+
+func TestTriggerProcessItem(t *testing.T) {
+	trigger := Trigger{
+		Type:                      "person",
+		UniqueAttributeValueRegex: regexp.MustCompile(`^[Dd]ylan$`),
+		QueryGenerator: func(in *sdp.Item) (*sdp.Query, error) {
+			if in.GetScope() != "something" {
+				return nil, errors.New("only 'something' scope supported")
+			}
+
+			return &sdp.Query{
+				Type:   "dog",
+				Method: sdp.QueryMethod_SEARCH,
+				Query:  "pug",
+			}, nil
+		},
+	}
+
+	t.Run("with a matching item", func(t *testing.T) {
+		item := newTriggerTestItem("person", "Dylan", "something")
+
+		q, err := trigger.ProcessItem(item)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if q.GetType() != "dog" {
+			t.Errorf("expected type dog, got %v", q.GetType())
+		}
+
+		if q.GetMethod() != sdp.QueryMethod_SEARCH {
+			t.Errorf("expected method SEARCH, got %v", q.GetMethod())
+		}
+
+		if q.GetQuery() != "pug" {
+			t.Errorf("expected query pug, got %v", q.GetQuery())
+		}
+
+		if q.GetScope() != "something" {
+			t.Errorf("expected scope to default to that of the item, got %v", q.GetScope())
+		}
+
+		if string(q.GetUUID()) != string(item.GetMetadata().GetSourceQuery().GetUUID()) {
+			t.Error("expected UUID to be inherited from the source query")
+		}
+
+		if q.GetRecursionBehaviour().GetLinkDepth() != 3 {
+			t.Errorf("expected link depth to be inherited from the source query, got %v", q.GetRecursionBehaviour().GetLinkDepth())
+		}
+
+		if !q.GetIgnoreCache() {
+			t.Error("expected IgnoreCache to be inherited from the source query")
+		}
+	})
+
+	t.Run("with the wrong type", func(t *testing.T) {
+		_, err := trigger.ProcessItem(newTriggerTestItem("dog", "Dylan", "something"))
+
+		if !errors.Is(err, ErrTriggerNotMatched) {
+			t.Errorf("expected ErrTriggerNotMatched, got %v", err)
+		}
+	})
+
+	t.Run("with a non-matching unique attribute", func(t *testing.T) {
+		_, err := trigger.ProcessItem(newTriggerTestItem("person", "Dylan Ratcliffe", "something"))
+
+		if !errors.Is(err, ErrTriggerNotMatched) {
+			t.Errorf("expected ErrTriggerNotMatched, got %v", err)
+		}
+	})
+
+	t.Run("with a generator error", func(t *testing.T) {
+		_, err := trigger.ProcessItem(newTriggerTestItem("person", "dylan", "else"))
+
+		if err == nil || errors.Is(err, ErrTriggerNotMatched) {
+			t.Errorf("expected error from QueryGenerator, got %v", err)
+		}
+	})
+
+	t.Run("without a source query", func(t *testing.T) {
+		item := newTriggerTestItem("person", "Dylan", "something")
+		item.Metadata = nil
+
+		_, err := trigger.ProcessItem(item)
+
+		if err == nil || errors.Is(err, ErrTriggerNotMatched) {
+			t.Errorf("expected error for missing source query, got %v", err)
+		}
+	})
+
+	t.Run("with an explicit scope", func(t *testing.T) {
+		scoped := Trigger{
+			Type: "person",
+			QueryGenerator: func(in *sdp.Item) (*sdp.Query, error) {
+				return &sdp.Query{
+					Type:   "dog",
+					Method: sdp.QueryMethod_GET,
+					Query:  "rover",
+					Scope:  "kennel",
+				}, nil
+			},
+		}
+
+		q, err := scoped.ProcessItem(newTriggerTestItem("person", "anyone", "something"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if q.GetScope() != "kennel" {
+			t.Errorf("expected scope kennel, got %v", q.GetScope())
+		}
+	})
+}
+
+func TestEngineTriggers(t *testing.T) {
+	SkipWithoutNats(t)
+
+	ec := EngineConfig{
+		MaxParallelExecutions: 10,
+		SourceName:            "trigger-test",
+		NATSOptions: &auth.NATSOptions{
+			NumRetries:        5,
+			RetryDelay:        time.Second,
+			Servers:           NatsTestURLs,
+			ConnectionName:    "test-connection",
+			ConnectionTimeout: time.Second,
+			MaxReconnects:     5,
+		},
+	}
+
+	e, err := NewEngine(&ec)
+	if err != nil {
+		t.Fatalf("Error initializing Engine: %v", err)
+	}
+
+	adapter := TestAdapter{
+		ReturnScopes: []string{"test"},
+		ReturnType:   "person",
+		ReturnName:   "trigger-test-adapter",
+	}
+
+	err = e.AddAdapters(&adapter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.AddTriggers(Trigger{
+		Type:                      "dog",
+		UniqueAttributeValueRegex: regexp.MustCompile(`^rover$`),
+		QueryGenerator: func(in *sdp.Item) (*sdp.Query, error) {
+			return &sdp.Query{
+				Type:   "person",
+				Method: sdp.QueryMethod_GET,
+				Query:  "owner-of-rover",
+				Scope:  "test",
+			}, nil
+		},
+	})
+
+	err = e.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		err = e.Stop()
+		if err != nil {
+			t.Errorf("Error stopping Engine: %v", err)
+		}
+	})
+
+	// request.all, cancel.all, query.> and requests and cancellations for the
+	// "test" and "global" scopes
+	if len(e.subscriptions) != 7 {
+		t.Errorf("Expected engine to have 7 subscriptions, got %v", len(e.subscriptions))
+	}
+
+	item := newTriggerTestItem("dog", "rover", "test")
+	item.GetMetadata().GetSourceQuery().Deadline = timestamppb.New(time.Now().Add(10 * time.Second))
+
+	err = e.natsConnection.Publish(context.Background(), item.GetMetadata().GetSourceQuery().Subject(), &sdp.QueryResponse{
+		ResponseType: &sdp.QueryResponse_NewItem{
+			NewItem: item,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		adapter.mutex.Lock()
+		calls := len(adapter.GetCalls)
+		adapter.mutex.Unlock()
+
+		if calls > 0 {
+			return
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Error("expected trigger to result in a GET call to the adapter")
+}
+
+func TestTriggeredQueriesAreCancellable(t *testing.T) {
+	e := newDrainTestEngine(t, time.Minute)
+
+	e.AddTriggers(Trigger{
+		Type: "dog",
+		QueryGenerator: func(in *sdp.Item) (*sdp.Query, error) {
+			return &sdp.Query{
+				Type:   "person",
+				Method: sdp.QueryMethod_GET,
+				Query:  "owner-of-rover",
+				Scope:  "test",
+			}, nil
+		},
+	})
+
+	item := newTriggerTestItem("dog", "rover", "test")
+	u, err := uuid.FromBytes(item.GetMetadata().GetSourceQuery().GetUUID())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same item is delivered on two subjects at once, so both triggered
+	// queries share the UUID of the query that found it
+	start := make(chan struct{})
+	for range 2 {
+		go func() {
+			<-start
+			e.ProcessTriggers(context.Background(), item)
+		}()
+	}
+	close(start)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for e.numTriggeredQueries(u) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 triggered queries to be tracked, got %v", e.numTriggeredQueries(u))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := e.GetTrackedQuery(u); err == nil {
+		t.Error("expected triggered queries not to be tracked as the original query")
+	}
+
+	e.HandleCancelQuery(context.Background(), &sdp.CancelQuery{UUID: u[:]})
+
+	deadline = time.Now().Add(5 * time.Second)
+	for e.inFlightQueries.Load() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected both triggered queries to be cancelled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := e.numTriggeredQueries(u); n != 0 {
+		t.Errorf("expected triggered queries to stop being tracked, got %v", n)
+	}
+}
+
+func TestTriggersIgnoreOwnResults(t *testing.T) {
+	e, err := NewEngine(&EngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adapter := TestAdapter{ReturnScopes: []string{"test"}, ReturnName: "own-results"}
+	err = e.AddAdapters(&adapter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The trigger matches the type that its own query returns, so would fire
+	// forever if the engine acted on its own results
+	e.AddTriggers(Trigger{
+		Type: "person",
+		QueryGenerator: func(in *sdp.Item) (*sdp.Query, error) {
+			return &sdp.Query{
+				Type:   "person",
+				Method: sdp.QueryMethod_GET,
+				Query:  in.UniqueAttributeValue() + "-friend",
+				Scope:  "test",
+			}, nil
+		},
+	})
+
+	getCalls := func() int {
+		adapter.mutex.Lock()
+		defer adapter.mutex.Unlock()
+
+		return len(adapter.GetCalls)
+	}
+
+	// An item from another source fires the trigger
+	e.ProcessTriggers(context.Background(), newTriggerTestItem("person", "dylan", "test"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for getCalls() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the trigger to fire for an item from another source")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The results of the triggered query are seen again over NATS, but
+	// mustn't fire the trigger
+	var own *sdp.Item
+	for item, err := range e.Query(context.Background(), &sdp.Query{
+		Type:        "person",
+		Method:      sdp.QueryMethod_GET,
+		Query:       "dylan-friend",
+		Scope:       "test",
+		IgnoreCache: true,
+	}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		own = item
+	}
+	if own == nil {
+		t.Fatal("expected an item")
+	}
+
+	calls := getCalls()
+	e.ProcessTriggers(context.Background(), own)
+	time.Sleep(100 * time.Millisecond)
+
+	if n := getCalls(); n != calls {
+		t.Errorf("expected the engine's own results not to fire the trigger, got %v more GET calls", n-calls)
+	}
+}